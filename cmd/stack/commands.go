@@ -0,0 +1,479 @@
+/*
+Copyright 2020 The Stack Authors.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/graph"
+	"github.com/kruglovmax/stack/pkg/log"
+	"github.com/kruglovmax/stack/pkg/plan"
+	"github.com/kruglovmax/stack/pkg/stack"
+	"github.com/kruglovmax/stack/pkg/types"
+
+	"github.com/spf13/pflag"
+)
+
+// command of the CLI
+type command struct {
+	name        string
+	usage       string
+	description string
+	hidden      bool
+	// flags registers flags of the command
+	flags func(fs *pflag.FlagSet, cli *cli)
+	// run executes the command with positional args and returns the exit code
+	run func(cli *cli, args []string) int
+}
+
+// cli holds values of flags
+type cli struct {
+	options   stack.Options
+	version   bool
+	varsKey   string
+	varsRun   bool
+	format    string
+	olderThan time.Duration
+	// values of config flags and their sources by config keys
+	values  map[string]string
+	sources map[string]string
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name:        "run",
+			usage:       "run [flags]",
+			description: "Run the stack tree. Flags without a command run it too",
+			flags: func(fs *pflag.FlagSet, cli *cli) {
+				globalFlags(fs, cli)
+				loadFlags(fs, cli)
+				selectFlags(fs, cli)
+				execFlags(fs, cli)
+				fs.BoolVar(&cli.options.Watch, "watch", false, "after the run re-run stacks whose files, templates or libs changed")
+				fs.DurationVar(&cli.options.WatchInterval, "watch-interval", consts.DefaultWatchInterval, "--watch: interval of polling files for changes")
+				fs.BoolVar(&cli.options.DryRun, "dry-run", false, "print the resolved stack tree without executing anything (same as stack plan)")
+				fs.StringVar(&cli.options.PlanFormat, "plan-format", "text", "dry-run output format(text, json).")
+				fs.BoolVar(&cli.version, "version", false, "get version number")
+				fs.MarkHidden("version")
+			},
+			run: runCommand,
+		},
+		{
+			name:        "plan",
+			usage:       "plan [flags]",
+			description: "Print the resolved stack tree without executing anything",
+			flags: func(fs *pflag.FlagSet, cli *cli) {
+				globalFlags(fs, cli)
+				loadFlags(fs, cli)
+				selectFlags(fs, cli)
+				fs.StringVar(&cli.options.PlanFormat, "format", "text", "output format(text, json).")
+			},
+			run: planCommand,
+		},
+		{
+			name:        "validate",
+			usage:       "validate [flags]",
+			description: "Check the whole stack tree without executing anything",
+			flags: func(fs *pflag.FlagSet, cli *cli) {
+				globalFlags(fs, cli)
+				loadFlags(fs, cli)
+			},
+			run: validateCommand,
+		},
+		{
+			name:        "vars",
+			usage:       "vars <stack path> [flags]",
+			description: "Print resolved vars of the stack and where they came from",
+			flags: func(fs *pflag.FlagSet, cli *cli) {
+				globalFlags(fs, cli)
+				loadFlags(fs, cli)
+				fs.StringVar(&cli.varsKey, "key", "", "explain only the var with this dotted path and its nested vars")
+				fs.BoolVar(&cli.varsRun, "run", false, "run the stack tree and explain vars as they were when the stack finished")
+				execFlags(fs, cli)
+			},
+			run: varsCommand,
+		},
+		{
+			name:        "graph",
+			usage:       "graph [flags]",
+			description: "Print the graph of the stack tree",
+			flags: func(fs *pflag.FlagSet, cli *cli) {
+				globalFlags(fs, cli)
+				loadFlags(fs, cli)
+				selectFlags(fs, cli)
+				fs.StringVar(&cli.format, "format", "dot", "output format(dot, mermaid, json).")
+			},
+			run: graphCommand,
+		},
+		{
+			name:        "cache",
+			usage:       "cache prune [flags]",
+			description: "Remove entries of the run items cache",
+			flags: func(fs *pflag.FlagSet, cli *cli) {
+				globalFlags(fs, cli)
+				workdirFlag(fs, cli)
+				fs.DurationVar(&cli.olderThan, "older-than", 0, "remove only entries not used for this duration")
+			},
+			run: cacheCommand,
+		},
+		{
+			name:        "config",
+			usage:       "config show [flags]",
+			description: "Print the effective configuration and where each value came from",
+			flags: func(fs *pflag.FlagSet, cli *cli) {
+				findCommand("run").flags(fs, cli)
+			},
+			run: configCommand,
+		},
+		{
+			name:        "version",
+			usage:       "version",
+			description: "Print the version",
+			flags:       func(fs *pflag.FlagSet, cli *cli) {},
+			run: func(cli *cli, args []string) int {
+				fmt.Println(version)
+				return consts.ExitCodeOK
+			},
+		},
+		{
+			name:        "completion",
+			usage:       "completion bash|zsh|fish",
+			description: "Print the shell completion script",
+			flags:       func(fs *pflag.FlagSet, cli *cli) {},
+			run:         completionCommand,
+		},
+		{
+			name:   completeCommandName,
+			usage:  completeCommandName + " [words...] <current word>",
+			hidden: true,
+			flags:  func(fs *pflag.FlagSet, cli *cli) {},
+			run:    completeCommand,
+		},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func (cmd *command) flagSet(cli *cli) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(cmd.name, pflag.ContinueOnError)
+	fs.Usage = func() {
+		cmd.printUsage(fs)
+	}
+	cmd.flags(fs, cli)
+	return fs
+}
+
+// execute parses args of the command and runs it
+func (cmd *command) execute(args []string) int {
+	cli := new(cli)
+	if cmd.name == completeCommandName {
+		// words of the completed command line are not flags of __complete
+		return cmd.run(cli, args)
+	}
+	fs := cmd.flagSet(cli)
+	err := fs.Parse(args)
+	switch {
+	case err == pflag.ErrHelp:
+		return consts.ExitCodeOK
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Error: %s\n\n", err.Error())
+		fs.Usage()
+		return 2
+	}
+	if err := cli.applyConfig(cmd, fs); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 2
+	}
+	return cmd.run(cli, fs.Args())
+}
+
+func (cmd *command) printUsage(fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "USAGE\n")
+	fmt.Fprintf(os.Stderr, "  %s %s\n", product, cmd.usage)
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "DESCRIPTION\n")
+	fmt.Fprintf(os.Stderr, "  %s.\n", cmd.description)
+	if fs.HasAvailableFlags() {
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "FLAGS\n")
+		fs.PrintDefaults()
+	}
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "DESCRIPTION\n")
+	fmt.Fprintf(os.Stderr, "  stack is more than template tool.\n")
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "USAGE\n")
+	fmt.Fprintf(os.Stderr, "  %s <command> [flags]\n", product)
+	fmt.Fprintf(os.Stderr, "  %s [flags] (same as %s run [flags])\n", product, product)
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "COMMANDS\n")
+	for _, cmd := range commands {
+		if !cmd.hidden {
+			fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.description)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "  %-12s %s\n", "help", "Print help of the command")
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "Run '%s help <command>' for flags of the command.\n", product)
+}
+
+// helpCommand prints usage of the command or of the CLI
+func helpCommand(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return consts.ExitCodeOK
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n\n", args[0])
+		printUsage()
+		return 2
+	}
+	cmd.flagSet(new(cli)).Usage()
+	return consts.ExitCodeOK
+}
+
+func globalFlags(fs *pflag.FlagSet, cli *cli) {
+	fs.StringVarP(&cli.options.LogFormat, "log-format", "l", "fmt", "change the log format(json, fmt).")
+	fs.CountVarP(&cli.options.Verbosity, "verb", "v", "verbosity")
+}
+
+func workdirFlag(fs *pflag.FlagSet, cli *cli) {
+	fs.StringVarP(&cli.options.Workdir, "workdir", "w", ".", `Working directory
+Example:
+--workdir="stackDir"
+or
+-w stackDir`)
+}
+
+// loadFlags are flags of loading the stack tree
+func loadFlags(fs *pflag.FlagSet, cli *cli) {
+	workdirFlag(fs, cli)
+	fs.StringSliceVarP(&cli.options.CLIValues, "set", "s", []string{}, `Additional vars
+Example:
+--set="name=value,topname.subname=value"`)
+	fs.StringArrayVar(&cli.options.CLIStringValues, "set-string", []string{}, `Additional vars, values are strings
+Example:
+--set-string="version=1.10,flag=true"`)
+	fs.StringArrayVar(&cli.options.CLIFileValues, "set-file", []string{}, `Additional vars, values are contents of files
+Example:
+--set-file="tls.cert=certs/tls.crt"`)
+	fs.StringArrayVar(&cli.options.CLIJSONValues, "set-json", []string{}, `Additional var with the JSON value
+Example:
+--set-json='resources={"cpu": "100m", "ports": [80, 443]}'`)
+	fs.StringSliceVarP(&cli.options.VarFiles, "file", "f", []string{}, `Files with additional vars, - reads stdin
+Example:
+-f vars.yaml -f vars2.yaml`)
+	fs.StringVar(&cli.options.GitLibsPath, "gitlibs-path", consts.GitLibsPath, `Directory where to clone libs from git
+Example:
+--gitlibs-path=".libs"`)
+	fs.DurationVar(&cli.options.DefaultTimeout, "wait-timeout", consts.DefaultTimeout,
+		"duration after which sync operations time out")
+}
+
+// selectFlags are flags of selecting stacks of the tree
+func selectFlags(fs *pflag.FlagSet, cli *cli) {
+	fs.StringSliceVar(&cli.options.Only, "only", []string{}, `Run only stacks matching the pattern and their child stacks.
+Patterns match the stack path relative to the root stack
+Example:
+--only="infra/external-dns" --only="apps/*"`)
+	fs.StringSliceVar(&cli.options.Skip, "skip", []string{}, `Skip stacks matching the pattern and their child stacks
+Example:
+--skip="infra/*"`)
+	fs.BoolVar(&cli.options.WithAncestors, "with-ancestors", false, "--only: execute run items of ancestors of selected stacks too")
+}
+
+// execFlags are flags of executing run items
+func execFlags(fs *pflag.FlagSet, cli *cli) {
+	fs.DurationVar(&cli.options.KillGrace, "kill-grace", consts.DefaultKillGrace,
+		"duration between SIGTERM and SIGKILL for cancelled scripts")
+	fs.StringVar(&cli.options.ReportJSON, "report-json", "", "write run report with statuses and timings of stacks and run items to the JSON file")
+	fs.StringVar(&cli.options.ReportJUnit, "report-junit", "", "write run report to the JUnit XML file")
+	fs.BoolVar(&cli.options.Resume, "resume", false, "skip stacks and run items of stacks finished by the previous failed run")
+	fs.BoolVar(&cli.options.NoCache, "no-cache", false, "ignore cache: true of run items")
+	fs.IntVarP(&cli.options.Jobs, "jobs", "j", 0, "max number of branches of the whole tree executed at the same time: the root stack, pstacks and elements of parallel groups and foreach at any depth (0 - unlimited). maxParallel only narrows it")
+}
+
+// runner sets up logging and returns the runner.
+// Errors are printed, nil is returned then
+func (cli *cli) runner() *stack.Runner {
+	log.SetFormat(cli.options.LogFormat)
+	log.SetLevel(cli.options.Verbosity)
+
+	runner, err := stack.NewRunner(cli.options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return nil
+	}
+	return runner
+}
+
+func noArgs(name string, args []string) bool {
+	if len(args) == 0 {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "Error: unexpected arguments of %s: %s\n", name, strings.Join(args, " "))
+	return false
+}
+
+func runCommand(cli *cli, args []string) int {
+	if cli.version {
+		fmt.Println(version)
+		return consts.ExitCodeOK
+	}
+	if !noArgs("run", args) {
+		return 2
+	}
+	if cli.options.DryRun {
+		return planCommand(cli, args)
+	}
+	runner := cli.runner()
+	if runner == nil {
+		return 2
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	var result *stack.Result
+	if cli.options.Watch {
+		result = runner.Watch(ctx)
+	} else {
+		result = runner.Run(ctx)
+	}
+
+	switch result.ExitCode {
+	case consts.ExitCodeOK:
+		log.Logger.Info().Int("Code", result.ExitCode).Msg("DONE")
+	default:
+		log.Logger.Error().Int("Code", result.ExitCode).Msg("FAIL")
+	}
+	return result.ExitCode
+}
+
+func planCommand(cli *cli, args []string) int {
+	if !noArgs("plan", args) {
+		return 2
+	}
+	runner := cli.runner()
+	if runner == nil {
+		return 2
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	stackPlan, err := runner.Plan(ctx)
+	if err == nil {
+		err = plan.Print(os.Stdout, stackPlan, cli.options.PlanFormat)
+		if err != nil {
+			log.Logger.Error().Msg(err.Error())
+		}
+	}
+	if err != nil {
+		return types.ExitCode(err)
+	}
+	return consts.ExitCodeOK
+}
+
+func validateCommand(cli *cli, args []string) int {
+	if !noArgs("validate", args) {
+		return 2
+	}
+	runner := cli.runner()
+	if runner == nil {
+		return 2
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	if err := runner.Validate(ctx); err != nil {
+		return types.ExitCode(err)
+	}
+	log.Logger.Info().Msg("Stack tree is valid")
+	return consts.ExitCodeOK
+}
+
+func varsCommand(cli *cli, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Error: stack path is required\n")
+		return 2
+	}
+	if cli.varsRun {
+		cli.options.ExplainVars = args[0]
+	}
+	runner := cli.runner()
+	if runner == nil {
+		return 2
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	if cli.varsRun {
+		result := runner.Run(ctx)
+		plan.PrintVars(os.Stdout, result.ExplainedVars, cli.varsKey)
+		return result.ExitCode
+	}
+	explained, err := runner.ExplainVars(ctx, args[0])
+	if err != nil {
+		return types.ExitCode(err)
+	}
+	plan.PrintVars(os.Stdout, explained, cli.varsKey)
+	return consts.ExitCodeOK
+}
+
+func graphCommand(cli *cli, args []string) int {
+	if !noArgs("graph", args) {
+		return 2
+	}
+	runner := cli.runner()
+	if runner == nil {
+		return 2
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	stackPlan, err := runner.Plan(ctx)
+	if err != nil {
+		return types.ExitCode(err)
+	}
+	if err = graph.Print(os.Stdout, graph.Build(stackPlan), cli.format); err != nil {
+		log.Logger.Error().Msg(err.Error())
+		return 2
+	}
+	return consts.ExitCodeOK
+}
+
+func cacheCommand(cli *cli, args []string) int {
+	if len(args) != 1 || args[0] != "prune" {
+		fmt.Fprintf(os.Stderr, "Error: unknown cache command %q\n", strings.Join(args, " "))
+		return 2
+	}
+	runner := cli.runner()
+	if runner == nil {
+		return 2
+	}
+	removed, cacheDir, err := runner.PruneCache(cli.olderThan)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 2
+	}
+	fmt.Printf("Removed %d cache entries from %s\n", removed, cacheDir)
+	return consts.ExitCodeOK
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2020 The Stack Authors.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/misc"
+
+	"github.com/spf13/pflag"
+)
+
+// completeCommandName is the hidden command called by completion scripts
+const completeCommandName = "__complete"
+
+// completion scripts call stack __complete with words of the command line
+// after the program name. The last word is the completed one. When nothing
+// is printed the shell completes file names
+var completionScripts = map[string]string{
+	"bash": `# bash completion for stack
+_stack() {
+    local IFS=$'\n'
+    COMPREPLY=($(stack __complete "${COMP_WORDS[@]:1:COMP_CWORD-1}" "${COMP_WORDS[COMP_CWORD]}" 2>/dev/null))
+}
+complete -o default -F _stack stack
+`,
+	"zsh": `#compdef stack
+# zsh completion for stack
+_stack() {
+    local -a candidates
+    candidates=("${(@f)$(stack __complete "${(@)words[2,CURRENT-1]}" "${words[CURRENT]}" 2>/dev/null)}")
+    if [[ -n "${candidates[1]}" ]]; then
+        compadd -- "${candidates[@]}"
+    else
+        _files
+    fi
+}
+compdef _stack stack
+`,
+	"fish": `# fish completion for stack
+function __stack_complete
+    set -l candidates (stack __complete (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)
+    if test (count $candidates) -gt 0
+        printf '%s\n' $candidates
+    else
+        __fish_complete_path (commandline -ct)
+    end
+end
+complete -c stack -f -a '(__stack_complete)'
+`,
+}
+
+// flagValues are completions of flag values, stack paths for nil
+var flagValues = map[string][]string{
+	"only":        nil,
+	"skip":        nil,
+	"log-format":  {"fmt", "json"},
+	"plan-format": {"text", "json"},
+}
+
+// formatValues are completions of --format of commands
+var formatValues = map[string][]string{
+	"plan":  {"text", "json"},
+	"graph": {"dot", "mermaid", "json"},
+}
+
+func completionCommand(cli *cli, args []string) int {
+	if len(args) == 1 {
+		if script, ok := completionScripts[args[0]]; ok {
+			fmt.Print(script)
+			return consts.ExitCodeOK
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Error: shell is required: bash, zsh or fish\n")
+	return 2
+}
+
+func completeCommand(cli *cli, args []string) int {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	for _, candidate := range complete(args[:len(args)-1], args[len(args)-1]) {
+		fmt.Println(candidate)
+	}
+	return consts.ExitCodeOK
+}
+
+// complete returns candidates for the current word of the command line
+func complete(words []string, current string) (candidates []string) {
+	cmd := findCommand("run")
+	positional := words
+	if len(words) > 0 && !strings.HasPrefix(words[0], "-") {
+		if cmd = findCommand(words[0]); cmd == nil {
+			return
+		}
+		positional = words[1:]
+	}
+	if len(words) == 0 && !strings.HasPrefix(current, "-") {
+		for _, cmd := range commands {
+			if !cmd.hidden {
+				candidates = append(candidates, cmd.name)
+			}
+		}
+		return filterPrefix(append(candidates, "help"), current)
+	}
+
+	fs := cmd.flagSet(new(cli))
+	// bash splits --flag=value into three words
+	if len(words) > 1 && words[len(words)-1] == "=" {
+		words = words[:len(words)-1]
+	}
+	if parts := strings.SplitN(current, "=", 2); len(parts) == 2 && strings.HasPrefix(parts[0], "--") {
+		for _, candidate := range completeFlagValue(cmd, fs, words, strings.TrimPrefix(parts[0], "--"), parts[1]) {
+			candidates = append(candidates, parts[0]+"="+candidate)
+		}
+		return
+	}
+	if len(words) > 0 && strings.HasPrefix(words[len(words)-1], "-") {
+		if flag := lookupFlag(fs, words[len(words)-1]); flag != nil && flag.NoOptDefVal == "" {
+			return completeFlagValue(cmd, fs, words, flag.Name, current)
+		}
+	}
+	if strings.HasPrefix(current, "-") {
+		fs.VisitAll(func(flag *pflag.Flag) {
+			if !flag.Hidden {
+				candidates = append(candidates, "--"+flag.Name)
+			}
+		})
+		return filterPrefix(candidates, current)
+	}
+
+	var args []string
+	for i := 0; i < len(positional); i++ {
+		switch {
+		case strings.HasPrefix(positional[i], "-"):
+			if flag := lookupFlag(fs, positional[i]); flag != nil && flag.NoOptDefVal == "" && !strings.Contains(positional[i], "=") {
+				i++
+			}
+		default:
+			args = append(args, positional[i])
+		}
+	}
+	if len(args) > 0 {
+		return
+	}
+	switch cmd.name {
+	case "vars":
+		return filterPrefix(stackPaths(workdirOf(fs, words)), current)
+	case "cache":
+		return filterPrefix([]string{"prune"}, current)
+	case "completion":
+		return filterPrefix([]string{"bash", "fish", "zsh"}, current)
+	}
+	return
+}
+
+func completeFlagValue(cmd *command, fs *pflag.FlagSet, words []string, name, current string) []string {
+	if name == "format" {
+		return filterPrefix(formatValues[cmd.name], current)
+	}
+	values, ok := flagValues[name]
+	if !ok {
+		return nil
+	}
+	if values == nil {
+		values = stackPaths(workdirOf(fs, words))
+	}
+	return filterPrefix(values, current)
+}
+
+// lookupFlag returns the flag of the word like --name, --name=value or -n
+func lookupFlag(fs *pflag.FlagSet, word string) *pflag.Flag {
+	name := strings.SplitN(strings.TrimLeft(word, "-"), "=", 2)[0]
+	if strings.HasPrefix(word, "--") {
+		return fs.Lookup(name)
+	}
+	if len(name) == 1 {
+		return fs.ShorthandLookup(name)
+	}
+	return nil
+}
+
+// workdirOf returns the value of --workdir in words
+func workdirOf(fs *pflag.FlagSet, words []string) string {
+	workdir := "."
+	for i, word := range words {
+		flag := lookupFlag(fs, word)
+		if flag == nil || flag.Name != "workdir" {
+			continue
+		}
+		if parts := strings.SplitN(word, "=", 2); len(parts) == 2 {
+			workdir = parts[1]
+		} else if i+1 < len(words) {
+			workdir = words[i+1]
+		}
+	}
+	return workdir
+}
+
+// stackPaths returns paths of dirs with stack files below the workdir
+func stackPaths(workdir string) (paths []string) {
+	filepath.Walk(workdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path != workdir && (strings.HasPrefix(info.Name(), ".") || info.Name() == "node_modules") {
+			return filepath.SkipDir
+		}
+		if _, err := misc.FindStackFileInDir(path); err == nil {
+			if rel, err := filepath.Rel(workdir, path); err == nil && rel != "." {
+				paths = append(paths, rel)
+			}
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	return
+}
+
+func filterPrefix(values []string, prefix string) (output []string) {
+	for _, value := range values {
+		if strings.HasPrefix(value, prefix) {
+			output = append(output, value)
+		}
+	}
+	return
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2020 The Stack Authors.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/stackrc"
+
+	"github.com/spf13/pflag"
+)
+
+// configKeys are flags of app.Config fields. Their defaults are taken from
+// STACK_* env vars and the project config
+var configKeys = []string{
+	"log-format", "verb",
+	"workdir", "set", "set-string", "set-file", "set-json", "file", "gitlibs-path", "wait-timeout",
+	"only", "skip", "with-ancestors",
+	"kill-grace", "report-json", "report-junit", "resume", "no-cache", "jobs",
+	"watch", "watch-interval", "dry-run", "plan-format",
+}
+
+// configFlagNames are flags of commands named not as their config keys
+var configFlagNames = map[string]map[string]string{
+	"plan": {"plan-format": "format"},
+}
+
+// Sources of config values
+const (
+	sourceDefault = "default"
+	sourceFlag    = "flag"
+)
+
+// envName returns the env var with the default of the config key
+func envName(key string) string {
+	return consts.EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+func configFlagName(cmd *command, key string) string {
+	if name, ok := configFlagNames[cmd.name][key]; ok {
+		return name
+	}
+	return key
+}
+
+// applyConfig sets config flags not given on the command line from
+// STACK_* env vars or, if not set there, from the project config
+// found upward from the workdir. Saves values and their sources by config keys
+func (cli *cli) applyConfig(cmd *command, fs *pflag.FlagSet) (err error) {
+	sources := make(map[string]string)
+	cli.sources = sources
+	defer func() {
+		cli.values = make(map[string]string)
+		for key := range sources {
+			cli.values[key] = fs.Lookup(configFlagName(cmd, key)).Value.String()
+		}
+	}()
+	for _, key := range configKeys {
+		if flag := fs.Lookup(configFlagName(cmd, key)); flag != nil {
+			sources[key] = sourceDefault
+			if flag.Changed {
+				sources[key] = sourceFlag
+			}
+		}
+	}
+	if len(sources) == 0 {
+		return
+	}
+
+	workdir := "."
+	if flag := fs.Lookup("workdir"); flag != nil && flag.Changed {
+		workdir = flag.Value.String()
+	} else if value, ok := os.LookupEnv(envName("workdir")); ok {
+		workdir = value
+	}
+	rcFile, err := stackrc.Find(workdir)
+	if err != nil {
+		return
+	}
+	var rcValues map[string]interface{}
+	if rcFile != "" {
+		if rcValues, err = stackrc.Load(rcFile); err != nil {
+			return
+		}
+		for key := range rcValues {
+			if !isConfigKey(key) {
+				return fmt.Errorf("%s: unknown key %q", rcFile, key)
+			}
+		}
+	}
+
+	for _, key := range configKeys {
+		if sources[key] != sourceDefault {
+			continue
+		}
+		name := configFlagName(cmd, key)
+		if value, ok := os.LookupEnv(envName(key)); ok {
+			if err = fs.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %w", envName(key), err)
+			}
+			sources[key] = "env " + envName(key)
+			continue
+		}
+		rcValue, ok := rcValues[key]
+		if !ok {
+			continue
+		}
+		items, isList := rcValue.([]interface{})
+		if !isList {
+			items = []interface{}{rcValue}
+		}
+		for _, item := range items {
+			value := fmt.Sprint(item)
+			if key == "workdir" && !filepath.IsAbs(value) {
+				// workdir of the project config is relative to the config
+				value = filepath.Join(filepath.Dir(rcFile), value)
+			}
+			if err = fs.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %s: %w", rcFile, key, err)
+			}
+		}
+		sources[key] = rcFile
+	}
+	return
+}
+
+func isConfigKey(key string) bool {
+	for _, configKey := range configKeys {
+		if configKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+func configCommand(cli *cli, args []string) int {
+	if len(args) != 1 || args[0] != "show" {
+		fmt.Fprintf(os.Stderr, "Error: unknown config command %q\n", strings.Join(args, " "))
+		return 2
+	}
+	width := 0
+	for _, key := range configKeys {
+		if len(key) > width {
+			width = len(key)
+		}
+	}
+	for _, key := range configKeys {
+		fmt.Printf("%-*s  %-20s  %s\n", width, key, cli.values[key], cli.sources[key])
+	}
+	return consts.ExitCodeOK
+}
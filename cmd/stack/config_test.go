@@ -0,0 +1,83 @@
+/*
+Copyright 2020 The Stack Authors.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kruglovmax/stack/pkg/consts"
+)
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stackrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rc := "jobs: 3\nkill-grace: 7s\nwait-timeout: 1m\nset:\n- a=rc\n- b=rc\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, consts.StackRCFileName), []byte(rc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setEnv(t, envName("kill-grace"), "9s")
+	setEnv(t, envName("wait-timeout"), "2m")
+
+	cmd := findCommand("run")
+	cli := new(cli)
+	fs := cmd.flagSet(cli)
+	if err = fs.Parse([]string{"--workdir", dir, "--wait-timeout", "3m"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.applyConfig(cmd, fs); err != nil {
+		t.Fatal(err)
+	}
+	rcFile := filepath.Join(dir, consts.StackRCFileName)
+	for key, want := range map[string][2]string{
+		"wait-timeout": {"3m0s", sourceFlag},
+		"kill-grace":   {"9s", "env " + envName("kill-grace")},
+		"jobs":         {"3", rcFile},
+		"set":          {"[a=rc,b=rc]", rcFile},
+		"resume":       {"false", sourceDefault},
+	} {
+		if value, source := cli.values[key], cli.sources[key]; value != want[0] || source != want[1] {
+			t.Errorf("%s = %q from %q, want %q from %q", key, value, source, want[0], want[1])
+		}
+	}
+}
+
+func TestApplyConfigUnknownKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stackrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, consts.StackRCFileName), []byte("nosuch: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := findCommand("run")
+	cli := new(cli)
+	fs := cmd.flagSet(cli)
+	if err = fs.Parse([]string{"--workdir", dir}); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.applyConfig(cmd, fs); err == nil {
+		t.Error("applyConfig with an unknown key of the project config returned no error")
+	}
+}
+
+// setEnv sets the env var until the end of the test
+func setEnv(t *testing.T, name, value string) {
+	previous, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
@@ -5,20 +5,17 @@ Copyright 2020 The Stack Authors.
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"os"
-	"path/filepath"
-	"runtime/debug"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/davecgh/go-spew/spew"
-	"github.com/kruglovmax/stack/pkg/app"
 	"github.com/kruglovmax/stack/pkg/consts"
 	"github.com/kruglovmax/stack/pkg/log"
-	"github.com/kruglovmax/stack/pkg/stack"
-
-	"github.com/spf13/pflag"
 )
 
 const (
@@ -29,85 +26,65 @@ const (
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
-	// Cancel even if everything goes fine without an error to release resources.
-	defer app.App.Cancel()
-
-	// Flag domain.
-	fs := pflag.NewFlagSet("default", pflag.ContinueOnError)
-	fs.Usage = func() {
-		fmt.Fprintf(os.Stderr, "DESCRIPTION\n")
-		fmt.Fprintf(os.Stderr, "  stack is more than template tool.\n")
-		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "FLAGS\n")
-		fs.PrintDefaults()
+	name, args := splitCommand(os.Args[1:])
+	switch {
+	case name == "help":
+		os.Exit(helpCommand(args))
+	case len(os.Args) == 2 && (os.Args[1] == "-h" || os.Args[1] == "--help"):
+		printUsage()
+		os.Exit(consts.ExitCodeOK)
 	}
 
-	versionFlag := fs.Bool("version", false, "get version number")
-
-	app.App.Config.LogFormat = fs.StringP("log-format", "l", "fmt", "change the log format(json, fmt).")
-	app.App.Config.Verbosity = fs.CountP("verb", "v", "verbosity")
-	app.App.Config.CLIValues = fs.StringSliceP("set", "s", []string{}, `Additional vars
-Example:
---set="name=value,topname.subname=value"`)
-	app.App.Config.VarFiles = fs.StringSliceP("file", "f", []string{}, `Files with additional vars
-Example:
--f vars.yaml -f vars2.yaml`)
-	app.App.Config.Workdir = fs.StringP("workdir", "w", ".", `Working directory
-Example:
---workdir="stackDir"
-or
--w stackDir`)
-	app.App.Config.GitLibsPath = fs.String("gitlibs-path", consts.GitLibsPath, `Directory where to clone libs from git
-Example:
---gitlibs-path=".libs"`)
-	app.App.Config.DefaultTimeout = fs.Duration("wait-timeout", consts.DefaultTimeout,
-		"duration after which sync operations time out")
-
-	err := fs.Parse(os.Args[1:])
-	switch {
-	case err == pflag.ErrHelp:
-		os.Exit(0)
-	case err != nil:
-		fmt.Fprintf(os.Stderr, "Error: %s\n\n", err.Error())
-		fs.Usage()
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n\n", name)
+		printUsage()
 		os.Exit(2)
-	case *versionFlag:
-		fmt.Println(version)
-		os.Exit(0)
 	}
+	os.Exit(cmd.execute(args))
+}
 
-	log.SetFormat(*app.App.Config.LogFormat)
-
-	log.SetLevel(*app.App.Config.Verbosity)
-
-	pwd, err := os.Getwd()
-	if err != nil {
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Msg(err.Error())
-	}
-	if !filepath.IsAbs(*app.App.Config.Workdir) {
-		pwd := filepath.Join(pwd, *app.App.Config.Workdir)
-		app.App.Config.Workdir = &pwd
-	}
-	if err := os.Chdir(*app.App.Config.Workdir); err != nil {
-		log.Logger.Trace().
-			Msg(spew.Sdump(*app.App.Config.Workdir))
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Msg(err.Error())
+// splitCommand returns the command and its args. Flags may go before
+// the command, without a command args are flags of run
+func splitCommand(args []string) (string, []string) {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--":
+			return "run", args
+		case strings.HasPrefix(args[i], "-"):
+			if !strings.Contains(args[i], "=") && flagTakesValue(args[i]) {
+				i++
+			}
+		default:
+			rest := append(append([]string(nil), args[:i]...), args[i+1:]...)
+			return args[i], rest
+		}
 	}
+	return "run", args
+}
 
-	stack.RunRootStack(*app.App.Config.Workdir)
-
-	switch app.App.AppError {
-	case consts.ExitCodeOK:
-		log.Logger.Info().Int("Code", app.App.AppError).Msg("DONE")
-	default:
-		log.Logger.Error().Int("Code", app.App.AppError).Msg("FAIL")
+// flagTakesValue reports whether the flag of any command is followed by its value
+func flagTakesValue(word string) bool {
+	for _, cmd := range commands {
+		if flag := lookupFlag(cmd.flagSet(new(cli)), word); flag != nil {
+			return flag.NoOptDefVal == ""
+		}
 	}
+	return false
+}
 
-	os.Exit(app.App.AppError)
+// interruptContext is cancelled by SIGINT or SIGTERM
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-c:
+			log.Logger.Error().Msg("SIGTERM received. Gracefully shutting down...")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
 }
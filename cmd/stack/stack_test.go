@@ -0,0 +1,32 @@
+/*
+Copyright 2020 The Stack Authors.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	for _, test := range []struct {
+		args    []string
+		command string
+		rest    []string
+	}{
+		{nil, "run", nil},
+		{[]string{"plan"}, "plan", nil},
+		{[]string{"-w", "dir", "plan", "--format", "json"}, "plan", []string{"-w", "dir", "--format", "json"}},
+		{[]string{"--workdir=dir", "validate"}, "validate", []string{"--workdir=dir"}},
+		{[]string{"--resume", "plan"}, "plan", []string{"--resume"}},
+		{[]string{"-w", "plan"}, "run", []string{"-w", "plan"}},
+		{[]string{"--jobs", "2"}, "run", []string{"--jobs", "2"}},
+		{[]string{"--", "plan"}, "run", []string{"--", "plan"}},
+	} {
+		command, rest := splitCommand(test.args)
+		if command != test.command || !reflect.DeepEqual(rest, test.rest) {
+			t.Errorf("splitCommand(%q) = %q, %q, want %q, %q", test.args, command, rest, test.command, test.rest)
+		}
+	}
+}
@@ -5,6 +5,7 @@ go 1.14
 require (
 	cloud.google.com/go/storage v1.10.0 // indirect
 	github.com/Azure/go-autorest/autorest v0.11.4 // indirect
+	github.com/BurntSushi/toml v0.3.1
 	github.com/Jeffail/gabs v1.4.0
 	github.com/Jeffail/gabs/v2 v2.6.0
 	github.com/Microsoft/go-winio v0.4.15-0.20190919025122-fc70bd9a86b5 // indirect
@@ -17,6 +18,7 @@ require (
 	github.com/hairyhenderson/gomplate/v3 v3.8.0
 	github.com/imdario/mergo v0.3.11
 	github.com/joeycumines/go-dotnotation v0.0.0-20180131115956-2d3612e36c5d
+	github.com/joho/godotenv v1.3.0
 	github.com/lib/pq v1.7.0 // indirect
 	github.com/mattn/go-colorable v0.1.7 // indirect
 	github.com/opencontainers/go-digest v1.0.0 // indirect
@@ -26,6 +28,7 @@ require (
 	github.com/xeipuuv/gojsonschema v1.2.0
 	go.mozilla.org/sops/v3 v3.6.1
 	google.golang.org/genproto v0.0.0-20200618031413-b414f8b61790
+	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776
 	k8s.io/helm v2.16.12+incompatible
 	sigs.k8s.io/yaml v1.2.0
 )
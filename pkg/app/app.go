@@ -3,82 +3,171 @@ package app
 import (
 	"context"
 	"fmt"
-	"os"
-	"os/signal"
+	"io"
 	"sync"
-	"syscall"
 	"time"
 
-	"github.com/kruglovmax/stack/pkg/consts"
-	"github.com/kruglovmax/stack/pkg/log"
+	"github.com/kruglovmax/stack/pkg/cache"
+	"github.com/kruglovmax/stack/pkg/checkpoint"
 	"github.com/kruglovmax/stack/pkg/out"
+	"github.com/kruglovmax/stack/pkg/report"
+	"github.com/kruglovmax/stack/pkg/scheduler"
+	"github.com/kruglovmax/stack/pkg/selector"
 	"github.com/kruglovmax/stack/pkg/types"
+	"github.com/kruglovmax/stack/pkg/watch"
+	"github.com/rs/zerolog"
 )
 
-// App global var
-var (
-	App *app
-)
+type contextKey struct{}
 
-type app struct {
+// State of one run of a stack tree. Every stack of the tree
+// carries it in its context
+type State struct {
 	Context       context.Context
 	Cancel        context.CancelFunc
-	Config        *appConfig
+	Interrupt     context.Context
+	interrupt     context.CancelFunc
+	Config        *Config
+	Logger        zerolog.Logger
 	StacksStatus  *types.StacksStatus
-	Mutex         *appMutex
+	StacksOutputs *types.StacksOutputs
+	Flags         *types.StackFlags
+	Mutex         *Mutex
 	StacksCounter uint64
 	StdOut        *out.Output
 	StdErr        *out.Output
 	WaitGroups    map[string]*sync.WaitGroup
-	AppError      int
+	Jobs          *scheduler.Scheduler
+	Report        *report.Report
+	Checkpoint    *checkpoint.State
+	Cache         *cache.Cache
+	Selector      *selector.Selector
+	Watch         *watch.Files
+	ExplainedVars *types.ExplainedVars
+	// StdinVars is the vars document read from stdin for -f -
+	StdinVars []byte
+	// ExecOutputs caches output of varsFrom exec commands
+	ExecOutputs *ExecOutputs
+	// NoExec is set when the stack tree is only loaded (plan, validate, graph, vars).
+	// varsFrom exec commands are not executed then
+	NoExec bool
+}
+
+// Config of a run
+type Config struct {
+	CLIValues       []string
+	CLIStringValues []string      `json:"CLIStringValues,omitempty"`
+	CLIFileValues   []string      `json:"CLIFileValues,omitempty"`
+	CLIJSONValues   []string      `json:"CLIJSONValues,omitempty"`
+	LogFormat       string        `json:"LogFormat,omitempty"`
+	VarFiles        []string      `json:"VarFiles,omitempty"`
+	Verbosity       int           `json:"Verbosity,omitempty"`
+	DefaultTimeout  time.Duration `json:"DefaultTimeout,omitempty"`
+	Workdir         string        `json:"Workdir,omitempty"`
+	GitLibsPath     string        `json:"GitLibsPath,omitempty"`
+	DryRun          bool          `json:"DryRun,omitempty"`
+	PlanFormat      string        `json:"PlanFormat,omitempty"`
+	Jobs            int           `json:"Jobs,omitempty"`
+	KillGrace       time.Duration `json:"KillGrace,omitempty"`
+	ReportJSON      string        `json:"ReportJSON,omitempty"`
+	ReportJUnit     string        `json:"ReportJUnit,omitempty"`
+	Resume          bool          `json:"Resume,omitempty"`
+	NoCache         bool          `json:"NoCache,omitempty"`
+	Only            []string      `json:"Only,omitempty"`
+	Skip            []string      `json:"Skip,omitempty"`
+	WithAncestors   bool          `json:"WithAncestors,omitempty"`
+	Watch           bool          `json:"Watch,omitempty"`
+	WatchInterval   time.Duration `json:"WatchInterval,omitempty"`
+	// ExplainVars is the path of the stack whose vars are explained
+	ExplainVars string `json:"ExplainVars,omitempty"`
 }
 
-type appConfig struct {
-	CLIValues      *[]string
-	LogFormat      *string        `json:"LogFormat,omitempty"`
-	VarFiles       *[]string      `json:"VarFiles,omitempty"`
-	Verbosity      *int           `json:"Verbosity,omitempty"`
-	DefaultTimeout *time.Duration `json:"DefaultTimeout,omitempty"`
-	Workdir        *string        `json:"Workdir,omitempty"`
-	GitLibsPath    *string        `json:"GitLibsPath,omitempty"`
+// Mutex type
+type Mutex struct {
+	StacksCounterMutex sync.Mutex
+	WaitGroupsMutex    sync.Mutex
 }
 
-type appMutex struct {
-	CurrentWorkDirMutex sync.Mutex
-	GitWorkMutex        sync.Mutex
-	StacksCounterMutex  sync.Mutex
+// New returns the state of a run stopped by ctx
+func New(ctx context.Context, config *Config, stdout, stderr io.Writer, logger zerolog.Logger) *State {
+	state := new(State)
+	ctx = context.WithValue(ctx, contextKey{}, state)
+	state.Interrupt, state.interrupt = context.WithCancel(ctx)
+	state.Context, state.Cancel = context.WithCancel(state.Interrupt)
+	state.Config = config
+	state.Logger = logger
+	state.Mutex = new(Mutex)
+	state.StdOut = out.New(stdout)
+	state.StdErr = out.New(stderr)
+	state.StacksStatus = new(types.StacksStatus)
+	state.StacksStatus.StacksStatus = make(map[string]string)
+	state.StacksOutputs = new(types.StacksOutputs)
+	state.StacksOutputs.StacksOutputs = make(map[string]map[string]interface{})
+	state.ExplainedVars = new(types.ExplainedVars)
+	state.Flags = new(types.StackFlags)
+	state.Flags.Vars = make(map[string]interface{})
+	state.StacksCounter = 0
+	state.WaitGroups = make(map[string]*sync.WaitGroup)
+	state.Jobs = scheduler.New(config.Jobs)
+	state.Report = report.New()
+	state.ExecOutputs = &ExecOutputs{outputs: make(map[string]*execOutput)}
+	return state
 }
 
-func init() {
-	App = new(app)
-	App.Context, App.Cancel = context.WithCancel(context.Background())
-	App.Config = new(appConfig)
-	App.Mutex = new(appMutex)
-	App.StdOut = out.New(os.Stdout)
-	App.StdErr = out.New(os.Stderr)
-	App.StacksStatus = new(types.StacksStatus)
-	App.StacksStatus.StacksStatus = make(map[string]string)
-	App.StacksCounter = 0
-	App.WaitGroups = make(map[string]*sync.WaitGroup)
+// FromContext returns the state carried by ctx
+func FromContext(ctx context.Context) *State {
+	state, _ := ctx.Value(contextKey{}).(*State)
+	return state
+}
 
-	setupCloseHandler()
+// FromStack returns the state of the stack tree
+func FromStack(stack types.Stack) *State {
+	return FromContext(stack.GetContext())
 }
 
 // NewStackID func
-func NewStackID() string {
-	App.Mutex.StacksCounterMutex.Lock()
-	App.StacksCounter++
-	App.Mutex.StacksCounterMutex.Unlock()
-	return fmt.Sprintf("stack_%v", App.StacksCounter)
+func (state *State) NewStackID() string {
+	state.Mutex.StacksCounterMutex.Lock()
+	defer state.Mutex.StacksCounterMutex.Unlock()
+	state.StacksCounter++
+	return fmt.Sprintf("stack_%v", state.StacksCounter)
+}
+
+// Interrupted returns true if the run was stopped by its parent context
+func (state *State) Interrupted() bool {
+	return state.Interrupt.Err() != nil
+}
+
+// Close releases resources of the state
+func (state *State) Close() {
+	state.Cancel()
+	state.interrupt()
+}
+
+// ExecOutputs of commands executed once per run
+type ExecOutputs struct {
+	mux     sync.Mutex
+	outputs map[string]*execOutput
+}
+
+type execOutput struct {
+	once   sync.Once
+	output []byte
+	err    error
 }
 
-func setupCloseHandler() {
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		log.Logger.Error().Msg("SIGTERM received. Gracefully shutting down...")
-		App.AppError = consts.ExitCodeSIGTERM
-		App.Cancel()
-	}()
+// Do returns the output of exec for the key. exec is called once,
+// concurrent calls with the same key wait for it
+func (outputs *ExecOutputs) Do(key string, exec func() ([]byte, error)) ([]byte, error) {
+	outputs.mux.Lock()
+	output, ok := outputs.outputs[key]
+	if !ok {
+		output = new(execOutput)
+		outputs.outputs[key] = output
+	}
+	outputs.mux.Unlock()
+	output.once.Do(func() {
+		output.output, output.err = exec()
+	})
+	return output.output, output.err
 }
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const fileExt = ".json"
+
+// Cache stores outputs of run items by content hash.
+// A nil Cache is disabled
+type Cache struct {
+	dir string
+}
+
+// Entry is a cached output with hashes of the files read while it was produced
+type Entry struct {
+	Output string            `json:"output"`
+	Files  map[string]string `json:"files,omitempty"`
+}
+
+// New func
+func New(dir string) *Cache {
+	cache := new(Cache)
+	cache.dir = dir
+	return cache
+}
+
+// Key returns a hash of values marshalled to json
+func Key(values ...interface{}) string {
+	content, _ := json.Marshal(values)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the cached output if the files it was produced from are unchanged
+func (cache *Cache) Get(key string) (output string, ok bool) {
+	if cache == nil || key == "" {
+		return
+	}
+	fileName := cache.fileName(key)
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	var entry Entry
+	if err = json.Unmarshal(content, &entry); err != nil {
+		return
+	}
+	for file, hash := range entry.Files {
+		if fileHash(file) != hash {
+			return
+		}
+	}
+	now := time.Now()
+	os.Chtimes(fileName, now, now)
+	return entry.Output, true
+}
+
+// Put stores output. files are the files read while the output was produced
+func (cache *Cache) Put(key, output string, files []string) error {
+	if cache == nil || key == "" {
+		return nil
+	}
+	entry := Entry{Output: output}
+	for _, file := range files {
+		if entry.Files == nil {
+			entry.Files = make(map[string]string)
+		}
+		entry.Files[file] = fileHash(file)
+	}
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(cache.dir, os.ModePerm); err != nil {
+		return err
+	}
+	tmpFile := cache.fileName(key) + ".tmp"
+	if err = ioutil.WriteFile(tmpFile, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, cache.fileName(key))
+}
+
+// Prune removes entries not used for olderThan. Zero olderThan removes everything
+func Prune(dir string, olderThan time.Duration) (removed int, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), fileExt) {
+			continue
+		}
+		if olderThan > 0 && time.Since(file.ModTime()) < olderThan {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, file.Name())); err != nil {
+			return
+		}
+		removed++
+	}
+	return
+}
+
+func (cache *Cache) fileName(key string) string {
+	return filepath.Join(cache.dir, key+fileExt)
+}
+
+func fileHash(file string) string {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -1,9 +1,15 @@
 package cel
 
 import (
+	"fmt"
+	"strconv"
+
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/operators"
+	celtypes "github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
 	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
 )
 
@@ -15,21 +21,133 @@ type CELaddons struct {
 
 // ComputeCEL func
 func ComputeCEL(expression string, varsMap map[string]interface{}, addons ...CELaddons) (result interface{}, err error) {
+	out, err := eval(expression, varsMap, addons...)
+	if err != nil {
+		return
+	}
+	result = out.Value()
+	return
+}
+
+// ComputeCELNative returns lists and maps as []interface{} and map[string]interface{}
+func ComputeCELNative(expression string, varsMap map[string]interface{}, addons ...CELaddons) (result interface{}, err error) {
+	out, err := eval(expression, varsMap, addons...)
+	if err != nil {
+		return
+	}
+	result = toNative(out)
+	return
+}
+
+// Compile checks the expression without evaluating it.
+// names are the variables available in the expression
+func Compile(expression string, names []string, addons ...CELaddons) error {
+	env, err := newEnv(names, addons...)
+	if err != nil {
+		return err
+	}
+	_, iss := env.Compile(expression)
+	return iss.Err()
+}
+
+// References returns paths the expression reads: chains of field
+// selections and constant indexes starting at a variable, like vars.a[0].b
+func References(expression string) (paths [][]string, err error) {
+	env, err := cel.NewEnv()
+	if err != nil {
+		return
+	}
+	ast, iss := env.Parse(expression)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	walkReferences(ast.Expr(), &paths)
+	return
+}
+
+func walkReferences(expr *exprpb.Expr, paths *[][]string) {
+	if expr == nil {
+		return
+	}
+	if path, ok := referencePath(expr); ok {
+		*paths = append(*paths, path)
+		return
+	}
+	switch {
+	case expr.GetSelectExpr() != nil:
+		walkReferences(expr.GetSelectExpr().GetOperand(), paths)
+	case expr.GetCallExpr() != nil:
+		call := expr.GetCallExpr()
+		walkReferences(call.GetTarget(), paths)
+		for _, arg := range call.GetArgs() {
+			walkReferences(arg, paths)
+		}
+	case expr.GetListExpr() != nil:
+		for _, element := range expr.GetListExpr().GetElements() {
+			walkReferences(element, paths)
+		}
+	case expr.GetStructExpr() != nil:
+		for _, entry := range expr.GetStructExpr().GetEntries() {
+			walkReferences(entry.GetMapKey(), paths)
+			walkReferences(entry.GetValue(), paths)
+		}
+	case expr.GetComprehensionExpr() != nil:
+		comprehension := expr.GetComprehensionExpr()
+		walkReferences(comprehension.GetIterRange(), paths)
+		walkReferences(comprehension.GetAccuInit(), paths)
+		walkReferences(comprehension.GetLoopCondition(), paths)
+		walkReferences(comprehension.GetLoopStep(), paths)
+		walkReferences(comprehension.GetResult(), paths)
+	}
+}
+
+func referencePath(expr *exprpb.Expr) ([]string, bool) {
+	switch {
+	case expr.GetIdentExpr() != nil:
+		return []string{expr.GetIdentExpr().GetName()}, true
+	case expr.GetSelectExpr() != nil:
+		path, ok := referencePath(expr.GetSelectExpr().GetOperand())
+		return append(path, expr.GetSelectExpr().GetField()), ok
+	case expr.GetCallExpr() != nil:
+		call := expr.GetCallExpr()
+		if call.GetFunction() != operators.Index || len(call.GetArgs()) != 2 {
+			return nil, false
+		}
+		path, ok := referencePath(call.GetArgs()[0])
+		if !ok || call.GetArgs()[1].GetConstExpr() == nil {
+			return nil, false
+		}
+		switch index := call.GetArgs()[1].GetConstExpr().GetConstantKind().(type) {
+		case *exprpb.Constant_StringValue:
+			return append(path, index.StringValue), true
+		case *exprpb.Constant_Int64Value:
+			return append(path, strconv.FormatInt(index.Int64Value, 10)), true
+		case *exprpb.Constant_Uint64Value:
+			return append(path, strconv.FormatUint(index.Uint64Value, 10)), true
+		}
+	}
+	return nil, false
+}
+
+func newEnv(names []string, addons ...CELaddons) (*cel.Env, error) {
 	var declarations []*exprpb.Decl
-	var env *cel.Env
+	for _, name := range names {
+		declarations = append(declarations, decls.NewVar(name, decls.Dyn))
+	}
+	for _, addon := range addons {
+		declarations = append(declarations, addon.Decls...)
+	}
+	return cel.NewEnv(cel.Declarations(declarations...))
+}
+
+func eval(expression string, varsMap map[string]interface{}, addons ...CELaddons) (out ref.Val, err error) {
 	var prg cel.Program
-	var out ref.Val
 
+	names := make([]string, 0, len(varsMap))
 	for key := range varsMap {
-		declarations = append(declarations, decls.NewVar(key, decls.Dyn))
-	}
-	if len(addons) > 0 {
-		for _, addon := range addons {
-			declarations = append(declarations, addon.Decls...)
-		}
+		names = append(names, key)
 	}
-	envOption := cel.Declarations(declarations...)
-	env, err = cel.NewEnv(envOption)
+	env, err := newEnv(names, addons...)
 	if err != nil {
 		return
 	}
@@ -49,10 +167,24 @@ func ComputeCEL(expression string, varsMap map[string]interface{}, addons ...CEL
 		return
 	}
 	out, _, err = prg.Eval(varsMap)
-	if err != nil {
-		return
-	}
-	result = out.Value()
-
 	return
 }
+
+func toNative(val ref.Val) interface{} {
+	switch v := val.(type) {
+	case traits.Mapper:
+		result := make(map[string]interface{})
+		for it := v.Iterator(); it.HasNext() == celtypes.True; {
+			key := it.Next()
+			result[fmt.Sprint(key.Value())] = toNative(v.Get(key))
+		}
+		return result
+	case traits.Lister:
+		var result []interface{}
+		for it := v.Iterator(); it.HasNext() == celtypes.True; {
+			result = append(result, toNative(it.Next()))
+		}
+		return result
+	}
+	return val.Value()
+}
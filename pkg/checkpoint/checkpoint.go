@@ -0,0 +1,134 @@
+package checkpoint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// State keeps stacks whose run items finished between runs.
+// A nil State is disabled
+type State struct {
+	mux  sync.Mutex
+	file string
+
+	Stacks map[string]*Entry `json:"stacks"`
+}
+
+// Entry is a stack whose preRun and run items finished with the values it produced.
+// Done is set when the whole stack with child stacks and postRun finished
+type Entry struct {
+	Fingerprint string                 `json:"fingerprint"`
+	Done        bool                   `json:"done,omitempty"`
+	Finished    time.Time              `json:"finished"`
+	Vars        map[string]interface{} `json:"vars,omitempty"`
+	Flags       map[string]interface{} `json:"flags,omitempty"`
+	Outputs     map[string]interface{} `json:"outputs,omitempty"`
+}
+
+// Load reads the state file if resume is true, otherwise starts an empty state
+func Load(file string, resume bool) (state *State, err error) {
+	state = new(State)
+	state.file = file
+	state.Stacks = make(map[string]*Entry)
+	if !resume {
+		return
+	}
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(content, state); err != nil {
+		return
+	}
+	if state.Stacks == nil {
+		state.Stacks = make(map[string]*Entry)
+	}
+	return
+}
+
+// Fingerprint returns a hash of values marshalled to json
+func Fingerprint(values ...interface{}) string {
+	content, _ := json.Marshal(values)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Files returns hashes of the contents of files. Files that can't be read get
+// an empty hash
+func Files(files []string) map[string]string {
+	hashes := make(map[string]string, len(files))
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			hashes[file] = ""
+			continue
+		}
+		sum := sha256.Sum256(content)
+		hashes[file] = hex.EncodeToString(sum[:])
+	}
+	return hashes
+}
+
+// Get returns the entry if it was saved with the same fingerprint
+func (state *State) Get(key, fingerprint string) (*Entry, bool) {
+	if state == nil {
+		return nil, false
+	}
+	state.mux.Lock()
+	defer state.mux.Unlock()
+	entry, ok := state.Stacks[key]
+	if !ok || entry.Fingerprint != fingerprint {
+		return nil, false
+	}
+	return entry, true
+}
+
+// Set stores the entry and writes the state file
+func (state *State) Set(key string, entry *Entry) error {
+	if state == nil {
+		return nil
+	}
+	state.mux.Lock()
+	defer state.mux.Unlock()
+	entry.Finished = time.Now()
+	state.Stacks[key] = entry
+	return state.save()
+}
+
+// Remove deletes the state file. Nothing is left to resume
+func (state *State) Remove() error {
+	if state == nil {
+		return nil
+	}
+	state.mux.Lock()
+	defer state.mux.Unlock()
+	err := os.Remove(state.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (state *State) save() error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(state.file), os.ModePerm); err != nil {
+		return err
+	}
+	tmpFile := state.file + ".tmp"
+	if err = ioutil.WriteFile(tmpFile, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, state.file)
+}
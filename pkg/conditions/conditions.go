@@ -1,6 +1,7 @@
 package conditions
 
 import (
+	"context"
 	"fmt"
 	"runtime/debug"
 	"sync"
@@ -17,59 +18,60 @@ import (
 	"github.com/kruglovmax/stack/pkg/app"
 	"github.com/kruglovmax/stack/pkg/cel"
 	"github.com/kruglovmax/stack/pkg/consts"
-	"github.com/kruglovmax/stack/pkg/log"
 	"github.com/kruglovmax/stack/pkg/types"
 )
 
 const sleepTime = 100 * time.Millisecond
 
-// When func
+// When func. waitGroup() in the condition blocks, the jobs slot is yielded meanwhile
 func When(stack types.Stack, condition string) (result bool) {
 	if condition == "" {
 		result = true
 		return
 	}
-	result = checkCondition(stack, condition, stack.GetView().(map[string]interface{}))
+	app.FromStack(stack).Jobs.Yield(func() {
+		result = checkCondition(stack.GetContext(), stack, condition, stack.GetView().(map[string]interface{}))
+	})
 	return
 }
 
 // Wait func
-func Wait(stack types.Stack, condition string, timeout time.Duration) (result bool) {
+// Returns false without an error if the app was cancelled while waiting.
+// The jobs slot of the caller is yielded while waiting
+func Wait(stack types.Stack, condition string, timeout time.Duration) (result bool, err error) {
 	if condition == "" {
 		result = true
 		return
 	}
-	log.Logger.Info().
+	app.FromStack(stack).Jobs.Yield(func() {
+		result, err = wait(stack, condition, timeout)
+	})
+	return
+}
+
+// wait checks the condition until it is true. Checking stops on timeout
+// and on cancellation of the stack, nothing is left running then
+func wait(stack types.Stack, condition string, timeout time.Duration) (result bool, err error) {
+	app.FromStack(stack).Logger.Info().
 		Str("condition", condition).
 		Str("in stack", stack.GetWorkdir()).
 		Msg("Waiting for")
-	waitLoopDone := make(chan int)
-	go waitLoop(stack, condition, waitLoopDone)
-	select {
-	case <-waitLoopDone:
-		result = true
-	case <-time.After(timeout):
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Error().
-			Str("timeout", fmt.Sprintf("%s", timeout)).
-			Str("in stack", stack.GetWorkdir()).
-			Str("condition", condition).
-			Msg("Waiting failed")
-		app.App.AppError = consts.ExitCodeWaitTimeout
-		app.App.Cancel()
-		return
-	case <-app.App.Context.Done():
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Error().
-			Str("timeout", fmt.Sprintf("%s", timeout)).
-			Str("in stack", stack.GetWorkdir()).
-			Str("condition", condition).
-			Msg("Waiting failed")
+	ctx, cancel := context.WithTimeout(stack.GetContext(), timeout)
+	defer cancel()
+	if result = waitLoop(ctx, stack, condition); result {
 		return
 	}
-
+	app.FromStack(stack).Logger.Debug().
+		Msg(string(debug.Stack()))
+	app.FromStack(stack).Logger.Error().
+		Str("timeout", fmt.Sprintf("%s", timeout)).
+		Str("in stack", stack.GetWorkdir()).
+		Str("condition", condition).
+		Msg("Waiting failed")
+	if stack.GetContext().Err() == nil {
+		err = types.NewStackError(stack, nil, consts.ExitCodeWaitTimeout,
+			fmt.Errorf(consts.MessageWaitTimeout, condition, timeout))
+	}
 	return
 }
 
@@ -83,50 +85,88 @@ func WaitGroupAdd(stack types.Stack, waitgroup string) *sync.WaitGroup {
 	if _, ok := computed.(string); err == nil && ok {
 		wgKey = computed.(string)
 	}
-	wg, ok := app.App.WaitGroups[wgKey]
+	state := app.FromStack(stack)
+	state.Mutex.WaitGroupsMutex.Lock()
+	wg, ok := state.WaitGroups[wgKey]
 	if !ok {
-		app.App.WaitGroups[wgKey] = new(sync.WaitGroup)
-		wg = app.App.WaitGroups[wgKey]
+		wg = new(sync.WaitGroup)
+		state.WaitGroups[wgKey] = wg
 	}
+	state.Mutex.WaitGroupsMutex.Unlock()
 	wg.Add(1)
 	return wg
 }
 
-func waitLoop(stack types.Stack, condition string, exit chan int) {
-	for {
-		select {
-		case <-app.App.Context.Done():
-			break
-		default: // Prevent from blocking.
+// waitLoop returns true when the condition is true and false when ctx is done
+func waitLoop(ctx context.Context, stack types.Stack, condition string) bool {
+	for ctx.Err() == nil {
+		if checkCondition(ctx, stack, condition, stack.GetView().(map[string]interface{})) {
+			return true
 		}
-		if checkCondition(stack, condition, stack.GetView().(map[string]interface{})) {
-			break
-		}
-		time.Sleep(sleepTime)
-		log.Logger.Trace().
+		app.FromStack(stack).Logger.Trace().
 			Str("condition", condition).Msg("Waiting for")
+		select {
+		case <-ctx.Done():
+		case <-time.After(sleepTime):
+		}
+	}
+	return false
+}
+
+// waitGroupDone waits for wg until ctx is done. The goroutine waiting for wg
+// only closes the channel, it has no effects after ctx is done
+func waitGroupDone(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Check compiles the condition in the view of the stack without evaluating it.
+// names are additional variables available in the condition
+func Check(stack types.Stack, condition string, names ...string) error {
+	if condition == "" {
+		return nil
+	}
+	for name := range stack.GetView().(map[string]interface{}) {
+		names = append(names, name)
 	}
-	exit <- 0
+	names = append(names, "stack")
+	return cel.Compile(condition, names, cel.CELaddons{Decls: waitGroupDecls()})
+}
+
+func waitGroupDecls() []*exprpb.Decl {
+	return []*exprpb.Decl{decls.NewFunction("waitGroup",
+		decls.NewOverload("waitGroup_string",
+			[]*exprpb.Type{decls.String},
+			decls.Bool))}
 }
 
-func checkCondition(stack types.Stack, condition string, varsMap map[string]interface{}) (result bool) {
+// checkCondition evaluates the condition. waitGroup() returns false if ctx is done while waiting
+func checkCondition(ctx context.Context, stack types.Stack, condition string, varsMap map[string]interface{}) (result bool) {
 	var celAddon cel.CELaddons
 	waitGroupFunc := &functions.Overload{
 		Operator: "waitGroup_string",
 		Unary: func(lhs celref.Val) celref.Val {
-			wg, ok := app.App.WaitGroups[fmt.Sprint(lhs)]
+			state := app.FromStack(stack)
+			state.Mutex.WaitGroupsMutex.Lock()
+			wg, ok := state.WaitGroups[fmt.Sprint(lhs)]
+			state.Mutex.WaitGroupsMutex.Unlock()
 			if ok {
-				log.Logger.Trace().
+				app.FromStack(stack).Logger.Trace().
 					Str("condition", condition).Msg("Waiting for")
-				wg.Wait()
-				return celtypes.True
+				return celtypes.Bool(waitGroupDone(ctx, wg))
 			}
 			return celtypes.False
 		}}
-	celAddon.Decls = append(celAddon.Decls, decls.NewFunction("waitGroup",
-		decls.NewOverload("waitGroup_string",
-			[]*exprpb.Type{decls.String},
-			decls.Bool)))
+	celAddon.Decls = waitGroupDecls()
 	celAddon.ProgramOption = append(celAddon.ProgramOption, celgo.Functions(waitGroupFunc))
 
 	stackMap := stack.GetView().(map[string]interface{})
@@ -134,7 +174,7 @@ func checkCondition(stack types.Stack, condition string, varsMap map[string]inte
 	computed, err := cel.ComputeCEL(condition, stackMap, celAddon)
 
 	if err != nil {
-		log.Logger.Warn().
+		app.FromStack(stack).Logger.Warn().
 			Str("condition", condition).
 			Str("in stack", stack.GetWorkdir()).
 			Msgf("Error %s\n", err.Error())
@@ -143,7 +183,7 @@ func checkCondition(stack types.Stack, condition string, varsMap map[string]inte
 	value, ok := computed.(bool)
 
 	if !ok {
-		log.Logger.Warn().
+		app.FromStack(stack).Logger.Warn().
 			Str("result type", fmt.Sprintf("%T", computed)).
 			Str("result value", spew.Sprint(computed)).
 			Str("type expected", "bool").
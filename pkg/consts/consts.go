@@ -8,14 +8,23 @@ const (
 	MessageBadStackErr               = "Bad stack: %s"
 	MessageBadStackUnsupportedAPI    = "Bad stack. Unsupported API"
 	MessageChanged                   = "Changed"
+	MessageContinueOnError           = "Failure ignored (continueOnError)"
+	MessageFailureReport             = "Failure report"
+	MessageScriptCancelled           = "Script cancelled"
+	MessageStackAncestor             = "Ancestor of stacks selected by --only. Run items are skipped"
+	MessageStackNotStarted           = "Not started. The parent stack failed or was cancelled"
 	MessageLibsBadItem               = "Bad lib item"
 	MessageLibsGitBadPathInRepo      = "Bad path %s in git repo %s"
 	MessageLibsParseAndInit          = "Parse and init lib item: %s"
 	MessagePathNotFoundInSearchPaths = "Path %s not found. Search paths:\n%s"
 	MessagesReadingStackFrom         = "Reading stack from"
+	MessageWatchCycle                = "Watch cycle"
+	MessageWatching                  = "Watching for changes"
 	MessageVarsBadVarName            = "Bad var name! Probably unexpected behavior"
 	MessageVarsDoubleDefinition      = "Var double definition"
 	MessageVarsSimplyfy              = "Simplyfy var name to <%s> Probably unexpected behavior"
+	MessageRunTimeout                = "%s waiting failed. Timeout %s"
+	MessageWaitTimeout               = "Waiting for %s failed. Timeout %s"
 )
 
 // ExitCodes
@@ -24,12 +33,22 @@ const (
 	ExitCodeScriptFailed
 	ExitCodeSIGTERM
 	ExitCodeWaitTimeout
+	ExitCodeBadStack
+	ExitCodeRunTimeout
 )
 
 // other
 const (
 	GitCloneDir          = ".gitclone"
 	GitLibsPath          = ".libs"
+	StateDir             = ".stack"
+	StateFileName        = "state.json"
+	CacheDir             = "cache"
 	StackDefaultFileName = "stack"
+	StackRCFileName      = ".stackrc.yaml"
+	EnvPrefix            = "STACK_"
 	DefaultTimeout       = 1 * time.Minute
+	DefaultKillGrace     = 10 * time.Second
+	DefaultWatchInterval = 1 * time.Second
+	WatchDebounce        = 300 * time.Millisecond
 )
@@ -0,0 +1,254 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+// Node types
+const (
+	NodeStack     = "stack"
+	NodeRunItem   = "runItem"
+	NodeWaitGroup = "waitGroup"
+)
+
+// Edge kinds
+const (
+	// EdgeChild links a stack with its child stacks and run items
+	EdgeChild = "child"
+	// EdgeNext links stacks and run items executed one after another
+	EdgeNext = "next"
+	// EdgeMember links a stack with the wait groups it belongs to
+	EdgeMember = "member"
+	// EdgeWait links a stack or a run item with the wait groups its wait expression refers to
+	EdgeWait = "wait"
+)
+
+const labelMaxLength = 40
+
+var waitGroupRef = regexp.MustCompile(`waitGroup\(\s*(?:"([^"]*)"|'([^']*)')\s*\)`)
+
+// Graph of the stack tree
+type Graph struct {
+	Nodes []*Node `json:"nodes"`
+	Edges []*Edge `json:"edges"`
+
+	waitGroups map[string]*Node
+}
+
+// Node of the graph
+type Node struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Label    string `json:"label"`
+	Path     string `json:"path,omitempty"`
+	Parallel bool   `json:"parallel,omitempty"`
+	// Members is the number of stacks in the wait group
+	Members int `json:"members,omitempty"`
+}
+
+// Edge of the graph
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// Build returns the graph of the stack tree plan
+func Build(plan *types.StackPlan) *Graph {
+	graph := new(Graph)
+	graph.waitGroups = make(map[string]*Node)
+	graph.addStack(plan, false)
+	sort.SliceStable(graph.Nodes, func(i, j int) bool {
+		// wait groups go last, other nodes keep the order of the tree
+		return graph.Nodes[i].Type != NodeWaitGroup && graph.Nodes[j].Type == NodeWaitGroup
+	})
+	return graph
+}
+
+func (graph *Graph) addNode(nodeType, label string) *Node {
+	node := &Node{
+		ID:    fmt.Sprintf("%s%d", nodeType[:1], len(graph.Nodes)),
+		Type:  nodeType,
+		Label: label,
+	}
+	graph.Nodes = append(graph.Nodes, node)
+	return node
+}
+
+func (graph *Graph) addEdge(from, to *Node, kind string) {
+	graph.Edges = append(graph.Edges, &Edge{From: from.ID, To: to.ID, Kind: kind})
+}
+
+func (graph *Graph) waitGroup(name string) *Node {
+	node, ok := graph.waitGroups[name]
+	if !ok {
+		node = graph.addNode(NodeWaitGroup, name)
+		graph.waitGroups[name] = node
+	}
+	return node
+}
+
+// addWaits links the node with wait groups referred by waitGroup("...") in the wait expression
+func (graph *Graph) addWaits(node *Node, wait string) {
+	for _, match := range waitGroupRef.FindAllStringSubmatch(wait, -1) {
+		graph.addEdge(node, graph.waitGroup(match[1]+match[2]), EdgeWait)
+	}
+}
+
+func (graph *Graph) addStack(plan *types.StackPlan, parallel bool) *Node {
+	node := graph.addNode(NodeStack, fmt.Sprintf("%s (%s)", plan.Path, plan.Name))
+	node.Path = plan.Path
+	node.Parallel = parallel
+	for _, name := range plan.WaitGroups {
+		waitGroup := graph.waitGroup(name)
+		waitGroup.Members++
+		graph.addEdge(node, waitGroup, EdgeMember)
+	}
+	graph.addWaits(node, plan.Wait)
+
+	graph.addRunItems(node, plan.PreRun, false)
+	graph.addRunItems(node, plan.Run, false)
+	var previous *Node
+	for _, child := range plan.Stacks {
+		childNode := graph.addStack(child, false)
+		graph.addEdge(node, childNode, EdgeChild)
+		if previous != nil {
+			graph.addEdge(previous, childNode, EdgeNext)
+		}
+		previous = childNode
+	}
+	for _, child := range plan.ParallelStacks {
+		graph.addEdge(node, graph.addStack(child, true), EdgeChild)
+	}
+	graph.addRunItems(node, plan.PostRun, false)
+	return node
+}
+
+func (graph *Graph) addRunItems(parent *Node, items []*types.RunItemPlan, parallel bool) {
+	var previous *Node
+	for _, item := range items {
+		node := graph.addNode(NodeRunItem, runItemLabel(item))
+		node.Parallel = parallel
+		graph.addEdge(parent, node, EdgeChild)
+		if previous != nil && !parallel {
+			graph.addEdge(previous, node, EdgeNext)
+		}
+		previous = node
+		graph.addWaits(node, item.Wait)
+		graph.addRunItems(node, item.Items, item.Parallel)
+	}
+}
+
+func runItemLabel(item *types.RunItemPlan) string {
+	value, ok := item.Value.(string)
+	if !ok {
+		if list, isList := item.Value.([]interface{}); isList && len(list) > 0 {
+			value, ok = list[0].(string)
+		}
+	}
+	if !ok || value == "" {
+		return item.Type
+	}
+	value = strings.TrimSpace(strings.SplitN(strings.TrimSpace(value), "\n", 2)[0])
+	if runes := []rune(value); len(runes) > labelMaxLength {
+		value = string(runes[:labelMaxLength]) + "..."
+	}
+	return item.Type + ": " + value
+}
+
+// Print writes the graph in the given format (dot, mermaid, json)
+func Print(w io.Writer, graph *Graph, format string) (err error) {
+	switch format {
+	case "dot", "":
+		printDot(w, graph)
+	case "mermaid":
+		printMermaid(w, graph)
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(graph)
+	default:
+		err = fmt.Errorf("Unsupported graph format: %s", format)
+	}
+	return
+}
+
+func printDot(w io.Writer, graph *Graph) {
+	fmt.Fprintln(w, "digraph stack {")
+	for _, node := range graph.Nodes {
+		attrs := fmt.Sprintf("label=%q", nodeLabel(node))
+		switch node.Type {
+		case NodeStack:
+			attrs += ", shape=box, style=bold"
+		case NodeRunItem:
+			attrs += ", shape=box, style=rounded"
+		case NodeWaitGroup:
+			attrs += ", shape=hexagon"
+			if node.Members == 0 {
+				attrs += ", color=red"
+			}
+		}
+		fmt.Fprintf(w, "  %s [%s];\n", node.ID, attrs)
+	}
+	for _, edge := range graph.Edges {
+		attrs := ""
+		switch edge.Kind {
+		case EdgeNext:
+			attrs = ` [style=dashed, label="next"]`
+		case EdgeMember:
+			attrs = ` [color=blue, label="member"]`
+		case EdgeWait:
+			attrs = ` [color=red, style=dashed, label="wait"]`
+		}
+		fmt.Fprintf(w, "  %s -> %s%s;\n", edge.From, edge.To, attrs)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func printMermaid(w io.Writer, graph *Graph) {
+	fmt.Fprintln(w, "flowchart TD")
+	for _, node := range graph.Nodes {
+		label := strings.ReplaceAll(nodeLabel(node), `"`, "#quot;")
+		switch node.Type {
+		case NodeStack:
+			fmt.Fprintf(w, "  %s[\"%s\"]\n", node.ID, label)
+		case NodeRunItem:
+			fmt.Fprintf(w, "  %s(\"%s\")\n", node.ID, label)
+		case NodeWaitGroup:
+			fmt.Fprintf(w, "  %s{{\"%s\"}}\n", node.ID, label)
+		}
+	}
+	for _, edge := range graph.Edges {
+		switch edge.Kind {
+		case EdgeChild:
+			fmt.Fprintf(w, "  %s --> %s\n", edge.From, edge.To)
+		case EdgeWait:
+			fmt.Fprintf(w, "  %s -. wait .-> %s\n", edge.From, edge.To)
+		default:
+			fmt.Fprintf(w, "  %s -- %s --> %s\n", edge.From, edge.Kind, edge.To)
+		}
+	}
+	for _, node := range graph.Nodes {
+		if node.Type == NodeWaitGroup && node.Members == 0 {
+			fmt.Fprintf(w, "  style %s stroke:#f00\n", node.ID)
+		}
+	}
+}
+
+func nodeLabel(node *Node) string {
+	label := node.Label
+	if node.Parallel {
+		label += " [parallel]"
+	}
+	if node.Type == NodeWaitGroup && node.Members == 0 {
+		label += " (no members)"
+	}
+	return label
+}
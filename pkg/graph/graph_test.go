@@ -0,0 +1,97 @@
+package graph
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// testPlan is a root stack with a run item, a group, sequential and parallel
+// child stacks and wait groups. The "cleanup" wait group has no members
+func testPlan() *types.StackPlan {
+	return &types.StackPlan{
+		Path: ".",
+		Name: "root",
+		Run: []*types.RunItemPlan{
+			{Type: "script", Value: "echo \"start\"\necho next line"},
+			{Type: "group", Parallel: true, Items: []*types.RunItemPlan{
+				{Type: "script", Value: "echo a"},
+				{Type: "script", Value: "echo b"},
+			}},
+		},
+		Stacks: []*types.StackPlan{
+			{Path: "db", Name: "db", WaitGroups: []string{"infra"}},
+			{Path: "app", Name: "app", Wait: `waitGroup("infra") && waitGroup('cleanup')`},
+		},
+		ParallelStacks: []*types.StackPlan{
+			{Path: "cache", Name: "cache", WaitGroups: []string{"infra"}},
+		},
+	}
+}
+
+func TestBuild(t *testing.T) {
+	graph := Build(testPlan())
+	labels := make(map[string]string)
+	for _, node := range graph.Nodes {
+		labels[node.ID] = node.Label
+	}
+	var edges [][3]string
+	for _, edge := range graph.Edges {
+		edges = append(edges, [3]string{labels[edge.From], edge.Kind, labels[edge.To]})
+	}
+	want := [][3]string{
+		{". (root)", EdgeChild, `script: echo "start"`},
+		{". (root)", EdgeChild, "group"},
+		{`script: echo "start"`, EdgeNext, "group"},
+		{"group", EdgeChild, "script: echo a"},
+		{"group", EdgeChild, "script: echo b"},
+		{"db (db)", EdgeMember, "infra"},
+		{". (root)", EdgeChild, "db (db)"},
+		{"app (app)", EdgeWait, "infra"},
+		{"app (app)", EdgeWait, "cleanup"},
+		{". (root)", EdgeChild, "app (app)"},
+		{"db (db)", EdgeNext, "app (app)"},
+		{"cache (cache)", EdgeMember, "infra"},
+		{". (root)", EdgeChild, "cache (cache)"},
+	}
+	if !reflect.DeepEqual(edges, want) {
+		t.Errorf("edges = %q, want %q", edges, want)
+	}
+	last := graph.Nodes[len(graph.Nodes)-2:]
+	if last[0].Label != "infra" || last[0].Members != 2 || last[1].Label != "cleanup" || last[1].Members != 0 {
+		t.Errorf("wait groups = %+v %+v, want infra with 2 members and cleanup without members", last[0], last[1])
+	}
+}
+
+func TestPrint(t *testing.T) {
+	for _, format := range []string{"dot", "mermaid"} {
+		var buf bytes.Buffer
+		if err := Print(&buf, Build(testPlan()), format); err != nil {
+			t.Fatal(err)
+		}
+		golden := filepath.Join("testdata", "graph."+format)
+		if *update {
+			if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != string(want) {
+			t.Errorf("%s graph differs from %s:\n%s", format, golden, buf.String())
+		}
+	}
+	if err := Print(ioutil.Discard, Build(testPlan()), "svg"); err == nil {
+		t.Error("Print with the svg format returned no error")
+	}
+}
@@ -1,15 +1,13 @@
 package misc
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime/debug"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -18,84 +16,110 @@ import (
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/kruglovmax/stack/pkg/app"
 	"github.com/kruglovmax/stack/pkg/consts"
-	"github.com/kruglovmax/stack/pkg/log"
 	"github.com/kruglovmax/stack/pkg/types"
+	"github.com/kruglovmax/stack/pkg/yamlpos"
+	"github.com/rs/zerolog"
 	sopsDecrypt "go.mozilla.org/sops/v3/decrypt"
 	"sigs.k8s.io/yaml"
 )
 
 // LoadYAML func
-func LoadYAML(yamlInput string, result interface{}) {
-	var yamlErr error
-	yamlErr = yaml.Unmarshal([]byte(yamlInput), &result)
-	if yamlErr != nil {
-		log.Logger.Trace().
-			Msg(spew.Sdump(yamlInput))
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Msg(yamlErr.Error())
-	}
+func LoadYAML(yamlInput string, result interface{}) (err error) {
+	err = yaml.Unmarshal([]byte(yamlInput), &result)
+	return
 }
 
 // LoadYAMLFromFile func
-func LoadYAMLFromFile(fileName string, result interface{}) {
-	content, ioErr := ioutil.ReadFile(fileName)
-	if ioErr != nil {
-		log.Logger.Trace().
-			Msg(spew.Sdump(fileName))
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Msg(ioErr.Error())
-	}
-	LoadYAML(string(content), &result)
+func LoadYAMLFromFile(fileName string, result interface{}) (err error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	err = LoadYAML(string(content), &result)
+	if err != nil {
+		err = yamlpos.Wrap(fileName, content, err)
+	}
+	return
 }
 
 // LoadYAMLFromSopsFile func
-func LoadYAMLFromSopsFile(fileName string, result interface{}) {
-	content, err := sopsDecrypt.File(fileName, "yaml")
+func LoadYAMLFromSopsFile(fileName string, result interface{}) (err error) {
+	content, err := DecryptSopsFile(fileName, "yaml")
 	if err != nil {
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Msgf("[ SOPS ] File %s decryption Error. Check internet connection.\n"+err.Error(), fileName)
+		return
+	}
+	err = LoadYAML(string(content), &result)
+	if err != nil {
+		err = yamlpos.Wrap(fileName, content, err)
 	}
-	LoadYAML(string(content), &result)
+	return
+}
+
+// DecryptSopsFile func. format is the format of the file (yaml, json, dotenv, binary)
+func DecryptSopsFile(fileName, format string) (content []byte, err error) {
+	content, err = sopsDecrypt.File(fileName, format)
+	if err != nil {
+		err = fmt.Errorf("[ SOPS ] File %s decryption Error. Check internet connection.\n%w", fileName, err)
+	}
+	return
 }
 
 // ToYAML func
-func ToYAML(object interface{}) string {
+func ToYAML(object interface{}) (string, error) {
 	y, err := yaml.Marshal(object)
 	if err != nil {
-		log.Logger.Trace().
-			Msg(spew.Sdump(object))
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Msg("YAML marshal error\n" + err.Error())
-	}
-	return string(y)
+		return "", fmt.Errorf("YAML marshal error: %w", err)
+	}
+	return string(y), nil
 }
 
-// ToInterface func
-func ToInterface(object interface{}) (result interface{}) {
-	LoadYAML(ToJSON(object), &result)
-	return
+// CopyValue returns a deep copy of maps and lists of the value.
+// Numbers become float64 as in values loaded from YAML and JSON
+func CopyValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		output := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			output[key] = CopyValue(item)
+		}
+		return output
+	case map[string]string:
+		output := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			output[key] = item
+		}
+		return output
+	case []interface{}:
+		output := make([]interface{}, len(value))
+		for i, item := range value {
+			output[i] = CopyValue(item)
+		}
+		return output
+	case int:
+		return float64(value)
+	case int32:
+		return float64(value)
+	case int64:
+		return float64(value)
+	case uint:
+		return float64(value)
+	case uint32:
+		return float64(value)
+	case uint64:
+		return float64(value)
+	case float32:
+		return float64(value)
+	}
+	return value
 }
 
 // ToJSON func
-func ToJSON(object interface{}) string {
+func ToJSON(object interface{}) (string, error) {
 	y, err := json.Marshal(object)
 	if err != nil {
-		log.Logger.Trace().
-			Msg(spew.Sdump(object))
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Msg("JSON marshal error\n" + err.Error())
-	}
-	return string(y)
+		return "", fmt.Errorf("JSON marshal error: %w", err)
+	}
+	return string(y), nil
 }
 
 // UniqueStr func
@@ -111,20 +135,17 @@ func UniqueStr(input []string) (output []string) {
 	return
 }
 
-// WaitTimeout waits for the waitgroup for the specified max timeout.
-// Returns true if waiting timed out.
-func WaitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
-	c := make(chan struct{})
-	go func() {
-		defer close(c)
-		wg.Wait()
-	}()
-	select {
-	case <-c:
-		return false // completed normally
-	case <-time.After(timeout):
-		return true // timed out
+// RunWithTimeout runs f with the context cancelled after the timeout or when ctx is done.
+// f must return soon after its context is done: RunWithTimeout waits for it, so no copy
+// of f is left running. Returns true if f timed out, the error of f is dropped then
+func RunWithTimeout(ctx context.Context, timeout time.Duration, f func(ctx context.Context) error) (timedOut bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err = f(ctx)
+	if ctx.Err() == context.DeadlineExceeded {
+		return true, nil
 	}
+	return false, err
 }
 
 // FindPath func
@@ -151,33 +172,23 @@ func FindPath(dir string, searchPaths ...string) (output string, err error) {
 	return
 }
 
-// CheckIfErr func
-func CheckIfErr(err error, stacks ...types.Stack) {
-	if err != nil {
-		for _, stack := range stacks {
-			PrintStackTrace(stack)
-		}
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Msg(err.Error())
-	}
-}
+// gitWorkMutex serializes clones of libs. They share directories between stack trees
+var gitWorkMutex sync.Mutex
 
-// GitClone func
-func GitClone(parentWG *sync.WaitGroup, gitClonePath, gitURL, gitRef string, fetchIfExists bool, noWaitForOthers bool) {
+// GitClone func. Refs which are not commit hashes are logged by logger.
+// Cloning and fetching stop when ctx is done
+func GitClone(ctx context.Context, parentWG *sync.WaitGroup, logger zerolog.Logger, gitClonePath, gitURL, gitRef string, fetchIfExists bool, noWaitForOthers bool) (err error) {
 	if parentWG != nil {
 		defer parentWG.Done()
 	}
 
-	var err error
 	if !noWaitForOthers {
-		app.App.Mutex.GitWorkMutex.Lock()
-		defer app.App.Mutex.GitWorkMutex.Unlock()
+		gitWorkMutex.Lock()
+		defer gitWorkMutex.Unlock()
 	}
 	os.MkdirAll(gitClonePath, os.ModePerm)
 	var gitRepo *git.Repository
-	gitRepo, err = git.PlainClone(gitClonePath, false, &git.CloneOptions{
+	gitRepo, err = git.PlainCloneContext(ctx, gitClonePath, false, &git.CloneOptions{
 		URL:      gitURL,
 		Progress: nil,
 	})
@@ -188,22 +199,34 @@ func GitClone(parentWG *sync.WaitGroup, gitClonePath, gitURL, gitRef string, fet
 			if err != nil {
 				return
 			}
-			err = gitRepo.Fetch(&git.FetchOptions{Progress: os.Stderr})
+			err = gitRepo.FetchContext(ctx, &git.FetchOptions{Progress: os.Stderr})
 		} else {
+			err = nil
 			return
 		}
 	}
 	if err != nil && err != git.NoErrAlreadyUpToDate {
 		return
 	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
 	var gitWorkTree *git.Worktree
 	gitWorkTree, err = gitRepo.Worktree()
 	if err != nil {
-		CheckIfErr(err)
+		return
 	}
 	err = gitWorkTree.Checkout(&git.CheckoutOptions{
 		Hash: plumbing.NewHash(gitRef),
 	})
+	if err != nil && !plumbing.IsHash(gitRef) {
+		// only commit hashes are pinned, other refs fall back to the default branch
+		logger.Warn().
+			Str("repo", gitURL).
+			Str("ref", gitRef).
+			Msg(err.Error())
+		err = nil
+	}
 	return
 }
 
@@ -216,59 +239,20 @@ func GitClone(parentWG *sync.WaitGroup, gitClonePath, gitURL, gitRef string, fet
 // 	return nil
 // }
 
-// GetObjectValue func
-func GetObjectValue(object interface{}, key string) interface{} {
-	switch object.(type) {
-	case map[string]interface{}:
-		return object.(map[string]interface{})[key]
-	case []interface{}:
-		i, err := strconv.Atoi(key)
-		if err != nil {
-			log.Logger.Trace().
-				Msg(spew.Sdump(key))
-			log.Logger.Debug().
-				Msg(string(debug.Stack()))
-			log.Logger.Fatal().Str("Index", key).
-				Msg(err.Error())
-		}
-		return object.([]interface{})[i]
-	default:
-		log.Logger.Warn().
-			Msg("Bad value\n" + string(debug.Stack()))
-		return nil
-	}
-}
-
-// GetObject func
-func GetObject(root interface{}, path string) interface{} {
-	splitResult := strings.SplitN(strings.TrimLeft(path, "."), ".", 2)
-	left := splitResult[0]
-	if len(splitResult) > 0 && left != "" {
-		if len(splitResult) > 1 {
-			right := splitResult[1]
-			return GetObject(GetObjectValue(root, left), right)
-		}
-		return GetObjectValue(root, left)
-	}
-	return root
-}
-
 // GetDirsByRegexp func
-func GetDirsByRegexp(pwd string, pattern string) (dirs []string) {
+func GetDirsByRegexp(pwd string, pattern string) (dirs []string, err error) {
 	// ^(?:monitoring|(.*))$
-	pattern = "^(" + pattern + ")$"
-	files, err := ioutil.ReadDir(pwd)
+	re, err := regexp.Compile("^(" + pattern + ")$")
 	if err != nil {
+		return
+	}
+	files, ioErr := ioutil.ReadDir(pwd)
+	if ioErr != nil {
 		dirs = nil
 		return
 	}
 	for _, fileItem := range files {
 		if fileItem.IsDir() {
-			re, err := regexp.Compile(pattern)
-			if err != nil {
-				log.Logger.Fatal().
-					Msg(err.Error() + "\n" + string(debug.Stack()))
-			}
 			matches := re.FindStringSubmatch(fileItem.Name())
 			if len(matches) > 0 && matches[1] != "" {
 				dirs = append(dirs, fileItem.Name())
@@ -279,7 +263,7 @@ func GetDirsByRegexp(pwd string, pattern string) (dirs []string) {
 }
 
 // ReadFileFromPath func
-func ReadFileFromPath(path string) (output string) {
+func ReadFileFromPath(path string) (output string, err error) {
 	loadTemplateFromWalkPath := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -296,13 +280,11 @@ func ReadFileFromPath(path string) (output string) {
 
 	fullpath, err := filepath.Abs(path)
 	if PathIsExists(fullpath) && (err == nil) {
-		err := filepath.Walk(fullpath, loadTemplateFromWalkPath)
-		CheckIfErr(err)
-		return output
+		err = filepath.Walk(fullpath, loadTemplateFromWalkPath)
+		return
 	}
 	err = fmt.Errorf("Path is not exists: %s", fullpath)
-	CheckIfErr(err)
-	return ""
+	return
 }
 
 // PathIsExists returns whether the given file or directory exists
@@ -342,22 +324,17 @@ func PathIsFile(path string) bool {
 	}
 }
 
-// PrintStackTrace func
-func PrintStackTrace(stack types.Stack) {
-	log.Logger.Error().
-		Str("stack", stack.GetWorkdir()).
-		Msg("From")
-	parentStack := stack.GetParent()
-	for parentStack != nil {
-		log.Logger.Error().
-			Str("stack", parentStack.GetWorkdir()).
-			Msg("Parent")
-		parentStack = parentStack.GetParent()
+// GetStackTrace returns workdirs of the stack and all its parents
+func GetStackTrace(stack types.Stack) (output []string) {
+	for stack != nil {
+		output = append(output, stack.GetWorkdir())
+		stack = stack.GetParent()
 	}
+	return
 }
 
 // FindStackFileInDir func
-func FindStackFileInDir(dir string) (stackFile string) {
+func FindStackFileInDir(dir string) (stackFile string, err error) {
 	dirBase := filepath.Base(dir)
 	switch {
 	case PathIsExists(filepath.Join(dir, consts.StackDefaultFileName+".yaml")):
@@ -373,11 +350,7 @@ func FindStackFileInDir(dir string) (stackFile string) {
 	case PathIsExists(filepath.Join(dir, dirBase+".json")):
 		stackFile = filepath.Clean(filepath.Join(dir, dirBase+".json"))
 	default:
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Str("workdir", dir).
-			Msg("Stack file is not found in")
+		err = fmt.Errorf("Stack file is not found in %s", dir)
 	}
 	return
 }
@@ -397,8 +370,10 @@ func GetDirPath(fullpath string) (dirPath string) {
 // GetStackPathRelativeToTheRootStack func
 func GetStackPathRelativeToTheRootStack(stack types.Stack) (output string) {
 	var err error
-	output, err = filepath.Rel(*app.App.Config.Workdir, stack.GetWorkdir())
-	CheckIfErr(err, stack)
+	output, err = filepath.Rel(app.FromStack(stack).Config.Workdir, stack.GetWorkdir())
+	if err != nil {
+		output = stack.GetWorkdir()
+	}
 	return
 }
 
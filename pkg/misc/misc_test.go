@@ -0,0 +1,40 @@
+package misc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunWithTimeout(t *testing.T) {
+	stopped := false
+	timedOut, err := RunWithTimeout(context.Background(), 50*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		stopped = true
+		return ctx.Err()
+	})
+	if !timedOut || err != nil {
+		t.Errorf("RunWithTimeout = %v, %v, want the timeout", timedOut, err)
+	}
+	if !stopped {
+		t.Error("RunWithTimeout returned before f stopped")
+	}
+
+	timedOut, err = RunWithTimeout(context.Background(), time.Minute, func(ctx context.Context) error {
+		return errors.New("failed")
+	})
+	if timedOut || err == nil || err.Error() != "failed" {
+		t.Errorf("RunWithTimeout = %v, %v, want the error of f", timedOut, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	timedOut, err = RunWithTimeout(ctx, time.Minute, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if timedOut || !errors.Is(err, context.Canceled) {
+		t.Errorf("RunWithTimeout of the cancelled context = %v, %v, want context.Canceled", timedOut, err)
+	}
+}
@@ -0,0 +1,20 @@
+package misc
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// TerminateProcessGroup sends SIGTERM to the process group of cmd started with
+// Setpgid and SIGKILL after the grace period or after done is closed, so children
+// left by the process are killed too. The caller waits for cmd
+func TerminateProcessGroup(cmd *exec.Cmd, done <-chan struct{}, grace time.Duration) {
+	pgid := -cmd.Process.Pid
+	syscall.Kill(pgid, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(grace):
+	}
+	syscall.Kill(pgid, syscall.SIGKILL)
+}
@@ -0,0 +1,187 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+const indentStep = "  "
+
+// Print writes the plan in the given format (text, json)
+func Print(w io.Writer, plan *types.StackPlan, format string) (err error) {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", indentStep)
+		err = encoder.Encode(plan)
+	case "text", "":
+		printStack(w, plan, "", "")
+	default:
+		err = fmt.Errorf("Unsupported plan format: %s", format)
+	}
+	return
+}
+
+func printStack(w io.Writer, plan *types.StackPlan, indent, mode string) {
+	fmt.Fprintf(w, "%sstack %s (name: %s)%s\n", indent, plan.Path, plan.Name, mode)
+	indent = indent + indentStep
+	fmt.Fprintf(w, "%sworkdir: %s\n", indent, plan.Workdir)
+	if plan.When != "" {
+		fmt.Fprintf(w, "%swhen: %s\n", indent, plan.When)
+	}
+	if plan.Wait != "" {
+		fmt.Fprintf(w, "%swait: %s (timeout: %s)\n", indent, plan.Wait, plan.WaitTimeout)
+	}
+	if len(plan.WaitGroups) > 0 {
+		fmt.Fprintf(w, "%swaitGroups: %s\n", indent, strings.Join(plan.WaitGroups, ", "))
+	}
+	printPolicy(w, indent, plan.Retries, plan.ContinueOnError)
+	if plan.Ancestor {
+		fmt.Fprintf(w, "%sancestor: run items are not executed\n", indent)
+	}
+	if plan.Input != nil {
+		printValue(w, indent, "input", plan.Input)
+	}
+	if len(plan.Vars) > 0 {
+		printValue(w, indent, "vars", plan.Vars)
+	}
+	if len(plan.Flags) > 0 {
+		printValue(w, indent, "flags", plan.Flags)
+	}
+	if len(plan.Locals) > 0 {
+		printValue(w, indent, "locals", plan.Locals)
+	}
+	printRunItems(w, indent, "preRun", plan.PreRun)
+	printRunItems(w, indent, "run", plan.Run)
+	if len(plan.Stacks) > 0 {
+		fmt.Fprintf(w, "%sstacks:\n", indent)
+		for _, child := range plan.Stacks {
+			printStack(w, child, indent+indentStep, "")
+		}
+	}
+	if len(plan.ParallelStacks) > 0 {
+		fmt.Fprintf(w, "%spstacks:%s\n", indent, maxParallel(plan.MaxParallel))
+		for _, child := range plan.ParallelStacks {
+			printStack(w, child, indent+indentStep, " [parallel]")
+		}
+	}
+	printRunItems(w, indent, "postRun", plan.PostRun)
+	if len(plan.Outputs) > 0 {
+		printValue(w, indent, "outputs", plan.Outputs)
+	}
+}
+
+func printRunItems(w io.Writer, indent, title string, items []*types.RunItemPlan) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s%s:\n", indent, title)
+	for i, item := range items {
+		printRunItem(w, indent+indentStep, i+1, item)
+	}
+}
+
+func printRunItem(w io.Writer, indent string, number int, item *types.RunItemPlan) {
+	mode := ""
+	if item.Parallel {
+		mode = " [parallel]" + maxParallel(item.MaxParallel)
+	}
+	fmt.Fprintf(w, "%s%d. %s%s\n", indent, number, item.Type, mode)
+	indent = indent + indentStep + indentStep
+	if item.Value != nil {
+		printValue(w, indent, item.Type, item.Value)
+	}
+	if item.Vars != nil {
+		printValue(w, indent, "vars", item.Vars)
+	}
+	if item.When != "" {
+		fmt.Fprintf(w, "%swhen: %s\n", indent, item.When)
+	}
+	if item.Wait != "" {
+		fmt.Fprintf(w, "%swait: %s\n", indent, item.Wait)
+	}
+	printPolicy(w, indent, item.Retries, item.ContinueOnError)
+	if len(item.Output) > 0 {
+		printValue(w, indent, "output", item.Output)
+	}
+	for i, child := range item.Items {
+		printRunItem(w, indent, i+1, child)
+	}
+}
+
+func printPolicy(w io.Writer, indent string, retries int, continueOnError bool) {
+	if retries > 0 {
+		fmt.Fprintf(w, "%sretries: %d\n", indent, retries)
+	}
+	if continueOnError {
+		fmt.Fprintf(w, "%scontinueOnError: true\n", indent)
+	}
+}
+
+func maxParallel(limit int) string {
+	if limit > 0 {
+		return fmt.Sprintf(" (maxParallel: %d)", limit)
+	}
+	return ""
+}
+
+func printValue(w io.Writer, indent, key string, value interface{}) {
+	if str, ok := value.(string); ok && !strings.Contains(str, "\n") {
+		fmt.Fprintf(w, "%s%s: %s\n", indent, key, str)
+		return
+	}
+	var text string
+	if str, ok := value.(string); ok {
+		text = str
+	} else if yamlText, err := misc.ToYAML(value); err == nil {
+		text = yamlText
+	} else {
+		text = fmt.Sprint(value)
+	}
+	fmt.Fprintf(w, "%s%s:\n", indent, key)
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		fmt.Fprintf(w, "%s%s%s\n", indent, indentStep, line)
+	}
+}
+
+// PrintVars writes resolved vars of stacks with their origins.
+// If key is not empty only the var and its nested vars are written
+func PrintVars(w io.Writer, stacks []*types.ExplainedStackVars, key string) {
+	for _, stack := range stacks {
+		fmt.Fprintf(w, "stack %s (name: %s)\n", stack.Path, stack.Name)
+		for _, explained := range stack.Vars {
+			if key != "" && !matchVarKey(explained.Key, key) {
+				continue
+			}
+			value, err := misc.ToJSON(explained.Value)
+			if err != nil {
+				value = fmt.Sprint(explained.Value)
+			}
+			fmt.Fprintf(w, "%s%s: %s\n", indentStep, explained.Key, value)
+			if origin := explained.Origin; origin != nil {
+				from := origin.Source
+				if origin.Stack != stack.Path {
+					from = fmt.Sprintf("%s (parent stack %s)", from, origin.Stack)
+				}
+				fmt.Fprintf(w, "%sfrom: %s\n", indentStep+indentStep, from)
+			}
+			if explained.Modifier != "" {
+				fmt.Fprintf(w, "%smodifier: %s\n", indentStep+indentStep, explained.Modifier)
+			}
+		}
+	}
+}
+
+// matchVarKey returns true if key is the var or one of its parents
+func matchVarKey(varKey, key string) bool {
+	if !strings.HasPrefix(varKey, key) {
+		return false
+	}
+	rest := varKey[len(key):]
+	return rest == "" || rest[0] == '.' || rest[0] == '['
+}
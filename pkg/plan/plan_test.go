@@ -0,0 +1,73 @@
+package plan
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/stack"
+	"github.com/rs/zerolog"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestPrint(t *testing.T) {
+	workdir, err := filepath.Abs(filepath.Join("testdata", "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := zerolog.Nop()
+	runner, err := stack.NewRunner(stack.Options{
+		Config: app.Config{Workdir: workdir},
+		Logger: &logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := runner.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(workdir, "executed")); !os.IsNotExist(err) {
+		os.Remove(filepath.Join(workdir, "executed"))
+		t.Error("plan executed preRun of the root stack")
+	}
+
+	for format, golden := range map[string]string{
+		"text": "plan.txt",
+		"json": "plan.json",
+	} {
+		var buf bytes.Buffer
+		if err = Print(&buf, plan, format); err != nil {
+			t.Fatal(err)
+		}
+		// workdirs are absolute, golden files keep them relative to testdata
+		got := strings.Replace(buf.String(), workdir, "$WORKDIR", -1)
+		golden = filepath.Join("testdata", golden)
+		if *update {
+			if err = ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%s plan differs from %s:\n%s", format, golden, got)
+		}
+	}
+}
+
+func TestPrintUnsupportedFormat(t *testing.T) {
+	if err := Print(ioutil.Discard, nil, "xml"); err == nil {
+		t.Error("Print with the xml format returned no error")
+	}
+}
@@ -0,0 +1,104 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes every stack as a test suite and the stack itself
+// with every run item as test cases
+func (report *Report) WriteJUnit(fileName string) error {
+	report.mux.Lock()
+	defer report.mux.Unlock()
+	suites := junitTestSuites{
+		Name: "stack",
+		Time: junitTime(report.Duration),
+	}
+	for _, stack := range report.Stacks {
+		suite := junitTestSuite{
+			Name:      stack.Path,
+			Time:      junitTime(stack.Duration),
+			Timestamp: stack.Start.Format(time.RFC3339),
+		}
+		suite.Cases = append(suite.Cases,
+			junitCase("stack", stack.Path, stack.Status, stack.Duration, stack.Skipped, stack.Error))
+		for i, runItem := range stack.RunItems {
+			name := fmt.Sprintf("%d. %s", i+1, runItem.Type)
+			if runItem.Name != "" {
+				name = name + ": " + runItem.Name
+			}
+			suite.Cases = append(suite.Cases,
+				junitCase(name, stack.Path, runItem.Status, runItem.Duration, runItem.Skipped, runItem.Error))
+		}
+		for _, testCase := range suite.Cases {
+			suite.Tests++
+			if testCase.Failure != nil {
+				suite.Failures++
+			}
+			if testCase.Skipped != nil {
+				suite.Skipped++
+			}
+		}
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Skipped += suite.Skipped
+		suites.Suites = append(suites.Suites, suite)
+	}
+	content, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, append([]byte(xml.Header), content...), 0644)
+}
+
+func junitCase(name, className, status string, duration float64, skipped, errorMessage string) (testCase junitTestCase) {
+	testCase.Name = name
+	testCase.ClassName = className
+	testCase.Time = junitTime(duration)
+	switch {
+	case status == StatusFailed || (errorMessage != "" && status != StatusFailedIgnored):
+		testCase.Failure = &junitMessage{Message: status, Text: errorMessage}
+	case status == StatusSkipped:
+		testCase.Skipped = &junitMessage{Message: skipped}
+	}
+	return
+}
+
+func junitTime(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
@@ -0,0 +1,198 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+// Statuses of run items
+const (
+	StatusDone          = "Done"
+	StatusFailed        = "Failed"
+	StatusFailedIgnored = "FailedIgnored"
+	StatusSkipped       = "Skipped"
+	StatusCancelled     = "Cancelled"
+)
+
+// Report collects timings, statuses and errors of stacks and run items
+type Report struct {
+	mux      sync.Mutex
+	stacks   map[string]*Stack
+	runItems map[types.RunItem]*RunItem
+
+	Status   string    `json:"status"`
+	ExitCode int       `json:"exitCode"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration"`
+	Stacks   []*Stack  `json:"stacks"`
+}
+
+// Stack is a report entry of a stack
+type Stack struct {
+	ID       string     `json:"id"`
+	Path     string     `json:"path"`
+	Name     string     `json:"name"`
+	Workdir  string     `json:"workdir"`
+	Status   string     `json:"status"`
+	Start    time.Time  `json:"start"`
+	End      time.Time  `json:"end"`
+	Duration float64    `json:"duration"`
+	Skipped  string     `json:"skipped,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	RunItems []*RunItem `json:"runItems,omitempty"`
+}
+
+// RunItem is a report entry of a run item
+type RunItem struct {
+	// ID is the key of the run item status in the stack status map
+	ID       string    `json:"id,omitempty"`
+	Type     string    `json:"type"`
+	Name     string    `json:"name,omitempty"`
+	Status   string    `json:"status"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration"`
+	Retries  int       `json:"retries,omitempty"`
+	Skipped  string    `json:"skipped,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// New func
+func New() *Report {
+	report := new(Report)
+	report.stacks = make(map[string]*Stack)
+	report.runItems = make(map[types.RunItem]*RunItem)
+	report.Start = time.Now()
+	return report
+}
+
+// StackStarted adds the stack to the report. path is relative to the root stack
+func (report *Report) StackStarted(stack types.Stack, path string) {
+	report.mux.Lock()
+	defer report.mux.Unlock()
+	entry := &Stack{
+		ID:      stack.GetStackID(),
+		Path:    path,
+		Name:    stack.GetName(),
+		Workdir: stack.GetWorkdir(),
+		Start:   time.Now(),
+	}
+	report.stacks[entry.ID] = entry
+	report.Stacks = append(report.Stacks, entry)
+}
+
+// StackSkipped func
+func (report *Report) StackSkipped(stack types.Stack, reason string) {
+	report.mux.Lock()
+	defer report.mux.Unlock()
+	if entry, ok := report.stacks[stack.GetStackID()]; ok {
+		entry.Skipped = reason
+	}
+}
+
+// StackFinished func
+func (report *Report) StackFinished(stack types.Stack, err error) {
+	report.mux.Lock()
+	defer report.mux.Unlock()
+	if entry, ok := report.stacks[stack.GetStackID()]; ok {
+		entry.End = time.Now()
+		entry.Duration = entry.End.Sub(entry.Start).Seconds()
+		if err != nil {
+			entry.Error = err.Error()
+		}
+	}
+}
+
+// RunItemStarted adds the run item to the report of its stack and returns its ID:
+// the stack ID and the number of the run item in the stack
+func (report *Report) RunItemStarted(stack types.Stack, runItem types.RunItem, itemType, name string) (id string) {
+	report.mux.Lock()
+	defer report.mux.Unlock()
+	entry := &RunItem{
+		Type:  itemType,
+		Name:  name,
+		Start: time.Now(),
+	}
+	report.runItems[runItem] = entry
+	if stackEntry, ok := report.stacks[stack.GetStackID()]; ok {
+		stackEntry.RunItems = append(stackEntry.RunItems, entry)
+		entry.ID = fmt.Sprintf("%s/run/%d", stackEntry.ID, len(stackEntry.RunItems))
+	}
+	return entry.ID
+}
+
+// RunItemSkipped func
+func (report *Report) RunItemSkipped(runItem types.RunItem, reason string) {
+	report.mux.Lock()
+	defer report.mux.Unlock()
+	if entry, ok := report.runItems[runItem]; ok {
+		entry.Skipped = reason
+	}
+}
+
+// RunItemRetried counts failed attempts of the run item followed by a retry
+func (report *Report) RunItemRetried(runItem types.RunItem) {
+	report.mux.Lock()
+	defer report.mux.Unlock()
+	if entry, ok := report.runItems[runItem]; ok {
+		entry.Retries++
+	}
+}
+
+// RunItemFinished records the outcome of the run item and returns its final status
+func (report *Report) RunItemFinished(runItem types.RunItem, status string, err error) string {
+	report.mux.Lock()
+	defer report.mux.Unlock()
+	entry, ok := report.runItems[runItem]
+	if !ok {
+		return status
+	}
+	entry.End = time.Now()
+	entry.Duration = entry.End.Sub(entry.Start).Seconds()
+	entry.Status = status
+	if entry.Skipped != "" && status == StatusDone {
+		entry.Status = StatusSkipped
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	return entry.Status
+}
+
+// Finish takes final statuses of stacks from status
+func (report *Report) Finish(status *types.StacksStatus, exitCode int) {
+	report.mux.Lock()
+	defer report.mux.Unlock()
+	report.End = time.Now()
+	report.Duration = report.End.Sub(report.Start).Seconds()
+	report.ExitCode = exitCode
+	report.Status = StatusDone
+	if exitCode != 0 {
+		report.Status = StatusFailed
+	}
+	status.Mux.Lock()
+	defer status.Mux.Unlock()
+	for id, entry := range report.stacks {
+		entry.Status = status.StacksStatus[id]
+		if entry.Skipped != "" && entry.Status != StatusFailed {
+			entry.Status = StatusSkipped
+		}
+	}
+}
+
+// WriteJSON func
+func (report *Report) WriteJSON(fileName string) error {
+	report.mux.Lock()
+	defer report.mux.Unlock()
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, content, 0644)
+}
@@ -0,0 +1,86 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultDelay between attempts
+const DefaultDelay = 1 * time.Second
+
+// Policy describes how a failed stack or run item is handled
+type Policy struct {
+	ContinueOnError bool
+	Retries         int
+	Delay           time.Duration
+	Backoff         float64
+}
+
+// New func
+func New(continueOnError bool, retries int, delay string, backoff float64) (policy Policy, err error) {
+	policy.ContinueOnError = continueOnError
+	policy.Retries = retries
+	policy.Delay = DefaultDelay
+	if delay != "" {
+		policy.Delay, err = time.ParseDuration(delay)
+		if err != nil {
+			return
+		}
+	}
+	policy.Backoff = 1
+	if backoff != 0 {
+		policy.Backoff = backoff
+	}
+	if policy.Retries < 0 || policy.Backoff < 1 {
+		err = fmt.Errorf("Bad retry policy: retries %d, retryBackoff %v", policy.Retries, policy.Backoff)
+	}
+	return
+}
+
+// Parse reads continueOnError, retries, retryDelay and retryBackoff keys
+func Parse(rawItem map[string]interface{}) (Policy, error) {
+	continueOnError, _ := rawItem["continueOnError"].(bool)
+	delay, _ := rawItem["retryDelay"].(string)
+	var retries int
+	switch value := rawItem["retries"].(type) {
+	case float64:
+		retries = int(value)
+	case int:
+		retries = value
+	}
+	var backoff float64
+	switch value := rawItem["retryBackoff"].(type) {
+	case float64:
+		backoff = value
+	case int:
+		backoff = float64(value)
+	}
+	return New(continueOnError, retries, delay, backoff)
+}
+
+// IsSet returns true if the policy changes default failure handling
+func (policy Policy) IsSet() bool {
+	return policy.ContinueOnError || policy.Retries > 0
+}
+
+// Do calls f until it succeeds, retries are exhausted or ctx is done.
+// onRetry is called before every next attempt
+func (policy Policy) Do(ctx context.Context, f func() error, onRetry func(attempt int, err error)) (err error) {
+	delay := policy.Delay
+	for attempt := 0; ; attempt++ {
+		err = f()
+		if err == nil || attempt >= policy.Retries || ctx.Err() != nil {
+			return
+		}
+		if onRetry != nil {
+			onRetry(attempt+1, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = time.Duration(float64(delay) * policy.Backoff)
+	}
+}
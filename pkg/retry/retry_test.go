@@ -0,0 +1,116 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	policy, err := New(false, 0, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Delay != DefaultDelay || policy.Backoff != 1 || policy.IsSet() {
+		t.Errorf("default policy = %+v", policy)
+	}
+
+	policy, err = New(true, 2, "250ms", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Delay != 250*time.Millisecond || policy.Backoff != 2 || !policy.IsSet() {
+		t.Errorf("policy = %+v", policy)
+	}
+
+	for _, bad := range []struct {
+		retries int
+		delay   string
+		backoff float64
+	}{
+		{-1, "", 0},
+		{1, "", 0.5},
+		{1, "soon", 0},
+	} {
+		if _, err := New(false, bad.retries, bad.delay, bad.backoff); err == nil {
+			t.Errorf("New(%d, %q, %v) returned no error", bad.retries, bad.delay, bad.backoff)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	policy, err := Parse(map[string]interface{}{
+		"continueOnError": true,
+		"retries":         float64(3),
+		"retryDelay":      "10ms",
+		"retryBackoff":    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Policy{ContinueOnError: true, Retries: 3, Delay: 10 * time.Millisecond, Backoff: 2}
+	if policy != want {
+		t.Errorf("Parse = %+v, want %+v", policy, want)
+	}
+}
+
+func TestDoRetries(t *testing.T) {
+	policy := Policy{Retries: 2, Delay: time.Millisecond, Backoff: 1}
+	failure := errors.New("failure")
+	var calls int
+	var attempts []int
+	err := policy.Do(context.Background(), func() error {
+		calls++
+		return failure
+	}, func(attempt int, err error) {
+		attempts = append(attempts, attempt)
+	})
+	if err != failure {
+		t.Errorf("Do = %v, want %v", err, failure)
+	}
+	if calls != 3 {
+		t.Errorf("f called %d times, want 3", calls)
+	}
+	if len(attempts) != 2 || attempts[0] != 1 || attempts[1] != 2 {
+		t.Errorf("onRetry attempts = %v, want [1 2]", attempts)
+	}
+}
+
+func TestDoSucceeds(t *testing.T) {
+	policy := Policy{Retries: 5, Delay: time.Millisecond, Backoff: 1}
+	var calls int
+	err := policy.Do(context.Background(), func() error {
+		calls++
+		if calls < 2 {
+			return errors.New("failure")
+		}
+		return nil
+	}, nil)
+	if err != nil || calls != 2 {
+		t.Errorf("Do = %v after %d calls, want nil after 2", err, calls)
+	}
+}
+
+func TestDoCancelled(t *testing.T) {
+	policy := Policy{Retries: 5, Delay: time.Hour, Backoff: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	done := make(chan error, 1)
+	go func() {
+		done <- policy.Do(ctx, func() error {
+			calls++
+			return errors.New("failure")
+		}, func(int, error) {
+			cancel()
+		})
+	}()
+	select {
+	case err := <-done:
+		if err == nil || calls != 1 {
+			t.Errorf("Do = %v after %d calls, want the error after 1", err, calls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Do did not stop waiting for the next attempt after cancel")
+	}
+}
@@ -0,0 +1,87 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+)
+
+// Scheduler limits the number of jobs running at the same time. A job is a goroutine
+// running a part of the stack tree: the root stack, a parallel stack or a branch of
+// a parallel group or foreach. A nil Scheduler or a Scheduler with limit <= 0 is unlimited
+type Scheduler struct {
+	slots chan struct{}
+}
+
+// New func
+func New(limit int) *Scheduler {
+	scheduler := new(Scheduler)
+	if limit > 0 {
+		scheduler.slots = make(chan struct{}, limit)
+	}
+	return scheduler
+}
+
+// Acquire blocks until a free slot or ctx is done
+func (scheduler *Scheduler) Acquire(ctx context.Context) error {
+	if scheduler == nil || scheduler.slots == nil {
+		return ctx.Err()
+	}
+	select {
+	case scheduler.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees the slot taken by Acquire
+func (scheduler *Scheduler) Release() {
+	if scheduler == nil || scheduler.slots == nil {
+		return
+	}
+	<-scheduler.slots
+}
+
+// Yield frees the slot of the calling goroutine while f blocks and takes a slot again after it.
+// Taking the slot again does not stop on cancellation: the caller releases the slot later
+func (scheduler *Scheduler) Yield(f func()) {
+	scheduler.Release()
+	defer scheduler.take()
+	f()
+}
+
+// Parallel runs f(i) for i in [0, n) in goroutines, at most maxParallel of them at the same time
+// if maxParallel > 0. Every goroutine takes a slot of the scheduler, the calling goroutine yields
+// its own slot until all of them finish, so nested Parallel calls share one limit.
+// Starting stops when ctx is done. Returns the number of started goroutines
+func (scheduler *Scheduler) Parallel(ctx context.Context, n, maxParallel int, f func(i int)) (started int) {
+	narrow := New(maxParallel)
+	var wg sync.WaitGroup
+	scheduler.Yield(func() {
+		for ; started < n; started++ {
+			if narrow.Acquire(ctx) != nil {
+				break
+			}
+			if scheduler.Acquire(ctx) != nil {
+				narrow.Release()
+				break
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer narrow.Release()
+				defer scheduler.Release()
+				f(i)
+			}(started)
+		}
+		wg.Wait()
+	})
+	return
+}
+
+func (scheduler *Scheduler) take() {
+	if scheduler == nil || scheduler.slots == nil {
+		return
+	}
+	scheduler.slots <- struct{}{}
+}
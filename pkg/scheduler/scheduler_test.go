@@ -0,0 +1,76 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// counter tracks the max number of goroutines running at the same time
+type counter struct {
+	mux          sync.Mutex
+	running, max int
+}
+
+func (counter *counter) run() {
+	counter.mux.Lock()
+	counter.running++
+	if counter.running > counter.max {
+		counter.max = counter.running
+	}
+	counter.mux.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	counter.mux.Lock()
+	counter.running--
+	counter.mux.Unlock()
+}
+
+func TestParallelNested(t *testing.T) {
+	for _, test := range []struct {
+		limit, maxParallel, want int
+	}{
+		{limit: 2, want: 2},
+		{limit: 3, maxParallel: 1, want: 3},
+		{limit: 8, maxParallel: 1, want: 4},
+		{limit: 0, want: 16},
+	} {
+		scheduler := New(test.limit)
+		ctx := context.Background()
+		if err := scheduler.Acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+		var counter counter
+		started := scheduler.Parallel(ctx, 4, 0, func(int) {
+			scheduler.Parallel(ctx, 4, test.maxParallel, func(int) {
+				counter.run()
+			})
+		})
+		scheduler.Release()
+		if started != 4 {
+			t.Errorf("limit %d: started %d, want 4", test.limit, started)
+		}
+		if counter.max == 0 || counter.max > test.want {
+			t.Errorf("limit %d, maxParallel %d: %d goroutines ran at the same time, want at most %d",
+				test.limit, test.maxParallel, counter.max, test.want)
+		}
+		if test.limit > 0 && len(scheduler.slots) != 0 {
+			t.Errorf("limit %d: %d slots are not released", test.limit, len(scheduler.slots))
+		}
+	}
+}
+
+func TestParallelCancelled(t *testing.T) {
+	scheduler := New(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := scheduler.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	started := scheduler.Parallel(ctx, 3, 0, func(int) {
+		cancel()
+	})
+	scheduler.Release()
+	if started != 1 {
+		t.Errorf("started %d after the cancellation, want 1", started)
+	}
+}
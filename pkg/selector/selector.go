@@ -0,0 +1,96 @@
+package selector
+
+import (
+	"path"
+	"strings"
+)
+
+// Selector picks stacks by their path relative to the root stack.
+// A nil Selector selects everything
+type Selector struct {
+	only []string
+	skip []string
+}
+
+// New returns nil if there are no patterns
+func New(only, skip []string) (*Selector, error) {
+	if len(only) == 0 && len(skip) == 0 {
+		return nil, nil
+	}
+	selector := new(Selector)
+	for _, patterns := range []*[]string{&only, &skip} {
+		for i, pattern := range *patterns {
+			pattern = clean(pattern)
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, err
+			}
+			(*patterns)[i] = pattern
+		}
+	}
+	selector.only = only
+	selector.skip = skip
+	return selector, nil
+}
+
+// Skipped returns true if the stack or one of its ancestors matches --skip
+func (selector *Selector) Skipped(stackPath string) bool {
+	if selector == nil {
+		return false
+	}
+	return matchSubtree(selector.skip, stackPath)
+}
+
+// Selected returns true if the stack or one of its ancestors matches --only
+func (selector *Selector) Selected(stackPath string) bool {
+	if selector == nil || len(selector.only) == 0 {
+		return true
+	}
+	return matchSubtree(selector.only, stackPath)
+}
+
+// MayContain returns true if a stack matching --only may be found under the stack
+func (selector *Selector) MayContain(stackPath string) bool {
+	if selector == nil || len(selector.only) == 0 {
+		return true
+	}
+	stackPath = clean(stackPath)
+	if stackPath == "." {
+		return true
+	}
+	parts := strings.Split(stackPath, "/")
+	for _, pattern := range selector.only {
+		patternParts := strings.Split(pattern, "/")
+		if len(patternParts) <= len(parts) {
+			continue
+		}
+		matched := true
+		for i, part := range parts {
+			if ok, _ := path.Match(patternParts[i], part); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSubtree matches the path and all its parents against patterns
+func matchSubtree(patterns []string, stackPath string) bool {
+	for p := clean(stackPath); ; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+		if p == "." || p == "/" {
+			return false
+		}
+	}
+}
+
+func clean(p string) string {
+	return path.Clean(strings.TrimPrefix(p, "./"))
+}
@@ -0,0 +1,80 @@
+package selector
+
+import "testing"
+
+func TestNewWithoutPatterns(t *testing.T) {
+	selector, err := New(nil, nil)
+	if err != nil || selector != nil {
+		t.Fatalf("New(nil, nil) = %v, %v, want nil, nil", selector, err)
+	}
+	if !selector.Selected("a/b") || selector.Skipped("a/b") || !selector.MayContain("a") {
+		t.Error("nil selector must select everything")
+	}
+}
+
+func TestNewBadPattern(t *testing.T) {
+	if _, err := New([]string{"a/[b"}, nil); err == nil {
+		t.Error("New with a bad pattern returned no error")
+	}
+}
+
+func TestSelected(t *testing.T) {
+	selector, err := New([]string{"./apps/*", "infra/db"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stackPath, want := range map[string]bool{
+		".":                false,
+		"apps":             false,
+		"apps/web":         true,
+		"./apps/web":       true,
+		"apps/web/migrate": true,
+		"infra":            false,
+		"infra/db":         true,
+		"infra/db/backup":  true,
+		"infra/dns":        false,
+	} {
+		if got := selector.Selected(stackPath); got != want {
+			t.Errorf("Selected(%q) = %v, want %v", stackPath, got, want)
+		}
+	}
+}
+
+func TestSkipped(t *testing.T) {
+	selector, err := New(nil, []string{"infra/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stackPath, want := range map[string]bool{
+		".":               false,
+		"infra":           false,
+		"infra/db":        true,
+		"infra/db/backup": true,
+		"apps/web":        false,
+	} {
+		if got := selector.Skipped(stackPath); got != want {
+			t.Errorf("Skipped(%q) = %v, want %v", stackPath, got, want)
+		}
+	}
+	if !selector.Selected("apps/web") {
+		t.Error("selector without --only must select every stack")
+	}
+}
+
+func TestMayContain(t *testing.T) {
+	selector, err := New([]string{"apps/*/migrate"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stackPath, want := range map[string]bool{
+		".":                true,
+		"apps":             true,
+		"apps/web":         true,
+		"apps/web/migrate": false,
+		"infra":            false,
+	} {
+		if got := selector.MayContain(stackPath); got != want {
+			t.Errorf("MayContain(%q) = %v, want %v", stackPath, got, want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package stack
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/rs/zerolog"
+)
+
+func TestScriptProcessGroupTerminated(t *testing.T) {
+	for name, test := range map[string]struct {
+		item     string
+		cancel   bool
+		exitCode int
+		status   string
+	}{
+		"cancel": {
+			item:     "- script: sleep 30 & echo $! > pid; wait\n",
+			cancel:   true,
+			exitCode: consts.ExitCodeSIGTERM,
+			status:   "Cancelled",
+		},
+		"cancel ignoring SIGTERM": {
+			item:     "- script: trap '' TERM; sleep 30 & echo $! > pid; wait\n  killGrace: 200ms\n",
+			cancel:   true,
+			exitCode: consts.ExitCodeSIGTERM,
+			status:   "Cancelled",
+		},
+		"runTimeout": {
+			item:     "- script: sleep 30 & echo $! > pid; wait\n  runTimeout: 300ms\n",
+			exitCode: consts.ExitCodeRunTimeout,
+			status:   "Failed",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{"stack.yaml": "api: v1\nrun:\n" + test.item})
+			logger := zerolog.Nop()
+			runner, err := NewRunner(Options{
+				Config: app.Config{Workdir: dir},
+				Stdout: ioutil.Discard,
+				Stderr: ioutil.Discard,
+				Logger: &logger,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			results := make(chan *Result, 1)
+			go func() { results <- runner.Run(ctx) }()
+
+			pid := waitPid(t, filepath.Join(dir, "pid"))
+			if test.cancel {
+				cancel()
+			}
+			var result *Result
+			select {
+			case result = <-results:
+			case <-time.After(10 * time.Second):
+				t.Fatal("the run is not finished 10s after the script was started")
+			}
+			if result.ExitCode != test.exitCode {
+				t.Errorf("exit code = %d, want %d", result.ExitCode, test.exitCode)
+			}
+			if status := result.Report.Stacks[0].Status; status != test.status {
+				t.Errorf("stack status = %s, want %s", status, test.status)
+			}
+			if processAlive(pid) {
+				t.Errorf("child process %d of the script is alive", pid)
+			}
+		})
+	}
+}
+
+// waitPid reads the pid written by the script to file
+func waitPid(t *testing.T, file string) int {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		content, err := ioutil.ReadFile(file)
+		if err != nil || !strings.HasSuffix(string(content), "\n") {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pid
+	}
+	t.Fatal("the script has not written its pid")
+	return 0
+}
+
+// processAlive reports whether the process exists and is not a zombie
+func processAlive(pid int) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+		if err != nil {
+			return false
+		}
+		// the state follows the command name in parentheses
+		fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+		if len(fields) > 0 && fields[0] == "Z" {
+			return false
+		}
+	}
+	return true
+}
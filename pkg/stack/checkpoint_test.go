@@ -0,0 +1,184 @@
+package stack
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/checkpoint"
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/rs/zerolog"
+)
+
+// logScript appends the name to $STACK_ROOT/log
+func logScript(name string) string {
+	return "- script: echo " + name + " >> $STACK_ROOT/log\n"
+}
+
+func TestResume(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"stack.yaml": "api: v1\nstacks: [a, b]\nrun:\n" + logScript("root") + `- script: printf root
+  output:
+  - str2var: flags.root
+postRun:
+` + logScript("root-postRun"),
+		"a/stack.yaml": "api: v1\nrun:\n" + logScript("a") + `- script: printf a
+  output:
+  - str2var: flags.a
+`,
+		"b/stack.yaml": "api: v1\nrun:\n" + logScript("b") + "- script: test -f $STACK_ROOT/ok\n",
+	})
+	if result := runStack(t, dir, false); result.ExitCode == consts.ExitCodeOK {
+		t.Fatal("the first run succeeded, want b failed")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ok"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	result := runStack(t, dir, true)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	want := []string{"root", "a", "b", "root-postRun", "b", "root-postRun"}
+	if log := readLog(t, dir); !reflect.DeepEqual(log, want) {
+		t.Errorf("log = %q, want %q", log, want)
+	}
+	wantFlags := map[string]interface{}{"root": "root", "a": "a"}
+	if !reflect.DeepEqual(result.Flags, wantFlags) {
+		t.Errorf("flags = %v, want %v", result.Flags, wantFlags)
+	}
+	if _, err := os.Stat(filepath.Join(dir, consts.StateDir, consts.StateFileName)); !os.IsNotExist(err) {
+		t.Errorf("state file is left after the successful run: %v", err)
+	}
+}
+
+func TestCheckpointWrittenFlags(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"stack.yaml": "api: v1\npstacks: [a, b, c]\n",
+		"a/stack.yaml": `api: v1
+wait: flags.b == "b"
+run:
+- script: printf a
+  output:
+  - str2var: flags.a
+`,
+		"b/stack.yaml": `api: v1
+run:
+- script: printf b
+  output:
+  - str2var: flags.b
+`,
+		"c/stack.yaml": "api: v1\nwait: flags.a == \"a\"\nrun:\n- script: exit 1\n",
+	})
+	if result := runStack(t, dir, false); result.ExitCode == consts.ExitCodeOK {
+		t.Fatal("the run succeeded, want c failed")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, consts.StateDir, consts.StateFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state checkpoint.State
+	if err = json.Unmarshal(content, &state); err != nil {
+		t.Fatal(err)
+	}
+	flags := make(map[string]map[string]interface{})
+	for key, entry := range state.Stacks {
+		if !entry.Done {
+			continue
+		}
+		flags[key[strings.LastIndex(key, ":")+1:]] = entry.Flags
+	}
+	want := map[string]map[string]interface{}{
+		"a": {"a": "a"},
+		"b": {"b": "b"},
+	}
+	if !reflect.DeepEqual(flags, want) {
+		t.Errorf("flags of done stacks = %v, want %v", flags, want)
+	}
+}
+
+func TestCheckpointInvalidated(t *testing.T) {
+	files := map[string]string{
+		"stack.yaml": "api: v1\nflags:\n  mode: x\n  other: x\nstacks: [a, b]\n",
+		"a/stack.yaml": "api: v1\nrun:\n" + logScript("a") + `- script: echo {{ stack.flags.mode }}
+`,
+		"b/stack.yaml": "api: v1\nrun:\n- script: test -f $STACK_ROOT/ok\n",
+	}
+	for name, test := range map[string]struct {
+		file, content string
+		rerun         bool
+	}{
+		"unchanged":     {},
+		"stack file":    {"a/stack.yaml", files["a/stack.yaml"] + logScript("a2"), true},
+		"read flag":     {"stack.yaml", strings.Replace(files["stack.yaml"], "mode: x", "mode: y", 1), true},
+		"not read flag": {"stack.yaml", strings.Replace(files["stack.yaml"], "other: x", "other: y", 1), false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := writeFiles(t, files)
+			runStack(t, dir, false)
+			if test.file != "" {
+				if err := ioutil.WriteFile(filepath.Join(dir, test.file), []byte(test.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "ok"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if result := runStack(t, dir, true); result.Err != nil {
+				t.Fatal(result.Err)
+			}
+			rerun := len(readLog(t, dir)) > 1
+			if rerun != test.rerun {
+				t.Errorf("a is run again %v, want %v", rerun, test.rerun)
+			}
+		})
+	}
+}
+
+func runStack(t *testing.T, dir string, resume bool) *Result {
+	t.Helper()
+	logger := zerolog.Nop()
+	runner, err := NewRunner(Options{
+		Config: app.Config{Workdir: dir, Resume: resume},
+		Stdout: ioutil.Discard,
+		Stderr: ioutil.Discard,
+		Logger: &logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runner.Run(context.Background())
+}
+
+func readLog(t *testing.T, dir string) []string {
+	t.Helper()
+	log, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(log))
+}
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "stack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
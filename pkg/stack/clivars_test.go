@@ -0,0 +1,172 @@
+package stack
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/types"
+	"github.com/rs/zerolog"
+)
+
+func TestCLIVars(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"stack.yaml": "api: v1\nvars:\n  name: root\n",
+		"cert.pem":   "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+	})
+	tests := []struct {
+		name   string
+		config app.Config
+		stdin  string
+		want   map[string]interface{}
+		source string
+	}{
+		{
+			name:   "set",
+			config: app.Config{CLIValues: []string{"enabled=true", "count=1", "image.tag=1.2"}},
+			want: map[string]interface{}{
+				"name":      "root",
+				"enabled":   true,
+				"count":     int64(1),
+				"image.tag": "1.2",
+			},
+			source: "--set",
+		},
+		{
+			name:   "set-string",
+			config: app.Config{CLIStringValues: []string{"enabled=true", "count=1", "image.tag=1.2"}},
+			want: map[string]interface{}{
+				"name":      "root",
+				"enabled":   "true",
+				"count":     "1",
+				"image.tag": "1.2",
+			},
+			source: "--set-string",
+		},
+		{
+			name:   "set-file",
+			config: app.Config{CLIFileValues: []string{"tls.cert=cert.pem"}},
+			want: map[string]interface{}{
+				"name":     "root",
+				"tls.cert": "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+			},
+			source: "--set-file",
+		},
+		{
+			name:   "set-json",
+			config: app.Config{CLIJSONValues: []string{`app.ports=[80,443]`, `app.labels={"tier":"web","a=b":"c"}`}},
+			want: map[string]interface{}{
+				"name":            "root",
+				"app.ports[0]":    float64(80),
+				"app.ports[1]":    float64(443),
+				"app.labels.tier": "web",
+				"app.labels.a=b":  "c",
+			},
+			source: "--set-json",
+		},
+		{
+			name: "merge order",
+			config: app.Config{
+				CLIValues:       []string{"a=set", "b=set", "c=set", "d=set"},
+				CLIStringValues: []string{"b=string", "c=string", "d=string"},
+				CLIFileValues:   []string{"c=cert.pem"},
+				CLIJSONValues:   []string{`d="json"`},
+			},
+			want: map[string]interface{}{
+				"name": "root",
+				"a":    "set",
+				"b":    "string",
+				"c":    "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+				"d":    "json",
+			},
+			source: "--set, --set-string, --set-file, --set-json",
+		},
+		{
+			name:   "stdin",
+			config: app.Config{VarFiles: []string{"-"}},
+			stdin:  "name: stdin\nreplicas: 2\n",
+			want: map[string]interface{}{
+				"name":     "stdin",
+				"replicas": float64(2),
+			},
+			source: "-f -",
+		},
+		{
+			name:   "set overrides stdin",
+			config: app.Config{VarFiles: []string{"-"}, CLIValues: []string{"name=set"}},
+			stdin:  "name: stdin\n",
+			want:   map[string]interface{}{"name": "set"},
+			source: "--set",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := test.config
+			config.Workdir = dir
+			explained, err := explainCLIVars(t, config, test.stdin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vars := make(map[string]interface{})
+			for _, v := range explained[0].Vars {
+				vars[v.Key] = v.Value
+				// name is set by stack.yaml unless the test overrides it
+				if v.Origin.Source == "vars in stack.yaml" {
+					continue
+				}
+				if v.Origin.Source != test.source {
+					t.Errorf("origin of %s = %q, want %q", v.Key, v.Origin.Source, test.source)
+				}
+			}
+			if !reflect.DeepEqual(vars, test.want) {
+				t.Errorf("vars = %#v, want %#v", vars, test.want)
+			}
+		})
+	}
+}
+
+func TestCLIVarsErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"stack.yaml": "api: v1\n"})
+	tests := []struct {
+		name   string
+		config app.Config
+		stdin  string
+		want   string
+	}{
+		{"set-json", app.Config{CLIJSONValues: []string{"a={"}}, "", "--set-json a={"},
+		{"set-json without value", app.Config{CLIJSONValues: []string{"a"}}, "", "key=json is expected"},
+		{"set-file", app.Config{CLIFileValues: []string{"a=missing.pem"}}, "", "--set-file a=missing.pem"},
+		{"stdin", app.Config{VarFiles: []string{"-"}}, "a: [", "<stdin>"},
+		{"stdin twice", app.Config{VarFiles: []string{"-", "-"}}, "a: 1\n", "-f - is given more than once"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := test.config
+			config.Workdir = dir
+			_, err := explainCLIVars(t, config, test.stdin)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+// explainCLIVars explains vars of the root stack, stdin is read by -f -
+func explainCLIVars(t *testing.T, config app.Config, stdin string) ([]*types.ExplainedStackVars, error) {
+	t.Helper()
+	logger := zerolog.Nop()
+	runner, err := NewRunner(Options{
+		Config: config,
+		Stdout: ioutil.Discard,
+		Stderr: ioutil.Discard,
+		Stdin:  strings.NewReader(stdin),
+		Logger: &logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return runner.ExplainVars(context.Background(), ".")
+}
@@ -0,0 +1,151 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/types"
+	"github.com/rs/zerolog"
+)
+
+var explainFiles = map[string]string{
+	"stack.yaml": `api: v1
+vars:
+  image: nginx
+  tag: "1.0"
+  list+: [a]
+varsFrom:
+- file: vars.yaml
+stacks: [app]
+`,
+	"vars.yaml":   "region: eu\n",
+	"values.yaml": "tag: \"1.1\"\nrelease: stable\n",
+	"app/stack.yaml": `api: v1
+vars:
+  replicas: 2
+  list: [b]
+run:
+- script: touch $STACK_ROOT/executed && printf generated
+  output:
+  - str2var: vars.generated
+`,
+}
+
+func TestExplainVars(t *testing.T) {
+	dir := writeFiles(t, explainFiles)
+	config := app.Config{
+		Workdir:   dir,
+		VarFiles:  []string{"values.yaml"},
+		CLIValues: []string{"tag=1.2"},
+	}
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{".", []string{
+			"image=nginx from vars in stack.yaml (.)",
+			"list[0]=a + from vars in stack.yaml (.)",
+			"region=eu from varsFrom vars.yaml (.)",
+			"release=stable from -f values.yaml (.)",
+			"tag=1.2 from --set (.)",
+		}},
+		{"app", []string{
+			"image=nginx from vars in stack.yaml (.)",
+			"list[0]=b + from vars in app/stack.yaml (app)",
+			"list[1]=a + from vars in stack.yaml (.)",
+			"region=eu from varsFrom vars.yaml (.)",
+			"release=stable from -f values.yaml (.)",
+			"replicas=2 from vars in app/stack.yaml (app)",
+			"tag=1.2 from --set (.)",
+		}},
+	}
+	for _, test := range tests {
+		explained, err := explainVars(t, config, test.path)
+		if err != nil {
+			t.Fatalf("ExplainVars(%q) error = %v", test.path, err)
+		}
+		if len(explained) != 1 {
+			t.Fatalf("ExplainVars(%q) returned %d stacks, want 1", test.path, len(explained))
+		}
+		if explained[0].Path != test.path {
+			t.Errorf("path = %q, want %q", explained[0].Path, test.path)
+		}
+		if vars := formatExplainedVars(explained[0].Vars); !reflect.DeepEqual(vars, test.want) {
+			t.Errorf("vars of %s = %q, want %q", test.path, vars, test.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "executed")); err == nil {
+		t.Error("run items were executed")
+	}
+}
+
+func TestExplainVarsNotFound(t *testing.T) {
+	dir := writeFiles(t, explainFiles)
+	if _, err := explainVars(t, app.Config{Workdir: dir}, "missing"); err == nil {
+		t.Error("ExplainVars(missing) error = nil, want stack not found")
+	}
+}
+
+func TestExplainVarsRun(t *testing.T) {
+	dir := writeFiles(t, explainFiles)
+	logger := zerolog.Nop()
+	runner, err := NewRunner(Options{
+		Config: app.Config{Workdir: dir, ExplainVars: "app"},
+		Stdout: ioutil.Discard,
+		Stderr: ioutil.Discard,
+		Logger: &logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := runner.Run(context.Background())
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if len(result.ExplainedVars) != 1 {
+		t.Fatalf("explained %d stacks, want 1", len(result.ExplainedVars))
+	}
+	want := "generated=generated from str2var vars.generated (app)"
+	for _, v := range formatExplainedVars(result.ExplainedVars[0].Vars) {
+		if v == want {
+			return
+		}
+	}
+	t.Errorf("vars of app = %q, want %q", formatExplainedVars(result.ExplainedVars[0].Vars), want)
+}
+
+func explainVars(t *testing.T, config app.Config, stackPath string) ([]*types.ExplainedStackVars, error) {
+	t.Helper()
+	logger := zerolog.Nop()
+	runner, err := NewRunner(Options{
+		Config: config,
+		Stdout: ioutil.Discard,
+		Stderr: ioutil.Discard,
+		Logger: &logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runner.ExplainVars(context.Background(), stackPath)
+}
+
+// formatExplainedVars formats vars as "key=value modifier from source (stack)"
+func formatExplainedVars(explained []*types.ExplainedVar) (output []string) {
+	for _, v := range explained {
+		str := fmt.Sprintf("%s=%v", v.Key, v.Value)
+		if v.Modifier != "" {
+			str += " " + v.Modifier
+		}
+		if v.Origin != nil {
+			str += fmt.Sprintf(" from %s (%s)", v.Origin.Source, v.Origin.Stack)
+		}
+		output = append(output, str)
+	}
+	return
+}
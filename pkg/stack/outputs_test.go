@@ -0,0 +1,56 @@
+package stack
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOutputs(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"stack.yaml": `api: v1
+pstacks: [db, app, deploy]
+stacks:
+- name: migrate
+  run: []
+  outputs:
+    done: "true"
+`,
+		"db/stack.yaml": `api: v1
+run:
+- script: "echo 'host: db.local'"
+  output:
+  - yml2var: vars.db
+outputs:
+  host: vars.db.host
+  url: '"postgres://" + vars.db.host + ":5432"'
+`,
+		"app/stack.yaml": `api: v1
+wait: '"db" in outputs'
+run:
+- gomplate: '{{ index .outputs "db" "url" }}'
+  output:
+  - str2var: vars.url
+outputs:
+  url: vars.url
+`,
+		"deploy/stack.yaml": `api: v1
+matrix: [eu, us]
+outputs:
+  region: input
+`,
+	})
+	result := runStack(t, dir, false)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	want := map[string]map[string]interface{}{
+		"db":        {"host": "db.local", "url": "postgres://db.local:5432"},
+		"app":       {"url": "postgres://db.local:5432"},
+		"deploy-eu": {"region": "eu"},
+		"deploy-us": {"region": "us"},
+		"migrate":   {"done": true},
+	}
+	if !reflect.DeepEqual(result.Outputs, want) {
+		t.Errorf("outputs = %v, want %v", result.Outputs, want)
+	}
+}
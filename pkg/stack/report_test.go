@@ -0,0 +1,94 @@
+package stack
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/report"
+	"github.com/rs/zerolog"
+)
+
+func TestReports(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"stack.yaml":   "api: v1\nstacks: [a, b, c]\n",
+		"a/stack.yaml": "api: v1\nwhen: \"false\"\nrun:\n- script: echo a\n",
+		"b/stack.yaml": "api: v1\nrun:\n- script: echo b\n- script: echo skipped\n  when: \"false\"\n",
+		"c/stack.yaml": "api: v1\nrun:\n- script: exit 3\n",
+	})
+	reportJSON, reportJUnit := filepath.Join(dir, "report.json"), filepath.Join(dir, "report.xml")
+	logger := zerolog.Nop()
+	runner, err := NewRunner(Options{
+		Config: app.Config{Workdir: dir, ReportJSON: reportJSON, ReportJUnit: reportJUnit},
+		Stdout: ioutil.Discard,
+		Stderr: ioutil.Discard,
+		Logger: &logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := runner.Run(context.Background()); result.ExitCode != consts.ExitCodeScriptFailed {
+		t.Fatalf("exit code = %d, want %d", result.ExitCode, consts.ExitCodeScriptFailed)
+	}
+
+	content, err := ioutil.ReadFile(reportJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runReport report.Report
+	if err = json.Unmarshal(content, &runReport); err != nil {
+		t.Fatal(err)
+	}
+	if runReport.Status != report.StatusFailed || runReport.ExitCode != consts.ExitCodeScriptFailed {
+		t.Errorf("report status = %s %d, want %s %d", runReport.Status, runReport.ExitCode, report.StatusFailed, consts.ExitCodeScriptFailed)
+	}
+	statuses := make(map[string][]string)
+	for _, stack := range runReport.Stacks {
+		if stack.End.Before(stack.Start) || stack.Duration < 0 {
+			t.Errorf("stack %s: start %s, end %s, duration %f", stack.Path, stack.Start, stack.End, stack.Duration)
+		}
+		statuses[stack.Path] = []string{stack.Status}
+		for _, runItem := range stack.RunItems {
+			statuses[stack.Path] = append(statuses[stack.Path], runItem.Status)
+		}
+		if stack.Path == "c" && stack.Error == "" {
+			t.Error("stack c has no error in the report")
+		}
+	}
+	wantStatuses := map[string][]string{
+		".": {report.StatusFailed},
+		"a": {report.StatusSkipped},
+		"b": {report.StatusDone, report.StatusDone, report.StatusSkipped},
+		"c": {report.StatusFailed, report.StatusFailed},
+	}
+	if !reflect.DeepEqual(statuses, wantStatuses) {
+		t.Errorf("statuses = %v, want %v", statuses, wantStatuses)
+	}
+
+	content, err = ioutil.ReadFile(reportJUnit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var suites struct {
+		Tests    int `xml:"tests,attr"`
+		Failures int `xml:"failures,attr"`
+		Skipped  int `xml:"skipped,attr"`
+		Suites   []struct {
+			Name  string `xml:"name,attr"`
+			Tests int    `xml:"tests,attr"`
+		} `xml:"testsuite"`
+	}
+	if err = xml.Unmarshal(content, &suites); err != nil {
+		t.Fatal(err)
+	}
+	if suites.Tests != 7 || suites.Failures != 3 || suites.Skipped != 2 || len(suites.Suites) != 4 {
+		t.Errorf("junit report: %d tests, %d failures, %d skipped in %d suites, want 7, 3, 2 in 4",
+			suites.Tests, suites.Failures, suites.Skipped, len(suites.Suites))
+	}
+}
@@ -0,0 +1,74 @@
+package stack
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/kruglovmax/stack/pkg/app"
+)
+
+func TestRunnersConcurrently(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"first", "second"}
+	dirs := make([]string, len(names))
+	for i, name := range names {
+		if dirs[i], err = ioutil.TempDir("", "stack"); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dirs[i])
+		stackYAML := `api: v1
+run:
+- script: sleep 0.2; echo ` + name + ` > name.txt
+- gomplate: '{{ file.Write "copy.txt" (file.Read "name.txt") }}{{ file.Read "name.txt" | strings.TrimSpace }}'
+  output:
+  - str2var: flags.name
+`
+		if err = ioutil.WriteFile(filepath.Join(dirs[i], "stack.yaml"), []byte(stackYAML), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results := make([]*Result, len(names))
+	var wg sync.WaitGroup
+	for i := range names {
+		runner, err := NewRunner(Options{
+			Config: app.Config{Workdir: dirs[i]},
+			Stdout: ioutil.Discard,
+			Stderr: ioutil.Discard,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = runner.Run(context.Background())
+		}(i)
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		if results[i].Err != nil {
+			t.Errorf("%s: %v", name, results[i].Err)
+			continue
+		}
+		if flag := results[i].Flags["name"]; flag != name {
+			t.Errorf("%s: flags.name = %v, want %q", name, flag, name)
+		}
+		for _, file := range []string{"name.txt", "copy.txt"} {
+			if content, err := ioutil.ReadFile(filepath.Join(dirs[i], file)); err != nil || string(content) != name+"\n" {
+				t.Errorf("%s: %s = %q, %v, want %q", name, file, content, err, name+"\n")
+			}
+		}
+	}
+	if dir, _ := os.Getwd(); dir != cwd {
+		t.Errorf("working dir changed to %s, want %s", dir, cwd)
+	}
+}
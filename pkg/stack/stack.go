@@ -1,62 +1,345 @@
 package stack
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"runtime/debug"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/cache"
+	"github.com/kruglovmax/stack/pkg/checkpoint"
 	"github.com/kruglovmax/stack/pkg/consts"
 	"github.com/kruglovmax/stack/pkg/log"
 	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/report"
+	"github.com/kruglovmax/stack/pkg/selector"
+	"github.com/kruglovmax/stack/pkg/stack/v1/run"
 	v1 "github.com/kruglovmax/stack/pkg/stack/v1/stack"
 	"github.com/kruglovmax/stack/pkg/types"
+	"github.com/kruglovmax/stack/pkg/watch"
+	"github.com/kruglovmax/stack/pkg/yamlpos"
+	"github.com/rs/zerolog"
 )
 
-// RootStack instance
-var rootStack types.Stack
+// Options of Runner. Zero values of Config get defaults of the stack CLI
+type Options struct {
+	app.Config
 
-// GetRootStack func
-func GetRootStack() types.Stack {
-	return rootStack
+	// Stdout and Stderr receive output of run items. Default os.Stdout and os.Stderr
+	Stdout io.Writer
+	Stderr io.Writer
+	// Stdin is read once for vars of -f -. Default os.Stdin
+	Stdin io.Reader
+
+	// Logger of the run. Default a copy of log.Logger
+	Logger *zerolog.Logger
+}
+
+// Result of Runner.Run
+type Result struct {
+	ExitCode    int
+	Err         error
+	Interrupted bool
+	Report      *report.Report
+	Flags       map[string]interface{}
+	Outputs     map[string]map[string]interface{}
+	// ExplainedVars holds vars of the stacks with path Options.ExplainVars
+	// as they were when the stacks finished
+	ExplainedVars []*types.ExplainedStackVars
+}
+
+// Runner runs a stack tree. Runners do not share state
+// and may run in one process at the same time
+type Runner struct {
+	options   Options
+	selector  *selector.Selector
+	files     *watch.Files
+	stdinVars []byte
+}
+
+// NewRunner func
+func NewRunner(options Options) (runner *Runner, err error) {
+	runner = new(Runner)
+	config := &options.Config
+	if config.Workdir == "" {
+		config.Workdir = "."
+	}
+	if config.GitLibsPath == "" {
+		config.GitLibsPath = consts.GitLibsPath
+	}
+	if config.DefaultTimeout == 0 {
+		config.DefaultTimeout = consts.DefaultTimeout
+	}
+	if config.KillGrace == 0 {
+		config.KillGrace = consts.DefaultKillGrace
+	}
+	if config.WatchInterval == 0 {
+		config.WatchInterval = consts.DefaultWatchInterval
+	}
+	for _, path := range []*string{&config.Workdir, &config.ReportJSON, &config.ReportJUnit} {
+		if *path != "" {
+			if *path, err = filepath.Abs(*path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if options.Stdout == nil {
+		options.Stdout = os.Stdout
+	}
+	if options.Stderr == nil {
+		options.Stderr = os.Stderr
+	}
+	if options.Stdin == nil {
+		options.Stdin = os.Stdin
+	}
+	stdinFiles := 0
+	for _, varsFile := range config.VarFiles {
+		if varsFile == "-" {
+			stdinFiles++
+		}
+	}
+	switch {
+	case stdinFiles > 1:
+		return nil, fmt.Errorf("-f - is given more than once")
+	case stdinFiles == 1:
+		// watch cycles load the root stack again, stdin is read only once
+		if runner.stdinVars, err = ioutil.ReadAll(options.Stdin); err != nil {
+			return nil, err
+		}
+	}
+	if options.Logger == nil {
+		logger := log.Logger
+		options.Logger = &logger
+	}
+	if runner.selector, err = selector.New(config.Only, config.Skip); err != nil {
+		return nil, err
+	}
+	runner.options = options
+	return
+}
+
+// Workdir returns the absolute path of the root stack directory
+func (runner *Runner) Workdir() string {
+	return runner.options.Workdir
+}
+
+// Run executes the stack tree. The run is interrupted when ctx is done
+func (runner *Runner) Run(ctx context.Context) *Result {
+	return runner.run(ctx, runner.selector)
+}
+
+func (runner *Runner) run(ctx context.Context, selector *selector.Selector) (result *Result) {
+	state := runner.newState(ctx)
+	state.Selector = selector
+	defer state.Close()
+	result = new(Result)
+
+	err := runner.initState(state)
+	if err == nil {
+		var rootStack types.Stack
+		if rootStack, err = loadRootStack(state); err == nil {
+			err = rootStack.Start(nil)
+		}
+	}
+	printFailureReport(state, err)
+
+	result.Err = err
+	result.ExitCode = types.ExitCode(err)
+	result.Interrupted = state.Interrupted()
+	if result.Interrupted {
+		result.ExitCode = consts.ExitCodeSIGTERM
+	}
+	runner.writeReports(state, result.ExitCode)
+	if result.ExitCode == consts.ExitCodeOK {
+		if err := state.Checkpoint.Remove(); err != nil {
+			state.Logger.Warn().Msg(err.Error())
+		}
+	}
+
+	result.Report = state.Report
+	state.Flags.Mux.Lock()
+	result.Flags = state.Flags.Vars
+	state.Flags.Mux.Unlock()
+	state.StacksOutputs.Mux.Lock()
+	result.Outputs = state.StacksOutputs.StacksOutputs
+	state.StacksOutputs.Mux.Unlock()
+	state.ExplainedVars.Mux.Lock()
+	result.ExplainedVars = state.ExplainedVars.Stacks
+	state.ExplainedVars.Mux.Unlock()
+	return
+}
+
+// Plan loads the stack tree without executing anything
+func (runner *Runner) Plan(ctx context.Context) (*types.StackPlan, error) {
+	state := runner.newState(ctx)
+	defer state.Close()
+	state.NoExec = true
+
+	rootStack, err := loadRootStack(state)
+	if err != nil {
+		printFailureReport(state, err)
+		return nil, err
+	}
+	plan, err := rootStack.Plan()
+	err = types.WrapError(nil, nil, consts.ExitCodeBadStack, err)
+	printFailureReport(state, err)
+	return plan, err
+}
+
+// Validate loads the whole stack tree without executing anything and
+// returns all problems found in it
+func (runner *Runner) Validate(ctx context.Context) error {
+	state := runner.newState(ctx)
+	defer state.Close()
+	state.NoExec = true
+
+	rootStack, err := loadRootStack(state)
+	if err == nil {
+		err = rootStack.Validate()
+	}
+	printFailureReport(state, err)
+	return err
+}
+
+// ExplainVars loads the stack tree without executing anything and returns
+// resolved vars of the stacks with the given path and their origins
+func (runner *Runner) ExplainVars(ctx context.Context, stackPath string) ([]*types.ExplainedStackVars, error) {
+	state := runner.newState(ctx)
+	defer state.Close()
+	state.NoExec = true
+	state.Config.ExplainVars = stackPath
+
+	var output []*types.ExplainedStackVars
+	rootStack, err := loadRootStack(state)
+	if err == nil {
+		var stacks []types.Stack
+		stacks, err = rootStack.(*v1.Stack).FindStacks(stackPath)
+		if err == nil && len(stacks) == 0 {
+			err = fmt.Errorf("Stack %s not found", stackPath)
+		}
+		for _, stack := range stacks {
+			output = append(output, stack.ExplainVars())
+		}
+		err = types.WrapError(nil, nil, consts.ExitCodeBadStack, err)
+	}
+	printFailureReport(state, err)
+	return output, err
+}
+
+// PruneCache removes cache entries not used for olderThan. Zero olderThan removes everything
+func (runner *Runner) PruneCache(olderThan time.Duration) (removed int, dir string, err error) {
+	dir = filepath.Join(runner.options.Workdir, consts.StateDir, consts.CacheDir)
+	removed, err = cache.Prune(dir, olderThan)
+	return
+}
+
+func (runner *Runner) newState(ctx context.Context) *app.State {
+	config := runner.options.Config
+	state := app.New(ctx, &config, runner.options.Stdout, runner.options.Stderr, *runner.options.Logger)
+	state.Selector = runner.selector
+	state.Watch = runner.files
+	state.StdinVars = runner.stdinVars
+	return state
+}
+
+// initState opens cache and checkpoint of the run
+func (runner *Runner) initState(state *app.State) (err error) {
+	stateDir := filepath.Join(state.Config.Workdir, consts.StateDir)
+	if !state.Config.NoCache {
+		state.Cache = cache.New(filepath.Join(stateDir, consts.CacheDir))
+	}
+	state.Checkpoint, err = checkpoint.Load(filepath.Join(stateDir, consts.StateFileName), state.Config.Resume)
+	return
+}
+
+func (runner *Runner) writeReports(state *app.State, exitCode int) {
+	state.Report.Finish(state.StacksStatus, exitCode)
+	if state.Config.ReportJSON != "" {
+		if err := state.Report.WriteJSON(state.Config.ReportJSON); err != nil {
+			state.Logger.Error().Str("file", state.Config.ReportJSON).Msg(err.Error())
+		}
+	}
+	if state.Config.ReportJUnit != "" {
+		if err := state.Report.WriteJUnit(state.Config.ReportJUnit); err != nil {
+			state.Logger.Error().Str("file", state.Config.ReportJUnit).Msg(err.Error())
+		}
+	}
 }
 
-// RunRootStack func
-func RunRootStack(workdir string) {
+// printFailureReport logs every failure with its stack, run item and parents
+func printFailureReport(state *app.State, err error) {
+	var errs types.StackErrors
+	errs = errs.Append(err)
+	if len(errs) == 0 {
+		return
+	}
+	state.Logger.Error().
+		Int("failures", len(errs)).
+		Msg(consts.MessageFailureReport)
+	for _, stackError := range errs {
+		event := state.Logger.Error().
+			Int("code", stackError.Code)
+		if stackError.Stack != nil {
+			event = event.
+				Str("stack", misc.GetStackPathRelativeToTheRootStack(stackError.Stack)).
+				Strs("parents", misc.GetStackTrace(stackError.Stack.GetParent()))
+		}
+		if stackError.RunItem != nil {
+			event = event.Str("runItem", describeRunItem(stackError.RunItem.Plan()))
+		}
+		event.Msg(stackError.Error())
+	}
+}
+
+func describeRunItem(plan *types.RunItemPlan) string {
+	value := run.Describe(plan)
+	if value == "" {
+		return plan.Type
+	}
+	return fmt.Sprintf("%s: %s", plan.Type, value)
+}
+
+func loadRootStack(state *app.State) (rootStack types.Stack, err error) {
 	var preConfig interface{}
 
-	stackFile := misc.FindStackFileInDir(workdir)
+	defer func() {
+		err = types.WrapError(nil, nil, consts.ExitCodeBadStack, err)
+	}()
+
+	stackFile, err := misc.FindStackFileInDir(state.Config.Workdir)
+	if err != nil {
+		return
+	}
+	state.Watch.Add(".", stackFile)
 
-	content, ioErr := ioutil.ReadFile(stackFile)
-	if ioErr != nil {
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Str("file", stackFile).
-			Msg(ioErr.Error())
+	content, err := ioutil.ReadFile(stackFile)
+	if err != nil {
+		return
 	}
 
-	misc.LoadYAML(string(content), &preConfig)
+	if err = misc.LoadYAML(string(content), &preConfig); err != nil {
+		return nil, yamlpos.Wrap(stackFile, content, err)
+	}
 
 	switch preConfig.(type) {
 	case map[string]interface{}:
 		switch preConfig.(map[string]interface{})["api"] {
 		case "v1":
-			rootStack = new(v1.Stack)
-			rootStack.LoadFromFile(stackFile, nil)
-			rootStack.Start(nil)
+			rootStack = v1.New(state)
+			return rootStack, rootStack.LoadFromFile(stackFile, nil)
 		default:
-			log.Logger.Debug().
-				Msg(string(debug.Stack()))
-			log.Logger.Fatal().
+			state.Logger.Debug().
 				Str("file", stackFile).
 				Str("api", spew.Sdump(preConfig.(map[string]interface{})["api"])).
 				Msg(consts.MessageBadStackUnsupportedAPI)
+			return nil, fmt.Errorf("%s: %s", stackFile, consts.MessageBadStackUnsupportedAPI)
 		}
 	default:
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Str("file", stackFile).
-			Msg(consts.MessageBadStack)
+		return nil, fmt.Errorf("%s: %s", stackFile, consts.MessageBadStack)
 	}
 }
@@ -3,15 +3,11 @@ package libs
 import (
 	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
-	"runtime/debug"
-	"sync"
 
 	"github.com/flytam/filenamify"
 	"github.com/kruglovmax/stack/pkg/app"
 	"github.com/kruglovmax/stack/pkg/consts"
-	"github.com/kruglovmax/stack/pkg/log"
 	"github.com/kruglovmax/stack/pkg/misc"
 )
 
@@ -21,25 +17,28 @@ var (
 )
 
 // ParseAndInitLibs func
-func ParseAndInitLibs(input []interface{}, workdir string) (output []string) {
+func ParseAndInitLibs(state *app.State, input []interface{}, workdir string) (output []string, err error) {
 	output = make([]string, 0, len(input)+1)
 	output = append(output, workdir)
 	for _, item := range input {
-		libPath, err := parseLibsItem(item, workdir)
-		misc.CheckIfErr(err)
+		var libPath string
+		libPath, err = parseLibsItem(state, item, workdir)
+		if err != nil {
+			return
+		}
 		output = append(output, libPath)
 	}
-	output = append(output, *app.App.Config.Workdir)
+	output = append(output, state.Config.Workdir)
 	output = misc.UniqueStr(output)
 	return
 }
 
-func parseLibsItem(input interface{}, workdir string) (libPath string, err error) {
-	log.Logger.Debug().
+func parseLibsItem(state *app.State, input interface{}, workdir string) (libPath string, err error) {
+	state.Logger.Debug().
 		Msgf(consts.MessageLibsParseAndInit, input)
 	switch input.(type) {
 	case string:
-		libPath, err = misc.FindPath(input.(string), workdir, *app.App.Config.Workdir)
+		libPath, err = misc.FindPath(input.(string), workdir, state.Config.Workdir)
 		return
 	case map[string]interface{}:
 		libItem := input.(map[string]interface{})
@@ -48,12 +47,8 @@ func parseLibsItem(input interface{}, workdir string) (libPath string, err error
 			var output string
 			output, err = filenamify.Filenamify(libItem["git"].(string), filenamify.Options{Replacement: "_"})
 			if err != nil {
-				log.Logger.Fatal().
-					Msg(err.Error() + "\n" + string(debug.Stack()))
+				return
 			}
-			app.App.Mutex.CurrentWorkDirMutex.Lock()
-			defer app.App.Mutex.CurrentWorkDirMutex.Unlock()
-			os.Chdir(*app.App.Config.Workdir)
 			gitURL, _ := libItem["git"].(string)
 			gitRef, ok := libItem["ref"].(string)
 			if !ok {
@@ -64,16 +59,16 @@ func parseLibsItem(input interface{}, workdir string) (libPath string, err error
 				gitPath = "."
 			}
 			var gitClonePath string
-			gitClonePath, err = filepath.Abs(filepath.Join(*app.App.Config.GitLibsPath, output, gitRef))
+			gitClonePath = filepath.Join(state.Config.GitLibsPath, output, gitRef)
+			if !filepath.IsAbs(gitClonePath) {
+				gitClonePath = filepath.Join(state.Config.Workdir, gitClonePath)
+			}
+
+			err = misc.GitClone(state.Context, nil, state.Logger, gitClonePath, gitURL, gitRef, false, false)
 			if err != nil {
 				return
 			}
 
-			var wg sync.WaitGroup
-			wg.Add(1)
-			misc.GitClone(&wg, gitClonePath, gitURL, gitRef, false, false)
-			misc.WaitTimeout(&wg, *app.App.Config.DefaultTimeout)
-
 			libPath = filepath.Clean(filepath.Join(gitClonePath, gitPath))
 			if !misc.PathIsDir(libPath) {
 				err = fmt.Errorf(consts.MessageLibsGitBadPathInRepo, gitPath, gitURL)
@@ -0,0 +1,63 @@
+package run
+
+import (
+	"os"
+
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/cache"
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+// CacheKey returns the cache key of the run item or "" if the item is not cached.
+// The key covers item type, stack workdir, vars passed to the item, env vars
+// listed in cacheEnv and the given values (template or script text)
+func CacheKey(stack types.Stack, rawItem map[string]interface{}, itemType string, vars interface{}, values ...interface{}) string {
+	if enabled, _ := rawItem["cache"].(bool); !enabled || app.FromStack(stack).Cache == nil {
+		return ""
+	}
+	env := make(map[string]string)
+	cacheEnv, _ := rawItem["cacheEnv"].([]interface{})
+	for _, name := range cacheEnv {
+		if name, ok := name.(string); ok {
+			env[name] = os.Getenv(name)
+		}
+	}
+	if view, ok := vars.(map[string]interface{}); ok && rawItem["vars"] == nil {
+		// id and status of the stacks change on every run
+		vars = viewWithoutStatus(view)
+	}
+	return cache.Key(itemType, stack.GetWorkdir(), vars, env, values)
+}
+
+// CacheGet returns cached output of the run item
+func CacheGet(stack types.Stack, key string) (string, bool) {
+	output, ok := app.FromStack(stack).Cache.Get(key)
+	if ok {
+		app.FromStack(stack).Logger.Info().
+			Str("stack", stack.GetWorkdir()).
+			Str("key", key).
+			Msg("Cache hit")
+	}
+	return output, ok
+}
+
+// CachePut stores output of the run item. files are the files read by the item
+func CachePut(stack types.Stack, key, output string, files []string) {
+	if err := app.FromStack(stack).Cache.Put(key, output, files); err != nil {
+		app.FromStack(stack).Logger.Warn().
+			Str("stack", stack.GetWorkdir()).
+			Msg(err.Error())
+	}
+}
+
+func viewWithoutStatus(view map[string]interface{}) map[string]interface{} {
+	output := make(map[string]interface{}, len(view))
+	for k, v := range view {
+		switch k {
+		case "id", "status":
+		default:
+			output[k] = v
+		}
+	}
+	return output
+}
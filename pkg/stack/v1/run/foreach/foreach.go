@@ -0,0 +1,205 @@
+package foreach
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/joeycumines/go-dotnotation/dotnotation"
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/cel"
+	"github.com/kruglovmax/stack/pkg/conditions"
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/stack/v1/run"
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+// foreachItem type
+type foreachItem struct {
+	Foreach     string        `json:"foreach,omitempty"`
+	Parallel    bool          `json:"parallel,omitempty"`
+	MaxParallel int           `json:"maxParallel,omitempty"`
+	When        string        `json:"when,omitempty"`
+	Wait        string        `json:"wait,omitempty"`
+	RunTimeout  time.Duration `json:"runTimeout,omitempty"`
+	WaitTimeout time.Duration `json:"waitTimeout,omitempty"`
+
+	rawItem map[string]interface{}
+	stack   types.Stack
+}
+
+// iteration binds item and index into the view of the stack
+type iteration struct {
+	types.Stack
+	item  interface{}
+	index interface{}
+}
+
+// GetView func
+func (stack *iteration) GetView() interface{} {
+	view := stack.Stack.GetView()
+	if stackMap, ok := view.(map[string]interface{}); ok {
+		stackMap["item"] = stack.item
+		stackMap["index"] = stack.index
+	}
+	return view
+}
+
+// GetIndex func
+func (stack *iteration) GetIndex() interface{} {
+	return stack.index
+}
+
+// New func
+func New(stack types.Stack, rawItem map[string]interface{}) types.RunItem {
+	item := new(foreachItem)
+	item.rawItem = rawItem
+	item.stack = stack
+
+	return item
+}
+
+// Plan func
+func (item *foreachItem) Plan() *types.RunItemPlan {
+	plan := run.NewPlan("foreach", item.rawItem)
+	rawRun, _ := item.rawItem["run"].([]interface{})
+	for _, runItem := range item.stack.GetRunItemsParser().ParseRun(item.stack, rawRun) {
+		plan.Items = append(plan.Items, runItem.Plan())
+	}
+	return plan
+}
+
+// Exec func
+func (item *foreachItem) Exec(parentWG *sync.WaitGroup) (err error) {
+	if parentWG != nil {
+		defer parentWG.Done()
+	}
+	if err = item.parse(); err != nil {
+		return
+	}
+	if !conditions.When(item.stack, item.When) {
+		run.Skip(item.stack, item, item.When)
+		return
+	}
+	if ok, err := conditions.Wait(item.stack, item.Wait, item.WaitTimeout); !ok {
+		return types.WrapError(item.stack, item, consts.ExitCodeWaitTimeout, err)
+	}
+
+	// the foreach is cancelled on its timeout, not the stack
+	scope, cancel := run.WithCancel(item.stack)
+	defer cancel()
+	iterations, err := item.iterations(scope)
+	if err != nil {
+		return
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- item.execIterations(scope, iterations)
+	}()
+
+	if item.RunTimeout == 0 {
+		return <-result
+	}
+	select {
+	case err = <-result:
+		return
+	case <-time.After(item.RunTimeout):
+		cancel()
+		<-result
+		return types.NewStackError(item.stack, item, consts.ExitCodeRunTimeout,
+			fmt.Errorf(consts.MessageRunTimeout, "Foreach", item.RunTimeout))
+	}
+}
+
+// iterations evaluates the collection. Lists are bound with the position
+// as index, maps with the key as index
+func (item *foreachItem) iterations(scope types.Stack) (iterations []*iteration, err error) {
+	stackMap := item.stack.GetView().(map[string]interface{})
+	stackMap["stack"] = stackMap
+	collection, err := cel.ComputeCELNative(item.Foreach, stackMap)
+	if err != nil {
+		var dotErr error
+		if collection, dotErr = dotnotation.Get(stackMap, item.Foreach); dotErr != nil {
+			return nil, fmt.Errorf("foreach %s: %w", item.Foreach, err)
+		}
+		err = nil
+	}
+	switch collection := collection.(type) {
+	case []interface{}:
+		for index, value := range collection {
+			iterations = append(iterations, &iteration{Stack: scope, item: value, index: index})
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(collection))
+		for key := range collection {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			iterations = append(iterations, &iteration{Stack: scope, item: collection[key], index: key})
+		}
+	case nil:
+	default:
+		err = fmt.Errorf("foreach %s: expected a list or a map, got %T", item.Foreach, collection)
+	}
+	return
+}
+
+func (item *foreachItem) execIterations(scope types.Stack, iterations []*iteration) error {
+	rawRun, _ := item.rawItem["run"].([]interface{})
+	var errs types.StackErrors
+	if item.Parallel {
+		var errsMutex sync.Mutex
+		app.FromStack(scope).Jobs.Parallel(scope.GetContext(), len(iterations), item.MaxParallel, func(i int) {
+			err := item.execIteration(iterations[i], rawRun)
+			errsMutex.Lock()
+			errs = errs.Append(err)
+			errsMutex.Unlock()
+		})
+	} else {
+		for _, iteration := range iterations {
+			if err := item.execIteration(iteration, rawRun); err != nil {
+				errs = errs.Append(err)
+				break
+			}
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// execIteration runs the run items of one element in order
+func (item *foreachItem) execIteration(iteration types.Stack, rawRun []interface{}) error {
+	for _, runItem := range iteration.GetRunItemsParser().ParseRun(iteration, rawRun) {
+		if iteration.GetContext().Err() != nil {
+			return nil
+		}
+		if err := runItem.Exec(nil); err != nil {
+			return types.WrapError(item.stack, runItem, consts.ExitCodeScriptFailed, err)
+		}
+	}
+	return nil
+}
+
+func (item *foreachItem) parse() (err error) {
+	item.Foreach, _ = item.rawItem["foreach"].(string)
+	item.Parallel, _ = item.rawItem["parallel"].(bool)
+	item.MaxParallel = 0
+	if maxParallel, ok := item.rawItem["maxParallel"].(float64); ok {
+		item.MaxParallel = int(maxParallel)
+	}
+	item.When, _ = item.rawItem["when"].(string)
+	item.Wait, _ = item.rawItem["wait"].(string)
+	item.RunTimeout = 0
+	if runTimeout, ok := item.rawItem["runTimeout"].(string); ok {
+		item.RunTimeout, err = time.ParseDuration(runTimeout)
+		if err != nil {
+			return
+		}
+	}
+	item.WaitTimeout = app.FromStack(item.stack).Config.DefaultTimeout
+	if waitTimeout, ok := item.rawItem["waitTimeout"].(string); ok {
+		item.WaitTimeout, err = time.ParseDuration(waitTimeout)
+	}
+	return
+}
@@ -1,8 +1,8 @@
 package gitclone
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"path/filepath"
 	"sync"
 	"time"
@@ -11,8 +11,8 @@ import (
 	"github.com/kruglovmax/stack/pkg/app"
 	"github.com/kruglovmax/stack/pkg/conditions"
 	"github.com/kruglovmax/stack/pkg/consts"
-	"github.com/kruglovmax/stack/pkg/log"
 	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/stack/v1/run"
 	"github.com/kruglovmax/stack/pkg/types"
 )
 
@@ -39,38 +39,50 @@ func New(stack types.Stack, rawItem map[string]interface{}) types.RunItem {
 	return item
 }
 
+// Plan func
+func (item *gitcloneItem) Plan() *types.RunItemPlan {
+	return run.NewPlan("gitclone", item.rawItem)
+}
+
 // Exec func
-func (item *gitcloneItem) Exec(parentWG *sync.WaitGroup) {
-	item.parse()
+func (item *gitcloneItem) Exec(parentWG *sync.WaitGroup) (err error) {
 	if parentWG != nil {
 		defer parentWG.Done()
 	}
-	if !conditions.When(item.stack, item.When) {
+	if err = item.parse(); err != nil {
 		return
 	}
-	if !conditions.Wait(item.stack, item.Wait, item.WaitTimeout) {
+	if !conditions.When(item.stack, item.When) {
+		run.Skip(item.stack, item, item.When)
 		return
 	}
-
+	if ok, err := conditions.Wait(item.stack, item.Wait, item.WaitTimeout); !ok {
+		return types.WrapError(item.stack, item, consts.ExitCodeWaitTimeout, err)
+	}
 	gitcloneSubDir, err := filenamify.Filenamify(item.Repo, filenamify.Options{Replacement: "_"})
-	misc.CheckIfErr(err, item.stack)
+	if err != nil {
+		return
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
 	dir := item.Dir
 	if dir == "" {
-		dir = filepath.Join(*app.App.Config.Workdir, consts.GitCloneDir, gitcloneSubDir, item.Ref)
+		dir = filepath.Join(app.FromStack(item.stack).Config.Workdir, consts.GitCloneDir, gitcloneSubDir, item.Ref)
+	}
+	timedOut, err := misc.RunWithTimeout(item.stack.GetContext(), item.RunTimeout, func(ctx context.Context) error {
+		return misc.GitClone(ctx, nil, app.FromStack(item.stack).Logger, dir, item.Repo, item.Ref, true, true)
+	})
+	if timedOut {
+		return types.NewStackError(item.stack, item, consts.ExitCodeRunTimeout,
+			fmt.Errorf(consts.MessageRunTimeout, "Git clone", item.RunTimeout))
 	}
-	go misc.GitClone(&wg, dir, item.Repo, item.Ref, true, true)
-	if misc.WaitTimeout(&wg, item.RunTimeout) {
-		log.Logger.Fatal().
-			Str("stack", item.stack.GetWorkdir()).
-			Str("timeout", fmt.Sprint(item.RunTimeout)).
-			Msg("Git clone waiting failed")
+	if item.stack.GetContext().Err() != nil {
+		// cancelled, the clone is incomplete
+		return nil
 	}
+	return
 }
 
-func (item *gitcloneItem) parse() {
+func (item *gitcloneItem) parse() (err error) {
 	item.Repo = item.rawItem["gitclone"].(string)
 	ref, ok := item.rawItem["ref"].(string)
 	if !ok || ref == "" {
@@ -85,25 +97,28 @@ func (item *gitcloneItem) parse() {
 	if waitCondition != nil {
 		item.Wait = waitCondition.(string)
 	}
-	var err error
 	runTimeout := item.rawItem["runTimeout"]
-	item.RunTimeout = *app.App.Config.DefaultTimeout
+	item.RunTimeout = app.FromStack(item.stack).Config.DefaultTimeout
 	if runTimeout != nil {
 		item.RunTimeout, err = time.ParseDuration(runTimeout.(string))
-		misc.CheckIfErr(err, item.stack)
+		if err != nil {
+			return
+		}
 	}
 	waitTimeout := item.rawItem["waitTimeout"]
-	item.WaitTimeout = *app.App.Config.DefaultTimeout
+	item.WaitTimeout = app.FromStack(item.stack).Config.DefaultTimeout
 	if waitTimeout != nil {
 		item.WaitTimeout, err = time.ParseDuration(waitTimeout.(string))
-		misc.CheckIfErr(err, item.stack)
+		if err != nil {
+			return
+		}
 	}
 
-	if _, ok := item.rawItem["dir"]; ok {
-		app.App.Mutex.CurrentWorkDirMutex.Lock()
-		os.Chdir(item.stack.GetWorkdir())
-		item.Dir, err = filepath.Abs(item.rawItem["dir"].(string))
-		app.App.Mutex.CurrentWorkDirMutex.Unlock()
-		misc.CheckIfErr(err, item.stack)
+	if dir, ok := item.rawItem["dir"].(string); ok {
+		item.Dir = dir
+		if !filepath.IsAbs(dir) {
+			item.Dir = filepath.Join(item.stack.GetWorkdir(), dir)
+		}
 	}
+	return
 }
@@ -0,0 +1,106 @@
+package gomplate
+
+import (
+	"sync"
+	"time"
+
+	gomplateAWS "github.com/hairyhenderson/gomplate/v3/aws"
+	gomplateConv "github.com/hairyhenderson/gomplate/v3/conv"
+)
+
+// awsFuncs is the gomplate aws namespace with the timeout of the run item.
+// gomplate reads AWS_TIMEOUT once per process, so the timeout is passed to the clients here
+type awsFuncs struct {
+	options  gomplateAWS.ClientOptions
+	meta     *gomplateAWS.Ec2Meta
+	info     *gomplateAWS.Ec2Info
+	kms      *gomplateAWS.KMS
+	sts      *gomplateAWS.STS
+	metaInit sync.Once
+	infoInit sync.Once
+	kmsInit  sync.Once
+	stsInit  sync.Once
+}
+
+func newAWSFuncs(timeout time.Duration) *awsFuncs {
+	return &awsFuncs{options: gomplateAWS.ClientOptions{Timeout: timeout}}
+}
+
+func (a *awsFuncs) namespace() interface{} {
+	return a
+}
+
+// funcs replaces the aws namespace and its global aliases in funcMap
+func (a *awsFuncs) funcs(funcMap map[string]interface{}) {
+	funcMap["aws"] = a.namespace
+	funcMap["ec2meta"] = a.EC2Meta
+	funcMap["ec2dynamic"] = a.EC2Dynamic
+	funcMap["ec2tag"] = a.EC2Tag
+	funcMap["ec2tags"] = a.EC2Tags
+	funcMap["ec2region"] = a.EC2Region
+}
+
+func (a *awsFuncs) ec2Meta() *gomplateAWS.Ec2Meta {
+	a.metaInit.Do(func() { a.meta = gomplateAWS.NewEc2Meta(a.options) })
+	return a.meta
+}
+
+func (a *awsFuncs) ec2Info() *gomplateAWS.Ec2Info {
+	a.infoInit.Do(func() { a.info = gomplateAWS.NewEc2Info(a.options) })
+	return a.info
+}
+
+// EC2Region func
+func (a *awsFuncs) EC2Region(def ...string) (string, error) {
+	return a.ec2Meta().Region(def...)
+}
+
+// EC2Meta func
+func (a *awsFuncs) EC2Meta(key string, def ...string) (string, error) {
+	return a.ec2Meta().Meta(key, def...)
+}
+
+// EC2Dynamic func
+func (a *awsFuncs) EC2Dynamic(key string, def ...string) (string, error) {
+	return a.ec2Meta().Dynamic(key, def...)
+}
+
+// EC2Tag func
+func (a *awsFuncs) EC2Tag(tag string, def ...string) (string, error) {
+	return a.ec2Info().Tag(tag, def...)
+}
+
+// EC2Tags func
+func (a *awsFuncs) EC2Tags() (map[string]string, error) {
+	return a.ec2Info().Tags()
+}
+
+// KMSEncrypt func
+func (a *awsFuncs) KMSEncrypt(keyID, plaintext interface{}) (string, error) {
+	a.kmsInit.Do(func() { a.kms = gomplateAWS.NewKMS(a.options) })
+	return a.kms.Encrypt(gomplateConv.ToString(keyID), gomplateConv.ToString(plaintext))
+}
+
+// KMSDecrypt func
+func (a *awsFuncs) KMSDecrypt(ciphertext interface{}) (string, error) {
+	a.kmsInit.Do(func() { a.kms = gomplateAWS.NewKMS(a.options) })
+	return a.kms.Decrypt(gomplateConv.ToString(ciphertext))
+}
+
+// UserID func
+func (a *awsFuncs) UserID() (string, error) {
+	a.stsInit.Do(func() { a.sts = gomplateAWS.NewSTS(a.options) })
+	return a.sts.UserID()
+}
+
+// Account func
+func (a *awsFuncs) Account() (string, error) {
+	a.stsInit.Do(func() { a.sts = gomplateAWS.NewSTS(a.options) })
+	return a.sts.Account()
+}
+
+// ARN func
+func (a *awsFuncs) ARN() (string, error) {
+	a.stsInit.Do(func() { a.sts = gomplateAWS.NewSTS(a.options) })
+	return a.sts.Arn()
+}
@@ -0,0 +1,114 @@
+package gomplate
+
+import (
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	gomplateConv "github.com/hairyhenderson/gomplate/v3/conv"
+	gomplateData "github.com/hairyhenderson/gomplate/v3/data"
+	gomplateFuncs "github.com/hairyhenderson/gomplate/v3/funcs"
+)
+
+// dataFuncs are the gomplate datasource functions resolving relative datasource
+// paths against the stack workdir instead of the process working directory.
+// Files read by datasources are recorded in files for the cache
+type dataFuncs struct {
+	data  *gomplateData.Data
+	files *fileFuncs
+}
+
+func newDataFuncs(files *fileFuncs) *dataFuncs {
+	return &dataFuncs{data: new(gomplateData.Data), files: files}
+}
+
+// funcs replaces the datasource functions of funcMap
+func (d *dataFuncs) funcs(funcMap map[string]interface{}) {
+	funcMap["datasource"] = d.Datasource
+	funcMap["ds"] = d.Datasource
+	funcMap["datasourceExists"] = d.data.DatasourceExists
+	funcMap["datasourceReachable"] = d.DatasourceReachable
+	funcMap["defineDatasource"] = d.DefineDatasource
+	funcMap["include"] = d.Include
+}
+
+// DefineDatasource func
+func (d *dataFuncs) DefineDatasource(alias, value string) (string, error) {
+	return d.data.DefineDatasource(alias, d.sourceURL(value))
+}
+
+// Datasource func
+func (d *dataFuncs) Datasource(alias string, args ...string) (interface{}, error) {
+	if err := d.read(alias, args); err != nil {
+		return nil, err
+	}
+	return d.data.Datasource(alias, args...)
+}
+
+// DatasourceReachable func
+func (d *dataFuncs) DatasourceReachable(alias string, args ...string) bool {
+	return d.read(alias, args) == nil && d.data.DatasourceReachable(alias, args...)
+}
+
+// Include func
+func (d *dataFuncs) Include(alias string, args ...string) (string, error) {
+	if err := d.read(alias, args); err != nil {
+		return "", err
+	}
+	return d.data.Include(alias, args...)
+}
+
+// sourceURL makes relative file paths absolute. URLs with a scheme and stdin are kept
+func (d *dataFuncs) sourceURL(value string) string {
+	if value == "-" {
+		return value
+	}
+	sourceURL, err := url.Parse(filepath.ToSlash(value))
+	if err != nil || sourceURL.IsAbs() || path.IsAbs(sourceURL.Path) {
+		return value
+	}
+	return filepath.Join(d.files.workdir, value)
+}
+
+// read fails after the context of the render is done and records the file of a file datasource
+func (d *dataFuncs) read(alias string, args []string) error {
+	if err := d.files.ctx.Err(); err != nil {
+		return err
+	}
+	source, ok := d.data.Sources[alias]
+	if !ok || source.URL.Scheme != "file" {
+		return nil
+	}
+	fileName := source.URL.Path
+	if len(args) > 0 && strings.HasSuffix(fileName, "/") {
+		// a file of the directory datasource
+		fileName = path.Join(fileName, strings.SplitN(args[0], "?", 2)[0])
+	}
+	d.files.record(filepath.FromSlash(fileName))
+	return nil
+}
+
+// filePathFuncs is the gomplate filepath namespace with Abs resolving
+// relative paths against the stack workdir
+type filePathFuncs struct {
+	*gomplateFuncs.FilePathFuncs
+	workdir string
+}
+
+func newFilePathFuncs(workdir string) *filePathFuncs {
+	return &filePathFuncs{FilePathFuncs: gomplateFuncs.FilePathNS(), workdir: workdir}
+}
+
+func (f *filePathFuncs) namespace() interface{} {
+	return f
+}
+
+// Abs func
+func (f *filePathFuncs) Abs(in interface{}) (string, error) {
+	p := gomplateConv.ToString(in)
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p), nil
+	}
+	return filepath.Join(f.workdir, p), nil
+}
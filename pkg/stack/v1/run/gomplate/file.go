@@ -0,0 +1,129 @@
+package gomplate
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	gomplateConv "github.com/hairyhenderson/gomplate/v3/conv"
+	gomplateFuncs "github.com/hairyhenderson/gomplate/v3/funcs"
+)
+
+// fileFuncs is the gomplate file namespace resolving relative paths
+// against the stack workdir instead of the process working directory.
+// It also records read files for the cache. Reads and writes fail after ctx is done.
+// Files are written only inside the root stack directory
+type fileFuncs struct {
+	ctx     context.Context
+	root    string
+	workdir string
+	mux     sync.Mutex
+	read    []string
+}
+
+func newFileFuncs(root, workdir string) *fileFuncs {
+	return &fileFuncs{ctx: context.Background(), root: root, workdir: workdir}
+}
+
+func (f *fileFuncs) namespace() interface{} {
+	return f
+}
+
+func (f *fileFuncs) files() []string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.read
+}
+
+// record adds the read file for the cache
+func (f *fileFuncs) record(fileName string) {
+	f.mux.Lock()
+	f.read = append(f.read, fileName)
+	f.mux.Unlock()
+}
+
+func (f *fileFuncs) path(path interface{}) string {
+	p := gomplateConv.ToString(path)
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(f.workdir, p)
+}
+
+// Read func
+func (f *fileFuncs) Read(path interface{}) (string, error) {
+	if err := f.ctx.Err(); err != nil {
+		return "", err
+	}
+	fileName := f.path(path)
+	f.record(fileName)
+	return gomplateFuncs.FileNS().Read(fileName)
+}
+
+// Stat func
+func (f *fileFuncs) Stat(path interface{}) (os.FileInfo, error) {
+	return gomplateFuncs.FileNS().Stat(f.path(path))
+}
+
+// Exists func
+func (f *fileFuncs) Exists(path interface{}) bool {
+	return gomplateFuncs.FileNS().Exists(f.path(path))
+}
+
+// IsDir func
+func (f *fileFuncs) IsDir(path interface{}) bool {
+	return gomplateFuncs.FileNS().IsDir(f.path(path))
+}
+
+// ReadDir func
+func (f *fileFuncs) ReadDir(path interface{}) ([]string, error) {
+	if err := f.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return gomplateFuncs.FileNS().ReadDir(f.path(path))
+}
+
+// Walk returns paths in the same form as the given root
+func (f *fileFuncs) Walk(path interface{}) ([]string, error) {
+	if err := f.ctx.Err(); err != nil {
+		return nil, err
+	}
+	files, err := gomplateFuncs.FileNS().Walk(f.path(path))
+	if err != nil || filepath.IsAbs(gomplateConv.ToString(path)) {
+		return files, err
+	}
+	for i, file := range files {
+		if rel, err := filepath.Rel(f.workdir, file); err == nil {
+			files[i] = rel
+		}
+	}
+	return files, nil
+}
+
+// Write func. Unlike gomplate, files are confined to the root stack directory,
+// not to the process working directory
+func (f *fileFuncs) Write(path interface{}, data interface{}) (string, error) {
+	if err := f.ctx.Err(); err != nil {
+		return "", err
+	}
+	fileName := f.path(path)
+	if rel, err := filepath.Rel(f.root, fileName); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("failed to open %s: path is not contained by the root stack directory %s", fileName, f.root)
+	}
+	content, ok := data.([]byte)
+	if !ok {
+		content = []byte(gomplateConv.ToString(data))
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(fileName); err == nil {
+		mode = info.Mode()
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return "", fmt.Errorf("failed to make dirs for %s: %w", fileName, err)
+	}
+	return "", ioutil.WriteFile(fileName, content, mode)
+}
@@ -1,29 +1,25 @@
 package gomplate
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"path/filepath"
-	"runtime/debug"
-	"strings"
 	"sync"
 	"text/template"
 	"time"
 
-	"github.com/Jeffail/gabs/v2"
 	"github.com/davecgh/go-spew/spew"
 	gomplate "github.com/hairyhenderson/gomplate/v3"
 	gomplateData "github.com/hairyhenderson/gomplate/v3/data"
 	gomplateTmpl "github.com/hairyhenderson/gomplate/v3/tmpl"
-	"github.com/imdario/mergo"
 	"github.com/joeycumines/go-dotnotation/dotnotation"
 	"github.com/kruglovmax/stack/pkg/app"
 	"github.com/kruglovmax/stack/pkg/cel"
 	"github.com/kruglovmax/stack/pkg/conditions"
-	"github.com/kruglovmax/stack/pkg/log"
+	"github.com/kruglovmax/stack/pkg/consts"
 	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/stack/v1/run"
 	"github.com/kruglovmax/stack/pkg/types"
-	"sigs.k8s.io/yaml"
 )
 
 // gomplateItem type
@@ -49,181 +45,78 @@ func New(stack types.Stack, rawItem map[string]interface{}) types.RunItem {
 	return item
 }
 
+// Plan func
+func (item *gomplateItem) Plan() *types.RunItemPlan {
+	return run.NewPlan("gomplate", item.rawItem)
+}
+
 // Exec func
-func (item *gomplateItem) Exec(parentWG *sync.WaitGroup) {
-	item.parse()
+func (item *gomplateItem) Exec(parentWG *sync.WaitGroup) (err error) {
 	if parentWG != nil {
 		defer parentWG.Done()
 	}
-	if !conditions.When(item.stack, item.When) {
+	if err = item.parse(); err != nil {
 		return
 	}
-	if !conditions.Wait(item.stack, item.Wait, item.WaitTimeout) {
+	if !conditions.When(item.stack, item.When) {
+		run.Skip(item.stack, item, item.When)
 		return
 	}
-
-	app.App.Mutex.CurrentWorkDirMutex.Lock()
-	os.Chdir(item.stack.GetWorkdir())
-	os.Setenv("AWS_TIMEOUT", fmt.Sprint(int64(item.RunTimeout/time.Millisecond)))
-	var parsedString string
+	if ok, err := conditions.Wait(item.stack, item.Wait, item.WaitTimeout); !ok {
+		return types.WrapError(item.stack, item, consts.ExitCodeWaitTimeout, err)
+	}
+	var rootObject interface{}
 	switch item.Vars.(type) {
 	case map[string]interface{}:
-		var wg sync.WaitGroup
-		wg.Add(1)
-		parsedString = processString(item.stack, &wg, item.Vars.(map[string]interface{}), item.Template)
-		if misc.WaitTimeout(&wg, item.RunTimeout) {
-			log.Logger.Fatal().
-				Str("stack", item.stack.GetWorkdir()).
-				Str("timeout", fmt.Sprint(item.RunTimeout)).
-				Msg("Gomplate waiting failed")
-		}
+		rootObject = item.Vars
 	case string:
 		stackMap := item.stack.GetView().(map[string]interface{})
 		stackMap["stack"] = stackMap
-		vars, err := dotnotation.Get(stackMap, item.Vars.(string))
-		misc.CheckIfErr(err, item.stack)
-		var wg sync.WaitGroup
-		wg.Add(1)
-		parsedString = processString(item.stack, &wg, vars, item.Template)
-		if misc.WaitTimeout(&wg, item.RunTimeout) {
-			log.Logger.Fatal().
-				Str("stack", item.stack.GetWorkdir()).
-				Str("timeout", fmt.Sprint(item.RunTimeout)).
-				Msg("Gomplate waiting failed")
+		rootObject, err = dotnotation.Get(stackMap, item.Vars.(string))
+		if err != nil {
+			return
 		}
 	case nil:
-		var wg sync.WaitGroup
-		wg.Add(1)
-		parsedString = processString(item.stack, &wg, item.stack.GetView(), item.Template)
-		if misc.WaitTimeout(&wg, item.RunTimeout) {
-			log.Logger.Fatal().
-				Str("stack", item.stack.GetWorkdir()).
-				Str("timeout", fmt.Sprint(item.RunTimeout)).
-				Msg("Gomplate waiting failed")
-		}
+		rootObject = item.stack.GetView()
 	default:
-		log.Logger.Trace().
+		app.FromStack(item.stack).Logger.Trace().
 			Msg(spew.Sdump(item))
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Msg("Unable to parse run item. Bad vars key")
+		return fmt.Errorf("Unable to parse run item. Bad vars key")
 	}
-	app.App.Mutex.CurrentWorkDirMutex.Unlock()
 
-	if item.Output == nil {
-		return
+	cacheKey := run.CacheKey(item.stack, item.rawItem, "gomplate", rootObject, item.Template)
+	if cached, ok := run.CacheGet(item.stack, cacheKey); ok {
+		return run.ProcessOutput(item.stack, item.Output, cached)
 	}
 
-	for _, v := range item.Output {
-		switch v.(type) {
-		case string:
-			switch v.(string) {
-			case "stdout":
-				messagesChannel, listenerChannel := app.App.StdOut.StartOutputForObject()
-				app.App.StdOut.SendStringForObject(messagesChannel, parsedString)
-				app.App.StdOut.FinishOutputForObject(messagesChannel, listenerChannel)
-			case "stderr":
-				messagesChannel, listenerChannel := app.App.StdErr.StartOutputForObject()
-				app.App.StdErr.SendStringForObject(messagesChannel, parsedString)
-				app.App.StdErr.FinishOutputForObject(messagesChannel, listenerChannel)
-			}
-		case map[string]interface{}:
-			if v.(map[string]interface{})["yml2var"] != nil {
-				var value map[string]interface{}
-				yml2var := v.(map[string]interface{})["yml2var"].(string)
-				err := yaml.Unmarshal([]byte(parsedString), &value)
-				misc.CheckIfErr(err, item.stack)
-				switch {
-				case strings.HasPrefix(yml2var, "vars") || strings.HasPrefix(yml2var, "stack.vars"):
-					key := strings.TrimPrefix(yml2var, "stack.")
-					key = strings.TrimPrefix(strings.TrimPrefix(yml2var, "vars"), ".")
-					setVar := gabs.New()
-					if key == "" {
-						setVar.Set(value)
-					} else {
-						setVar.SetP(value, key)
-					}
-					item.stack.AddRawVarsRight(setVar.Data().(map[string]interface{}))
-				case strings.HasPrefix(yml2var, "flags") || strings.HasPrefix(yml2var, "stack.flags"):
-					key := strings.TrimPrefix(yml2var, "stack.")
-					key = strings.TrimPrefix(strings.TrimPrefix(yml2var, "flags"), ".")
-					setVar := gabs.New()
-					if key == "" {
-						setVar.Set(value)
-					} else {
-						setVar.SetP(value, key)
-					}
-					item.stack.GetFlags().Mux.Lock()
-					err := mergo.Merge(&item.stack.GetFlags().Vars, setVar.Data().(map[string]interface{}), mergo.WithOverwriteWithEmptyValue)
-					misc.CheckIfErr(err, item.stack)
-					item.stack.GetFlags().Mux.Unlock()
-				case strings.HasPrefix(yml2var, "locals") || strings.HasPrefix(yml2var, "stack.locals"):
-					key := strings.TrimPrefix(yml2var, "stack.")
-					key = strings.TrimPrefix(strings.TrimPrefix(yml2var, "locals"), ".")
-					setVar := gabs.New()
-					if key == "" {
-						setVar.Set(value)
-					} else {
-						setVar.SetP(value, key)
-					}
-					item.stack.GetLocals().Mux.Lock()
-					err := mergo.Merge(&item.stack.GetLocals().Vars, setVar.Data().(map[string]interface{}), mergo.WithOverwriteWithEmptyValue)
-					misc.CheckIfErr(err, item.stack)
-					item.stack.GetLocals().Mux.Unlock()
-				default:
-					log.Logger.Fatal().
-						Str("yml2var", yml2var).
-						Str("in stack", item.stack.GetWorkdir()).
-						Msg("Bad output var")
-				}
-			}
-			if v.(map[string]interface{})["str2var"] != nil {
-				str2var := v.(map[string]interface{})["str2var"].(string)
-				switch {
-				case strings.HasPrefix(str2var, "vars.") || strings.HasPrefix(str2var, "stack.vars."):
-					key := strings.TrimPrefix(str2var, "stack.")
-					key = strings.TrimPrefix(str2var, "vars.")
-					setVar := gabs.New()
-					setVar.SetP(parsedString, key)
-					item.stack.AddRawVarsRight(setVar.Data().(map[string]interface{}))
-				case strings.HasPrefix(str2var, "flags.") || strings.HasPrefix(str2var, "stack.flags."):
-					key := strings.TrimPrefix(str2var, "stack.")
-					key = strings.TrimPrefix(str2var, "flags.")
-					setVar := gabs.New()
-					setVar.SetP(parsedString, key)
-					item.stack.GetFlags().Mux.Lock()
-					err := mergo.Merge(&item.stack.GetFlags().Vars, setVar.Data().(map[string]interface{}), mergo.WithOverwriteWithEmptyValue)
-					misc.CheckIfErr(err, item.stack)
-					item.stack.GetFlags().Mux.Unlock()
-				case strings.HasPrefix(str2var, "locals.") || strings.HasPrefix(str2var, "stack.locals."):
-					key := strings.TrimPrefix(str2var, "stack.")
-					key = strings.TrimPrefix(str2var, "locals.")
-					setVar := gabs.New()
-					setVar.SetP(parsedString, key)
-					item.stack.GetLocals().Mux.Lock()
-					err := mergo.Merge(&item.stack.GetLocals().Vars, setVar.Data().(map[string]interface{}), mergo.WithOverwriteWithEmptyValue)
-					misc.CheckIfErr(err, item.stack)
-					item.stack.GetLocals().Mux.Unlock()
-				default:
-					log.Logger.Fatal().
-						Str("str2var", str2var).
-						Str("in stack", item.stack.GetWorkdir()).
-						Msg("Bad output var")
-				}
-			}
-		}
+	var parsedString string
+	files := newFileFuncs(app.FromStack(item.stack).Config.Workdir, item.stack.GetWorkdir())
+	timedOut, err := misc.RunWithTimeout(item.stack.GetContext(), item.RunTimeout, func(ctx context.Context) (err error) {
+		parsedString, err = processString(ctx, item.stack, nil, rootObject, item.Template, files, item.RunTimeout)
+		return
+	})
+	if timedOut {
+		return types.NewStackError(item.stack, item, consts.ExitCodeRunTimeout,
+			fmt.Errorf(consts.MessageRunTimeout, "Gomplate", item.RunTimeout))
 	}
+	if item.stack.GetContext().Err() != nil {
+		// cancelled, the result is incomplete
+		return nil
+	}
+	run.Watch(item.stack, files.files()...)
+	if err != nil {
+		return
+	}
+	run.CachePut(item.stack, cacheKey, parsedString, files.files())
+
+	return run.ProcessOutput(item.stack, item.Output, parsedString)
 }
 
-func (item *gomplateItem) parse() {
-	app.App.Mutex.CurrentWorkDirMutex.Lock()
-	defer app.App.Mutex.CurrentWorkDirMutex.Unlock()
-	os.Chdir(item.stack.GetWorkdir())
-	templateLoader := func() string {
+func (item *gomplateItem) parse() (err error) {
+	templateLoader, err := func() (string, error) {
 		switch item.rawItem["gomplate"].(type) {
 		case string:
-			return item.rawItem["gomplate"].(string)
+			return item.rawItem["gomplate"].(string), nil
 		case []interface{}:
 			var resultTemplate string
 			for _, path := range item.rawItem["gomplate"].([]interface{}) {
@@ -237,14 +130,20 @@ func (item *gomplateItem) parse() {
 				if !filepath.IsAbs(path) {
 					path = filepath.Join(item.stack.GetWorkdir(), path)
 				}
-				resultTemplate = resultTemplate + misc.ReadFileFromPath(path)
+				run.Watch(item.stack, path)
+				content, err := misc.ReadFileFromPath(path)
+				if err != nil {
+					return "", err
+				}
+				resultTemplate = resultTemplate + content
 			}
-			return resultTemplate
+			return resultTemplate, nil
 		}
-		err := fmt.Errorf("Unable to parse run item")
-		misc.CheckIfErr(err, item.stack)
-		return ""
+		return "", fmt.Errorf("Unable to parse run item")
 	}()
+	if err != nil {
+		return
+	}
 
 	item.Template = templateLoader
 	item.Vars = item.rawItem["vars"]
@@ -260,29 +159,51 @@ func (item *gomplateItem) parse() {
 	if waitCondition != nil {
 		item.Wait = waitCondition.(string)
 	}
-	var err error
 	runTimeout := item.rawItem["runTimeout"]
-	item.RunTimeout = *app.App.Config.DefaultTimeout
+	item.RunTimeout = app.FromStack(item.stack).Config.DefaultTimeout
 	if runTimeout != nil {
 		item.RunTimeout, err = time.ParseDuration(runTimeout.(string))
-		misc.CheckIfErr(err, item.stack)
+		if err != nil {
+			return
+		}
 	}
 	waitTimeout := item.rawItem["waitTimeout"]
-	item.WaitTimeout = *app.App.Config.DefaultTimeout
+	item.WaitTimeout = app.FromStack(item.stack).Config.DefaultTimeout
 	if waitTimeout != nil {
 		item.WaitTimeout, err = time.ParseDuration(waitTimeout.(string))
-		misc.CheckIfErr(err, item.stack)
 	}
+	return
 }
 
-func processString(stack types.Stack, parentWG *sync.WaitGroup, rootObject interface{}, str string) string {
+// baseFuncs are the gomplate functions shared by all renders. gomplate keeps its
+// namespaces in globals and sets their context on every gomplate.Funcs call,
+// so the functions are created once
+var (
+	baseFuncs     template.FuncMap
+	baseFuncsInit sync.Once
+)
+
+// processString renders the template. Functions of the file namespace fail after ctx is done.
+// Clients of the aws namespace time out after awsTimeout
+func processString(ctx context.Context, stack types.Stack, parentWG *sync.WaitGroup, rootObject interface{}, str string, files *fileFuncs, awsTimeout time.Duration) (string, error) {
 	if parentWG != nil {
 		defer parentWG.Done()
 	}
 
 	var gtpl *gomplateTmpl.Template
 	root := template.New("root")
-	funcMap := gomplate.Funcs(&gomplateData.Data{})
+	files.ctx = ctx
+	baseFuncsInit.Do(func() {
+		baseFuncs = gomplate.Funcs(new(gomplateData.Data))
+	})
+	funcMap := make(template.FuncMap, len(baseFuncs)+2)
+	for name, f := range baseFuncs {
+		funcMap[name] = f
+	}
+	funcMap["file"] = files.namespace
+	funcMap["filepath"] = newFilePathFuncs(files.workdir).namespace
+	newDataFuncs(files).funcs(funcMap)
+	newAWSFuncs(awsTimeout).funcs(funcMap)
 
 	gtpl = gomplateTmpl.New(root, rootObject)
 	funcMap["tpl"] = gtpl.Inline
@@ -291,9 +212,8 @@ func processString(stack types.Stack, parentWG *sync.WaitGroup, rootObject inter
 	}
 	root.Funcs(funcMap)
 	gtplOut, err := gtpl.Inline(str)
-	log.Logger.Trace().
+	app.FromStack(stack).Logger.Trace().
 		Str("rootMap", spew.Sprint(rootObject)).
 		Msg("")
-	misc.CheckIfErr(err, stack)
-	return gtplOut
+	return gtplOut, err
 }
@@ -7,8 +7,8 @@ import (
 
 	"github.com/kruglovmax/stack/pkg/app"
 	"github.com/kruglovmax/stack/pkg/conditions"
-	"github.com/kruglovmax/stack/pkg/log"
-	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/stack/v1/run"
 	"github.com/kruglovmax/stack/pkg/types"
 )
 
@@ -16,6 +16,7 @@ import (
 type groupItem struct {
 	Group       []types.RunItem `json:"group,omitempty"`
 	Parallel    bool            `json:"parallel,omitempty"`
+	MaxParallel int             `json:"maxParallel,omitempty"`
 	When        string          `json:"when,omitempty"`
 	Wait        string          `json:"wait,omitempty"`
 	RunTimeout  time.Duration   `json:"runTimeout,omitempty"`
@@ -34,59 +35,92 @@ func New(stack types.Stack, rawItem map[string]interface{}) types.RunItem {
 	return item
 }
 
+// Plan func
+func (item *groupItem) Plan() *types.RunItemPlan {
+	plan := run.NewPlan("group", item.rawItem)
+	plan.Value = nil
+	rawGroup, _ := item.rawItem["group"].([]interface{})
+	for _, runItem := range item.stack.GetRunItemsParser().ParseRun(item.stack, rawGroup) {
+		plan.Items = append(plan.Items, runItem.Plan())
+	}
+	return plan
+}
+
 // Exec func
-func (item *groupItem) Exec(parentWG *sync.WaitGroup) {
-	item.parse()
+func (item *groupItem) Exec(parentWG *sync.WaitGroup) (err error) {
 	if parentWG != nil {
 		defer parentWG.Done()
 	}
-	if !conditions.When(item.stack, item.When) {
+	if err = item.parse(); err != nil {
 		return
 	}
-	if !conditions.Wait(item.stack, item.Wait, item.WaitTimeout) {
+	if !conditions.When(item.stack, item.When) {
+		run.Skip(item.stack, item, item.When)
 		return
 	}
+	if ok, err := conditions.Wait(item.stack, item.Wait, item.WaitTimeout); !ok {
+		return types.WrapError(item.stack, item, consts.ExitCodeWaitTimeout, err)
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go item.execGroup(&wg)
+	// the group is cancelled on its timeout, not the stack
+	scope, cancel := run.WithCancel(item.stack)
+	defer cancel()
+	rawGroup, _ := item.rawItem["group"].([]interface{})
+	item.Group = scope.GetRunItemsParser().ParseRun(scope, rawGroup)
+	result := make(chan error, 1)
+	go func() {
+		result <- item.execGroup(scope)
+	}()
 
-	if item.RunTimeout != 0 {
-		if misc.WaitTimeout(&wg, item.RunTimeout) {
-			log.Logger.Fatal().
-				Str("stack", item.stack.GetWorkdir()).
-				Str("timeout", fmt.Sprint(item.RunTimeout)).
-				Msg("Group waiting failed")
-		}
+	if item.RunTimeout == 0 {
+		return <-result
+	}
+	select {
+	case err = <-result:
+		return
+	case <-time.After(item.RunTimeout):
+		cancel()
+		<-result
+		return types.NewStackError(item.stack, item, consts.ExitCodeRunTimeout,
+			fmt.Errorf(consts.MessageRunTimeout, "Group", item.RunTimeout))
 	}
 }
 
-func (item *groupItem) execGroup(parentWG *sync.WaitGroup) {
-	defer parentWG.Done()
+func (item *groupItem) execGroup(scope types.Stack) error {
+	var errs types.StackErrors
 	if item.Parallel {
-		var wg sync.WaitGroup
-		for _, runItem := range item.Group {
-			wg.Add(1)
-			go runItem.Exec(&wg)
-		}
-		wg.Wait()
+		var errsMutex sync.Mutex
+		app.FromStack(scope).Jobs.Parallel(scope.GetContext(), len(item.Group), item.MaxParallel, func(i int) {
+			err := item.Group[i].Exec(nil)
+			errsMutex.Lock()
+			errs = errs.Append(types.WrapError(item.stack, item.Group[i], consts.ExitCodeScriptFailed, err))
+			errsMutex.Unlock()
+		})
 	} else {
 		for _, runItem := range item.Group {
-			var wg sync.WaitGroup
-			wg.Add(1)
-			go runItem.Exec(&wg)
-			wg.Wait()
+			if scope.GetContext().Err() != nil {
+				break
+			}
+			err := runItem.Exec(nil)
+			if err != nil {
+				errs = errs.Append(types.WrapError(item.stack, runItem, consts.ExitCodeScriptFailed, err))
+				break
+			}
 		}
 	}
+	return errs.ErrorOrNil()
 }
 
-func (item *groupItem) parse() {
-	item.Group = item.stack.GetRunItemsParser().ParseRun(item.stack, item.rawItem["group"].([]interface{}))
+func (item *groupItem) parse() (err error) {
 	parallel := item.rawItem["parallel"]
 	if parallel == nil {
 		parallel = false
 	}
 	item.Parallel = parallel.(bool)
+	item.MaxParallel = 0
+	if maxParallel, ok := item.rawItem["maxParallel"].(float64); ok {
+		item.MaxParallel = int(maxParallel)
+	}
 	whenCondition := (item.rawItem)["when"]
 	waitCondition := (item.rawItem)["wait"]
 	if whenCondition != nil {
@@ -95,17 +129,18 @@ func (item *groupItem) parse() {
 	if waitCondition != nil {
 		item.Wait = waitCondition.(string)
 	}
-	var err error
 	runTimeout := item.rawItem["runTimeout"]
 	item.RunTimeout = 0
 	if runTimeout != nil {
 		item.RunTimeout, err = time.ParseDuration(runTimeout.(string))
-		misc.CheckIfErr(err, item.stack)
+		if err != nil {
+			return
+		}
 	}
 	waitTimeout := item.rawItem["waitTimeout"]
-	item.WaitTimeout = *app.App.Config.DefaultTimeout
+	item.WaitTimeout = app.FromStack(item.stack).Config.DefaultTimeout
 	if waitTimeout != nil {
 		item.WaitTimeout, err = time.ParseDuration(waitTimeout.(string))
-		misc.CheckIfErr(err, item.stack)
 	}
+	return
 }
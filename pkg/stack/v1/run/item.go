@@ -0,0 +1,161 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/report"
+	"github.com/kruglovmax/stack/pkg/retry"
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+// wrappedItem applies continueOnError and retries to a run item
+// and records it in the run report
+type wrappedItem struct {
+	runItem types.RunItem
+	rawItem map[string]interface{}
+	stack   types.Stack
+}
+
+// Iteration is a stack bound to an element of foreach.
+// GetIndex returns nil for other stacks
+type Iteration interface {
+	GetIndex() interface{}
+}
+
+// scopedStack is the stack with the context of a run item. Cancelling
+// the context stops nested run items of the run item only
+type scopedStack struct {
+	types.Stack
+	ctx context.Context
+}
+
+// WithCancel returns the stack for nested run items of a run item
+// and the func cancelling them
+func WithCancel(stack types.Stack) (types.Stack, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(stack.GetContext())
+	return &scopedStack{Stack: stack, ctx: ctx}, cancel
+}
+
+// GetContext func
+func (stack *scopedStack) GetContext() context.Context {
+	return stack.ctx
+}
+
+// GetIndex func
+func (stack *scopedStack) GetIndex() interface{} {
+	if iteration, ok := stack.Stack.(Iteration); ok {
+		return iteration.GetIndex()
+	}
+	return nil
+}
+
+// Wrap func
+func Wrap(stack types.Stack, rawItem map[string]interface{}, runItem types.RunItem) types.RunItem {
+	if runItem == nil {
+		return nil
+	}
+	item := new(wrappedItem)
+	item.runItem = runItem
+	item.rawItem = rawItem
+	item.stack = stack
+	return item
+}
+
+// Skip marks the run item as skipped by its when condition in the run report
+func Skip(stack types.Stack, runItem types.RunItem, condition string) {
+	app.FromStack(stack).Report.RunItemSkipped(runItem, "when: "+condition)
+}
+
+// Describe returns the first line of the run item value
+func Describe(plan *types.RunItemPlan) string {
+	const maxLength = 60
+	value, ok := plan.Value.(string)
+	if !ok {
+		return ""
+	}
+	value = strings.SplitN(value, "\n", 2)[0]
+	if len(value) > maxLength {
+		value = value[:maxLength] + "..."
+	}
+	return value
+}
+
+// Plan func
+func (item *wrappedItem) Plan() *types.RunItemPlan {
+	plan := item.runItem.Plan()
+	policy, _ := retry.Parse(item.rawItem)
+	plan.Retries = policy.Retries
+	plan.ContinueOnError = policy.ContinueOnError
+	return plan
+}
+
+// Exec func
+func (item *wrappedItem) Exec(parentWG *sync.WaitGroup) (err error) {
+	if parentWG != nil {
+		defer parentWG.Done()
+	}
+	plan := item.runItem.Plan()
+	name := Describe(plan)
+	if iteration, ok := item.stack.(Iteration); ok && iteration.GetIndex() != nil {
+		name = fmt.Sprintf("[%v] %s", iteration.GetIndex(), name)
+	}
+	id := app.FromStack(item.stack).Report.RunItemStarted(item.stack, item.runItem, plan.Type, name)
+	item.setStatus(id, "Run")
+	status := report.StatusDone
+	var ignoredErr error
+	defer func() {
+		reportErr := err
+		switch {
+		case err != nil:
+			status = report.StatusFailed
+		case ignoredErr != nil:
+			reportErr = ignoredErr
+		case item.stack.GetContext().Err() != nil:
+			status = report.StatusCancelled
+		}
+		item.setStatus(id, app.FromStack(item.stack).Report.RunItemFinished(item.runItem, status, reportErr))
+	}()
+
+	policy, err := retry.Parse(item.rawItem)
+	if err != nil {
+		return
+	}
+	err = policy.Do(item.stack.GetContext(), func() error {
+		return item.runItem.Exec(nil)
+	}, func(attempt int, err error) {
+		app.FromStack(item.stack).Logger.Warn().
+			Str("stack", item.stack.GetWorkdir()).
+			Str("runItem", plan.Type).
+			Int("attempt", attempt).
+			Int("retries", policy.Retries).
+			Msg(err.Error())
+		app.FromStack(item.stack).Report.RunItemRetried(item.runItem)
+		item.setStatus(id, fmt.Sprintf("Retry %d/%d", attempt, policy.Retries))
+	})
+	if err != nil && policy.ContinueOnError {
+		app.FromStack(item.stack).Logger.Warn().
+			Str("stack", item.stack.GetWorkdir()).
+			Str("runItem", plan.Type).
+			Msg(consts.MessageContinueOnError + ": " + err.Error())
+		status = report.StatusFailedIgnored
+		ignoredErr = err
+		return nil
+	}
+	return types.WrapError(item.stack, item.runItem, consts.ExitCodeScriptFailed, err)
+}
+
+// setStatus records the status of the run item in the stack status map under its report ID
+func (item *wrappedItem) setStatus(id, status string) {
+	if id == "" {
+		return
+	}
+	stacksStatus := app.FromStack(item.stack).StacksStatus
+	stacksStatus.Mux.Lock()
+	stacksStatus.StacksStatus[id] = status
+	stacksStatus.Mux.Unlock()
+}
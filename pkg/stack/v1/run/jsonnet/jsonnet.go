@@ -1,24 +1,21 @@
 package jsonnet
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/Jeffail/gabs/v2"
 	jsonnet "github.com/google/go-jsonnet"
-	"github.com/imdario/mergo"
 	"github.com/joeycumines/go-dotnotation/dotnotation"
 	"github.com/kruglovmax/stack/pkg/app"
 	"github.com/kruglovmax/stack/pkg/conditions"
-	"github.com/kruglovmax/stack/pkg/log"
+	"github.com/kruglovmax/stack/pkg/consts"
 	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/stack/v1/run"
 	"github.com/kruglovmax/stack/pkg/types"
-	"sigs.k8s.io/yaml"
 )
 
 // jsonnetItem type
@@ -45,22 +42,47 @@ func New(stack types.Stack, rawItem map[string]interface{}) types.RunItem {
 	return item
 }
 
+// Plan func
+func (item *jsonnetItem) Plan() *types.RunItemPlan {
+	return run.NewPlan("jsonnet", item.rawItem)
+}
+
 // Exec func
-func (item *jsonnetItem) Exec(parentWG *sync.WaitGroup) {
-	item.parse()
+func (item *jsonnetItem) Exec(parentWG *sync.WaitGroup) (err error) {
 	if parentWG != nil {
 		defer parentWG.Done()
 	}
-	if !conditions.When(item.stack, item.When) {
+	if err = item.parse(); err != nil {
 		return
 	}
-	if !conditions.Wait(item.stack, item.Wait, item.WaitTimeout) {
+	if !conditions.When(item.stack, item.When) {
+		run.Skip(item.stack, item, item.When)
 		return
 	}
+	if ok, err := conditions.Wait(item.stack, item.Wait, item.WaitTimeout); !ok {
+		return types.WrapError(item.stack, item, consts.ExitCodeWaitTimeout, err)
+	}
+	var rootObject interface{}
+	switch item.Vars.(type) {
+	case map[string]interface{}:
+		rootObject = item.Vars
+	case string:
+		stackMap := item.stack.GetView().(map[string]interface{})
+		stackMap["stack"] = stackMap
+		rootObject, err = dotnotation.Get(stackMap, item.Vars.(string))
+		if err != nil {
+			return
+		}
+	case nil:
+		rootObject = item.stack.GetView()
+	default:
+		return fmt.Errorf("Unable to parse run item. Bad vars key")
+	}
 
-	app.App.Mutex.CurrentWorkDirMutex.Lock()
-	os.Chdir(item.stack.GetWorkdir())
 	var parsedString, jsonnetSnippet string
+	// imports are resolved relative to the snippet file, inline snippets live in the stack workdir
+	jsonnetFile := filepath.Join(item.stack.GetWorkdir(), "jsonnet")
+	var files []string
 	switch {
 	case item.Jsonnet != "":
 		jsonnetSnippet = item.Jsonnet
@@ -68,18 +90,21 @@ func (item *jsonnetItem) Exec(parentWG *sync.WaitGroup) {
 		switch {
 		case len(item.Paths) == 1:
 			path := item.Paths[0]
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(item.stack.GetWorkdir(), path)
+			}
+			run.Watch(item.stack, path)
 			switch {
 			case misc.PathIsFile(path):
-				dir := filepath.Dir(path)
-				file := filepath.Base(path)
-				os.Chdir(dir)
-				var err error
 				var content []byte
-				content, err = ioutil.ReadFile(file)
-				misc.CheckIfErr(err, item.stack)
+				content, err = ioutil.ReadFile(path)
+				if err != nil {
+					return
+				}
 				jsonnetSnippet = string(content)
+				jsonnetFile = path
+				files = append(files, path)
 			case misc.PathIsDir(path):
-				os.Chdir(path)
 				// TODO
 			}
 		case len(item.Paths) > 1:
@@ -87,179 +112,57 @@ func (item *jsonnetItem) Exec(parentWG *sync.WaitGroup) {
 		}
 	}
 
-	switch item.Vars.(type) {
-	case map[string]interface{}:
-		var wg sync.WaitGroup
-		wg.Add(1)
-		parsedString = processJsonnet(item.stack, &wg, item.Vars.(map[string]interface{}), jsonnetSnippet)
-		if misc.WaitTimeout(&wg, item.RunTimeout) {
-			log.Logger.Fatal().
-				Str("stack", item.stack.GetWorkdir()).
-				Str("timeout", fmt.Sprint(item.RunTimeout)).
-				Msg("Jsonnet waiting failed")
-		}
-	case string:
-		stackMap := item.stack.GetView().(map[string]interface{})
-		stackMap["stack"] = stackMap
-		vars, err := dotnotation.Get(stackMap, item.Vars.(string))
-		misc.CheckIfErr(err, item.stack)
-		var wg sync.WaitGroup
-		wg.Add(1)
-		parsedString = processJsonnet(item.stack, &wg, vars, jsonnetSnippet)
-		if misc.WaitTimeout(&wg, item.RunTimeout) {
-			log.Logger.Fatal().
-				Str("stack", item.stack.GetWorkdir()).
-				Str("timeout", fmt.Sprint(item.RunTimeout)).
-				Msg("Jsonnet waiting failed")
-		}
-	case nil:
-		var wg sync.WaitGroup
-		wg.Add(1)
-		parsedString = processJsonnet(item.stack, &wg, item.stack.GetView(), jsonnetSnippet)
-		if misc.WaitTimeout(&wg, item.RunTimeout) {
-			log.Logger.Fatal().
-				Str("stack", item.stack.GetWorkdir()).
-				Str("timeout", fmt.Sprint(item.RunTimeout)).
-				Msg("Jsonnet waiting failed")
-		}
-	default:
-		err := fmt.Errorf("Unable to parse run item. Bad vars key")
-		misc.CheckIfErr(err, item.stack)
+	cacheKey := run.CacheKey(item.stack, item.rawItem, "jsonnet", rootObject, jsonnetFile, jsonnetSnippet)
+	if cached, ok := run.CacheGet(item.stack, cacheKey); ok {
+		return run.ProcessOutput(item.stack, item.Output, cached)
 	}
 
-	app.App.Mutex.CurrentWorkDirMutex.Unlock()
-
-	if item.Output == nil {
+	importer := new(recordingImporter)
+	timedOut, err := misc.RunWithTimeout(item.stack.GetContext(), item.RunTimeout, func(ctx context.Context) (err error) {
+		importer.ctx = ctx
+		parsedString, err = processJsonnet(item.stack, nil, rootObject, jsonnetFile, jsonnetSnippet, importer)
 		return
+	})
+	if timedOut {
+		return types.NewStackError(item.stack, item, consts.ExitCodeRunTimeout,
+			fmt.Errorf(consts.MessageRunTimeout, "Jsonnet", item.RunTimeout))
 	}
-
-	for _, v := range item.Output {
-		switch v.(type) {
-		case string:
-			switch v.(string) {
-			case "stdout":
-				messagesChannel, listenerChannel := app.App.StdOut.StartOutputForObject()
-				app.App.StdOut.SendStringForObject(messagesChannel, parsedString)
-				app.App.StdOut.FinishOutputForObject(messagesChannel, listenerChannel)
-			case "stderr":
-				messagesChannel, listenerChannel := app.App.StdErr.StartOutputForObject()
-				app.App.StdErr.SendStringForObject(messagesChannel, parsedString)
-				app.App.StdErr.FinishOutputForObject(messagesChannel, listenerChannel)
-			}
-		case map[string]interface{}:
-			if v.(map[string]interface{})["yml2var"] != nil {
-				var value map[string]interface{}
-				yml2var := v.(map[string]interface{})["yml2var"].(string)
-				err := yaml.Unmarshal([]byte(parsedString), &value)
-				misc.CheckIfErr(err, item.stack)
-				switch {
-				case strings.HasPrefix(yml2var, "vars") || strings.HasPrefix(yml2var, "stack.vars"):
-					key := strings.TrimPrefix(yml2var, "stack.")
-					key = strings.TrimPrefix(strings.TrimPrefix(yml2var, "vars"), ".")
-					setVar := gabs.New()
-					if key == "" {
-						setVar.Set(value)
-					} else {
-						setVar.SetP(value, key)
-					}
-					item.stack.AddRawVarsRight(setVar.Data().(map[string]interface{}))
-				case strings.HasPrefix(yml2var, "flags") || strings.HasPrefix(yml2var, "stack.flags"):
-					key := strings.TrimPrefix(yml2var, "stack.")
-					key = strings.TrimPrefix(strings.TrimPrefix(yml2var, "flags"), ".")
-					setVar := gabs.New()
-					if key == "" {
-						setVar.Set(value)
-					} else {
-						setVar.SetP(value, key)
-					}
-					item.stack.GetFlags().Mux.Lock()
-					err := mergo.Merge(&item.stack.GetFlags().Vars, setVar.Data().(map[string]interface{}), mergo.WithOverwriteWithEmptyValue)
-					misc.CheckIfErr(err, item.stack)
-					item.stack.GetFlags().Mux.Unlock()
-				case strings.HasPrefix(yml2var, "locals") || strings.HasPrefix(yml2var, "stack.locals"):
-					key := strings.TrimPrefix(yml2var, "stack.")
-					key = strings.TrimPrefix(strings.TrimPrefix(yml2var, "locals"), ".")
-					setVar := gabs.New()
-					if key == "" {
-						setVar.Set(value)
-					} else {
-						setVar.SetP(value, key)
-					}
-					item.stack.GetLocals().Mux.Lock()
-					err := mergo.Merge(&item.stack.GetLocals().Vars, setVar.Data().(map[string]interface{}), mergo.WithOverwriteWithEmptyValue)
-					misc.CheckIfErr(err, item.stack)
-					item.stack.GetLocals().Mux.Unlock()
-				default:
-					log.Logger.Fatal().
-						Str("yml2var", yml2var).
-						Str("in stack", item.stack.GetWorkdir()).
-						Msg("Bad output var")
-				}
-			}
-			if v.(map[string]interface{})["str2var"] != nil {
-				str2var := v.(map[string]interface{})["str2var"].(string)
-				switch {
-				case strings.HasPrefix(str2var, "vars.") || strings.HasPrefix(str2var, "stack.vars."):
-					key := strings.TrimPrefix(str2var, "stack.")
-					key = strings.TrimPrefix(str2var, "vars.")
-					setVar := gabs.New()
-					setVar.SetP(parsedString, key)
-					item.stack.AddRawVarsRight(setVar.Data().(map[string]interface{}))
-				case strings.HasPrefix(str2var, "flags.") || strings.HasPrefix(str2var, "stack.flags."):
-					key := strings.TrimPrefix(str2var, "stack.")
-					key = strings.TrimPrefix(str2var, "flags.")
-					setVar := gabs.New()
-					setVar.SetP(parsedString, key)
-					item.stack.GetFlags().Mux.Lock()
-					err := mergo.Merge(&item.stack.GetFlags().Vars, setVar.Data().(map[string]interface{}), mergo.WithOverwriteWithEmptyValue)
-					misc.CheckIfErr(err, item.stack)
-					item.stack.GetFlags().Mux.Unlock()
-				case strings.HasPrefix(str2var, "locals.") || strings.HasPrefix(str2var, "stack.locals."):
-					key := strings.TrimPrefix(str2var, "stack.")
-					key = strings.TrimPrefix(str2var, "locals.")
-					setVar := gabs.New()
-					setVar.SetP(parsedString, key)
-					item.stack.GetLocals().Mux.Lock()
-					err := mergo.Merge(&item.stack.GetLocals().Vars, setVar.Data().(map[string]interface{}), mergo.WithOverwriteWithEmptyValue)
-					misc.CheckIfErr(err, item.stack)
-					item.stack.GetLocals().Mux.Unlock()
-				default:
-					log.Logger.Fatal().
-						Str("str2var", str2var).
-						Str("in stack", item.stack.GetWorkdir()).
-						Msg("Bad output var")
-				}
-			}
-		}
+	if item.stack.GetContext().Err() != nil {
+		// cancelled, the result is incomplete
+		return nil
 	}
+	run.Watch(item.stack, importer.files...)
+	if err != nil {
+		return
+	}
+	run.CachePut(item.stack, cacheKey, parsedString, append(files, importer.files...))
+
+	return run.ProcessOutput(item.stack, item.Output, parsedString)
 }
 
-func (item *jsonnetItem) parse() {
-	app.App.Mutex.CurrentWorkDirMutex.Lock()
-	defer app.App.Mutex.CurrentWorkDirMutex.Unlock()
-	os.Chdir(item.stack.GetWorkdir())
-	jsonnetSnippet, jsonnetFiles := func() (string, []string) {
+func (item *jsonnetItem) parse() (err error) {
+	jsonnetSnippet, jsonnetFiles, err := func() (string, []string, error) {
 		var jsonnetFiles []string
 		switch item.rawItem["jsonnet"].(type) {
 		case string:
-			return item.rawItem["jsonnet"].(string), nil
+			return item.rawItem["jsonnet"].(string), nil, nil
 		case []interface{}:
 			var resultJsonnet string
 			for _, v := range item.rawItem["jsonnet"].([]interface{}) {
 				jsonnetFiles = append(jsonnetFiles, v.(string))
 			}
-			return resultJsonnet, jsonnetFiles
+			return resultJsonnet, jsonnetFiles, nil
 		}
-		err := fmt.Errorf("Unable to parse run item")
-		misc.CheckIfErr(err, item.stack)
-		return "", nil
+		return "", nil, fmt.Errorf("Unable to parse run item")
 	}()
+	if err != nil {
+		return
+	}
 
-	item.Jsonnet = jsonnetSnippet
 	item.Jsonnet = jsonnetSnippet
 	item.Paths = jsonnetFiles
 	item.Vars = item.rawItem["vars"]
-	item.Output = item.rawItem["output"].([]interface{})
+	item.Output, _ = item.rawItem["output"].([]interface{})
 	whenCondition := item.rawItem["when"]
 	waitCondition := item.rawItem["wait"]
 	if whenCondition != nil {
@@ -268,29 +171,53 @@ func (item *jsonnetItem) parse() {
 	if waitCondition != nil {
 		item.Wait = waitCondition.(string)
 	}
-	var err error
 	runTimeout := item.rawItem["runTimeout"]
-	item.RunTimeout = *app.App.Config.DefaultTimeout
+	item.RunTimeout = app.FromStack(item.stack).Config.DefaultTimeout
 	if runTimeout != nil {
 		item.RunTimeout, err = time.ParseDuration(runTimeout.(string))
-		misc.CheckIfErr(err, item.stack)
+		if err != nil {
+			return
+		}
 	}
 	waitTimeout := item.rawItem["waitTimeout"]
-	item.WaitTimeout = *app.App.Config.DefaultTimeout
+	item.WaitTimeout = app.FromStack(item.stack).Config.DefaultTimeout
 	if waitTimeout != nil {
 		item.WaitTimeout, err = time.ParseDuration(waitTimeout.(string))
-		misc.CheckIfErr(err, item.stack)
 	}
+	return
+}
+
+// recordingImporter records imported files for the cache.
+// Imports fail after ctx is done, the evaluation stops at the next import then
+type recordingImporter struct {
+	jsonnet.FileImporter
+	ctx   context.Context
+	files []string
+}
+
+// Import func
+func (importer *recordingImporter) Import(importedFrom, importedPath string) (contents jsonnet.Contents, foundAt string, err error) {
+	if err = importer.ctx.Err(); err != nil {
+		return
+	}
+	contents, foundAt, err = importer.FileImporter.Import(importedFrom, importedPath)
+	if err == nil {
+		importer.files = append(importer.files, foundAt)
+	}
+	return
 }
 
-func processJsonnet(stack types.Stack, parentWG *sync.WaitGroup, rootObject interface{}, str string) string {
+func processJsonnet(stack types.Stack, parentWG *sync.WaitGroup, rootObject interface{}, filename, str string, importer jsonnet.Importer) (string, error) {
 	if parentWG != nil {
 		defer parentWG.Done()
 	}
 
+	stackJSON, err := misc.ToJSON(rootObject)
+	if err != nil {
+		return "", err
+	}
 	vm := jsonnet.MakeVM()
-	vm.TLACode("stack", misc.ToJSON(rootObject))
-	result, err := vm.EvaluateSnippet("jsonnet", str)
-	misc.CheckIfErr(err, stack)
-	return result
+	vm.Importer(importer)
+	vm.TLACode("stack", stackJSON)
+	return vm.EvaluateSnippet(filename, str)
 }
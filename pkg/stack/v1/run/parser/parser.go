@@ -1,6 +1,8 @@
 package parser
 
 import (
+	"github.com/kruglovmax/stack/pkg/stack/v1/run"
+	"github.com/kruglovmax/stack/pkg/stack/v1/run/foreach"
 	"github.com/kruglovmax/stack/pkg/stack/v1/run/gitclone"
 	"github.com/kruglovmax/stack/pkg/stack/v1/run/gomplate"
 	"github.com/kruglovmax/stack/pkg/stack/v1/run/group"
@@ -49,7 +51,10 @@ func (parser *runItemParser) ParseRunItem(stack types.Stack, item interface{}) (
 			output = gitclone.New(stack, item.(map[string]interface{}))
 		case item.(map[string]interface{})["group"] != nil:
 			output = group.New(stack, item.(map[string]interface{}))
+		case item.(map[string]interface{})["foreach"] != nil:
+			output = foreach.New(stack, item.(map[string]interface{}))
 		}
+		output = run.Wrap(stack, item.(map[string]interface{}), output)
 	}
 	return
 }
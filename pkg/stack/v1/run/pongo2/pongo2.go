@@ -4,6 +4,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/kruglovmax/stack/pkg/stack/v1/run"
 	"github.com/kruglovmax/stack/pkg/types"
 )
 
@@ -30,6 +31,15 @@ func New(stack types.Stack, rawItem map[string]interface{}) types.RunItem {
 	return item
 }
 
+// Plan func
+func (item *pongo2Item) Plan() *types.RunItemPlan {
+	return run.NewPlan("pongo2", item.rawItem)
+}
+
 // Exec func
-func (item *pongo2Item) Exec(parentWG *sync.WaitGroup) {
+func (item *pongo2Item) Exec(parentWG *sync.WaitGroup) error {
+	if parentWG != nil {
+		defer parentWG.Done()
+	}
+	return nil
 }
@@ -1 +1,113 @@
 package run
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/imdario/mergo"
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+// NewPlan returns dry-run view of raw run item
+func NewPlan(itemType string, rawItem map[string]interface{}) *types.RunItemPlan {
+	plan := new(types.RunItemPlan)
+	plan.Type = itemType
+	plan.Value = rawItem[itemType]
+	plan.Vars = rawItem["vars"]
+	plan.Output, _ = rawItem["output"].([]interface{})
+	plan.When, _ = rawItem["when"].(string)
+	plan.Wait, _ = rawItem["wait"].(string)
+	plan.Parallel, _ = rawItem["parallel"].(bool)
+	if maxParallel, ok := rawItem["maxParallel"].(float64); ok {
+		plan.MaxParallel = int(maxParallel)
+	}
+	return plan
+}
+
+// ProcessOutput sends rendered result to every output of the run item
+func ProcessOutput(stack types.Stack, output []interface{}, result string) error {
+	state := app.FromStack(stack)
+	for _, v := range output {
+		switch v.(type) {
+		case string:
+			switch v.(string) {
+			case "stdout":
+				messagesChannel, listenerChannel := state.StdOut.StartOutputForObject()
+				state.StdOut.SendStringForObject(messagesChannel, result)
+				state.StdOut.FinishOutputForObject(messagesChannel, listenerChannel)
+			case "stderr":
+				messagesChannel, listenerChannel := state.StdErr.StartOutputForObject()
+				state.StdErr.SendStringForObject(messagesChannel, result)
+				state.StdErr.FinishOutputForObject(messagesChannel, listenerChannel)
+			}
+		case map[string]interface{}:
+			if yml2var, ok := v.(map[string]interface{})["yml2var"].(string); ok {
+				if err := YAMLToVar(stack, yml2var, result); err != nil {
+					return err
+				}
+			}
+			if str2var, ok := v.(map[string]interface{})["str2var"].(string); ok {
+				if err := StringToVar(stack, str2var, result); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// YAMLToVar parses result as yaml map and stores it by path (vars.a, flags, stack.locals.b)
+func YAMLToVar(stack types.Stack, path string, result string) error {
+	var value map[string]interface{}
+	if err := yaml.Unmarshal([]byte(result), &value); err != nil {
+		return fmt.Errorf("yml2var %s: %w", path, err)
+	}
+	return setVar(stack, path, value, true, "yml2var "+path)
+}
+
+// StringToVar stores result as string by path (vars.a, flags.b, stack.locals.c)
+func StringToVar(stack types.Stack, path string, result string) error {
+	return setVar(stack, path, result, false, "str2var "+path)
+}
+
+// setVar stores value by path. source is recorded as the origin of vars
+func setVar(stack types.Stack, path string, value interface{}, allowRoot bool, source string) (err error) {
+	target := strings.TrimPrefix(path, "stack.")
+	var kind, key string
+	for _, prefix := range []string{"vars", "flags", "locals"} {
+		if target == prefix || strings.HasPrefix(target, prefix+".") {
+			kind = prefix
+			key = strings.TrimPrefix(strings.TrimPrefix(target, prefix), ".")
+		}
+	}
+	if kind == "" || (key == "" && !allowRoot) {
+		return fmt.Errorf("Bad output var: %s", path)
+	}
+	setVar := gabs.New()
+	if key == "" {
+		setVar.Set(value)
+	} else {
+		setVar.SetP(value, key)
+	}
+	data, ok := setVar.Data().(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Bad output var: %s", path)
+	}
+	switch kind {
+	case "vars":
+		err = stack.AddRawVarsRight(data, source)
+	case "flags":
+		err = stack.AddFlags(data)
+	case "locals":
+		stack.GetLocals().Mux.Lock()
+		if stack.GetLocals().Vars == nil {
+			stack.GetLocals().Vars = make(map[string]interface{})
+		}
+		err = mergo.Merge(&stack.GetLocals().Vars, data, mergo.WithOverwriteWithEmptyValue)
+		stack.GetLocals().Mux.Unlock()
+	}
+	return
+}
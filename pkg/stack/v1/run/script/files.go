@@ -0,0 +1,48 @@
+package script
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// interpreters run the script file given as their first argument
+var interpreters = map[string]bool{
+	"sh": true, "bash": true, "zsh": true, "source": true, ".": true,
+	"python": true, "python3": true, "node": true, "ruby": true, "perl": true,
+}
+
+// Files returns script files run by the lines of script. Relative paths are
+// resolved in workdir. ok is false if a line runs a file whose path is known
+// only at run time, e.g. ./$NAME.sh or $STACK_ROOT/deploy.sh
+func Files(workdir, script string) (files []string, ok bool) {
+	ok = true
+	for _, line := range strings.Split(script, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		path := fields[0]
+		if interpreters[path] {
+			if len(fields) == 1 || strings.HasPrefix(fields[1], "-") {
+				continue
+			}
+			path = fields[1]
+		} else if !isPath(path) {
+			continue
+		}
+		if strings.ContainsAny(path, "$*?{}`~") {
+			ok = false
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workdir, path)
+		}
+		files = append(files, path)
+	}
+	return
+}
+
+func isPath(field string) bool {
+	return strings.HasPrefix(field, "./") || strings.HasPrefix(field, "../") ||
+		strings.HasPrefix(field, "$") && strings.Contains(field, "/")
+}
@@ -0,0 +1,28 @@
+package script
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFiles(t *testing.T) {
+	for _, test := range []struct {
+		script string
+		files  []string
+		ok     bool
+	}{
+		{"echo hello", nil, true},
+		{"./deploy.sh --dry-run", []string{"/stack/deploy.sh"}, true},
+		{"../common/run.sh\nbash scripts/build.sh\n. ./env.sh", []string{"/common/run.sh", "/stack/scripts/build.sh", "/stack/env.sh"}, true},
+		{"python3 /opt/tool.py", []string{"/opt/tool.py"}, true},
+		{"sh -c 'echo hello'", nil, true},
+		{"./$NAME.sh", nil, false},
+		{"$STACK_ROOT/deploy.sh", nil, false},
+		{"source ~/.profile\n./deploy.sh", []string{"/stack/deploy.sh"}, false},
+	} {
+		files, ok := Files("/stack", test.script)
+		if !reflect.DeepEqual(files, test.files) || ok != test.ok {
+			t.Errorf("Files(%q) = %q, %v, want %q, %v", test.script, files, ok, test.files, test.ok)
+		}
+	}
+}
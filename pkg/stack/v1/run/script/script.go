@@ -7,22 +7,19 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime/debug"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/Jeffail/gabs"
 	"github.com/davecgh/go-spew/spew"
-	"github.com/imdario/mergo"
 	"github.com/joeycumines/go-dotnotation/dotnotation"
 	"github.com/kruglovmax/stack/pkg/app"
 	"github.com/kruglovmax/stack/pkg/conditions"
 	"github.com/kruglovmax/stack/pkg/consts"
-	"github.com/kruglovmax/stack/pkg/log"
 	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/stack/v1/run"
 	"github.com/kruglovmax/stack/pkg/types"
-	"sigs.k8s.io/yaml"
 )
 
 // scriptItem type
@@ -34,6 +31,7 @@ type scriptItem struct {
 	Wait        string        `json:"wait,omitempty"`
 	RunTimeout  time.Duration `json:"runTimeout,omitempty"`
 	WaitTimeout time.Duration `json:"waitTimeout,omitempty"`
+	KillGrace   time.Duration `json:"killGrace,omitempty"`
 
 	rawItem map[string]interface{}
 	stack   types.Stack
@@ -48,113 +46,184 @@ func New(stack types.Stack, rawItem map[string]interface{}) types.RunItem {
 	return item
 }
 
+// Plan func
+func (item *scriptItem) Plan() *types.RunItemPlan {
+	return run.NewPlan("script", item.rawItem)
+}
+
 // Exec func
-func (item *scriptItem) Exec(parentWG *sync.WaitGroup) {
-	item.parse()
+func (item *scriptItem) Exec(parentWG *sync.WaitGroup) (err error) {
 	if parentWG != nil {
 		defer parentWG.Done()
 	}
-	if !conditions.When(item.stack, item.When) {
+	if err = item.parse(); err != nil {
 		return
 	}
-	if !conditions.Wait(item.stack, item.Wait, item.WaitTimeout) {
+	if !conditions.When(item.stack, item.When) {
+		run.Skip(item.stack, item, item.When)
 		return
 	}
-
-	varsFile, err := ioutil.TempFile("/tmp", "vars")
-	misc.CheckIfErr(err, item.stack)
-	defer os.Remove(varsFile.Name())
+	if ok, err := conditions.Wait(item.stack, item.Wait, item.WaitTimeout); !ok {
+		return types.WrapError(item.stack, item, consts.ExitCodeWaitTimeout, err)
+	}
+	var vars interface{}
 	switch item.Vars.(type) {
 	case map[string]interface{}:
-		err := ioutil.WriteFile(varsFile.Name(), []byte(misc.ToJSON(item.Vars.(map[string]interface{}))), 0600)
-		misc.CheckIfErr(err, item.stack)
+		vars = item.Vars
 	case string:
 		stackMap := item.stack.GetView().(map[string]interface{})
 		stackMap["stack"] = stackMap
-		vars, err := dotnotation.Get(stackMap, item.Vars.(string))
-		misc.CheckIfErr(err, item.stack)
-		err = ioutil.WriteFile(varsFile.Name(), []byte(misc.ToJSON(vars)), 0600)
-		misc.CheckIfErr(err, item.stack)
+		vars, err = dotnotation.Get(stackMap, item.Vars.(string))
+		if err != nil {
+			return
+		}
 	case nil:
-		err := ioutil.WriteFile(varsFile.Name(), []byte(misc.ToJSON(item.stack.GetView())), 0600)
-		misc.CheckIfErr(err, item.stack)
+		vars = item.stack.GetView()
 	default:
-		log.Logger.Trace().
+		app.FromStack(item.stack).Logger.Trace().
 			Msg(spew.Sdump(item))
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Msg("Unable to parse run item. Bad vars key")
+		return fmt.Errorf("Unable to parse run item. Bad vars key")
+	}
+
+	// script files are checked on cache hits, scripts running files unknown
+	// before the run are not cached
+	files, ok := Files(item.stack.GetWorkdir(), item.Script)
+	cacheKey := ""
+	if ok {
+		cacheKey = run.CacheKey(item.stack, item.rawItem, "script", vars, item.Script)
+	}
+	if cached, ok := run.CacheGet(item.stack, cacheKey); ok {
+		return run.ProcessOutput(item.stack, item.Output, cached)
+	}
+	var capture *strings.Builder
+	if cacheKey != "" {
+		capture = new(strings.Builder)
 	}
+
+	varsFile, err := ioutil.TempFile("/tmp", "vars")
+	if err != nil {
+		return
+	}
+	defer os.Remove(varsFile.Name())
+	varsJSON, err := misc.ToJSON(vars)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(varsFile.Name(), []byte(varsJSON), 0600)
+	if err != nil {
+		return
+	}
+
 	cmd := exec.Command("sh", "-c", item.Script)
 	cmd.Dir = item.stack.GetWorkdir()
+	// own process group, so cancellation reaches every child of the script
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	cmd.Env = append(os.Environ(),
 		fmt.Sprintf("STACK_VARS=%s", varsFile.Name()),
-		fmt.Sprintf("STACK_ROOT=%s", *app.App.Config.Workdir),
-		fmt.Sprintf("STACK_GITCLONE_DIR=%s", filepath.Join(*app.App.Config.Workdir, consts.GitCloneDir)),
+		fmt.Sprintf("STACK_ROOT=%s", app.FromStack(item.stack).Config.Workdir),
+		fmt.Sprintf("STACK_GITCLONE_DIR=%s", filepath.Join(app.FromStack(item.stack).Config.Workdir, consts.GitCloneDir)),
 	)
 	stderr, err := cmd.StderrPipe()
-	misc.CheckIfErr(err, item.stack)
+	if err != nil {
+		return
+	}
 	stdout, err := cmd.StdoutPipe()
-	misc.CheckIfErr(err, item.stack)
+	if err != nil {
+		return
+	}
 
 	stdoutBufio := bufio.NewScanner(stdout)
 	stderrBufio := bufio.NewScanner(stderr)
 
 	var wg sync.WaitGroup
+	var outputErr error
 	wg.Add(2)
-	go item.getScriptOutput(item.stack, stdoutBufio, &wg, false)
-	go item.getScriptOutput(item.stack, stderrBufio, &wg, true)
+	go func() {
+		defer wg.Done()
+		outputErr = item.getScriptOutput(item.stack, stdoutBufio, false, capture)
+	}()
+	go func() {
+		defer wg.Done()
+		item.getScriptOutput(item.stack, stderrBufio, true, nil)
+	}()
 
 	err = cmd.Start()
-	misc.CheckIfErr(err, item.stack)
+	if err != nil {
+		return
+	}
 
-	runTimeout := *app.App.Config.DefaultTimeout
+	runTimeout := app.FromStack(item.stack).Config.DefaultTimeout
 	if item.RunTimeout != 0 {
 		runTimeout = item.RunTimeout
 	}
-	if misc.WaitTimeout(&wg, runTimeout) {
-		log.Logger.Fatal().
+	outputDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(outputDone)
+	}()
+	select {
+	case <-outputDone:
+	case <-time.After(runTimeout):
+		item.terminate(cmd, outputDone)
+		return types.NewStackError(item.stack, item, consts.ExitCodeRunTimeout,
+			fmt.Errorf(consts.MessageRunTimeout, "Script", runTimeout))
+	case <-item.stack.GetContext().Done():
+		item.terminate(cmd, outputDone)
+		app.FromStack(item.stack).Logger.Warn().
 			Str("stack", item.stack.GetWorkdir()).
 			Str("script", item.Script).
-			Str("timeout", fmt.Sprint(runTimeout)).
-			Msg("Script waiting failed")
+			Msg(consts.MessageScriptCancelled)
+		item.stack.SetStatus("Cancelled")
+		return nil
 	}
 
 	err = cmd.Wait()
 	if err != nil {
-		log.Logger.Error().
+		app.FromStack(item.stack).Logger.Error().
 			Str("stack", item.stack.GetWorkdir()).
 			Str("script", item.Script).
 			Msg("Error in")
-
-		misc.PrintStackTrace(item.stack)
-		app.App.AppError = consts.ExitCodeScriptFailed
 		item.stack.SetStatus("ScriptError")
+		return types.NewStackError(item.stack, item, consts.ExitCodeScriptFailed, err)
 	}
+	if outputErr == nil && capture != nil {
+		run.CachePut(item.stack, cacheKey, strings.TrimSuffix(capture.String(), "\n"), files)
+	}
+	return outputErr
+}
+
+// terminate stops the process group of the script
+func (item *scriptItem) terminate(cmd *exec.Cmd, outputDone chan struct{}) {
+	misc.TerminateProcessGroup(cmd, outputDone, item.KillGrace)
+	cmd.Wait()
 }
 
-func (item *scriptItem) getScriptOutput(stack types.Stack, output *bufio.Scanner, wg *sync.WaitGroup, isErr bool) {
-	defer wg.Done()
+// getScriptOutput sends script output to outputs of the run item.
+// stdout is also written to capture if it is not nil
+func (item *scriptItem) getScriptOutput(stack types.Stack, output *bufio.Scanner, isErr bool, capture *strings.Builder) (err error) {
 	var outBuffer strings.Builder
 	yml2var := ""
 	str2var := ""
 	outputType := item.Output
-	stdoutMessagesChannel, stdoutListenerChannel := app.App.StdOut.StartOutputForObject()
-	stderrMessagesChannel, stderrListenerChannel := app.App.StdErr.StartOutputForObject()
+	state := app.FromStack(item.stack)
+	stdoutMessagesChannel, stdoutListenerChannel := state.StdOut.StartOutputForObject()
+	stderrMessagesChannel, stderrListenerChannel := state.StdErr.StartOutputForObject()
 
 	for output.Scan() {
 		line := output.Text()
+		if capture != nil {
+			capture.WriteString(line + "\n")
+		}
 		if isErr {
-			log.Logger.Error().Msg("SCRIPT STDERR: " + line)
+			app.FromStack(item.stack).Logger.Error().Msg("SCRIPT STDERR: " + line)
 		} else if outputType != nil {
 			for _, v := range outputType {
 				switch v.(type) {
 				case string:
 					if v.(string) == "stdout" {
-						app.App.StdOut.SendStringForObject(stdoutMessagesChannel, line)
+						state.StdOut.SendStringForObject(stdoutMessagesChannel, line)
 					} else if v.(string) == "stderr" {
-						app.App.StdErr.SendStringForObject(stderrMessagesChannel, line)
+						state.StdErr.SendStringForObject(stderrMessagesChannel, line)
 					}
 				case map[string]interface{}:
 					switch {
@@ -178,94 +247,22 @@ func (item *scriptItem) getScriptOutput(stack types.Stack, output *bufio.Scanner
 		}
 	}
 
+	state.StdOut.FinishOutputForObject(stdoutMessagesChannel, stdoutListenerChannel)
+	state.StdErr.FinishOutputForObject(stderrMessagesChannel, stderrListenerChannel)
+
 	if yml2var != "" {
-		var value map[string]interface{}
-		err := yaml.Unmarshal([]byte(outBuffer.String()), &value)
-		misc.CheckIfErr(err, item.stack)
-		switch {
-		case strings.HasPrefix(yml2var, "vars") || strings.HasPrefix(yml2var, "stack.vars"):
-			key := strings.TrimPrefix(yml2var, "stack.")
-			key = strings.TrimPrefix(strings.TrimPrefix(yml2var, "vars"), ".")
-			setVar := gabs.New()
-			if key == "" {
-				setVar.Set(value)
-			} else {
-				setVar.SetP(value, key)
-			}
-			stack.AddRawVarsRight(setVar.Data().(map[string]interface{}))
-		case strings.HasPrefix(yml2var, "flags") || strings.HasPrefix(yml2var, "stack.flags"):
-			key := strings.TrimPrefix(yml2var, "stack.")
-			key = strings.TrimPrefix(strings.TrimPrefix(yml2var, "flags"), ".")
-			setVar := gabs.New()
-			if key == "" {
-				setVar.Set(value)
-			} else {
-				setVar.SetP(value, key)
-			}
-			stack.GetFlags().Mux.Lock()
-			err := mergo.Merge(&stack.GetFlags().Vars, setVar.Data().(map[string]interface{}), mergo.WithOverwriteWithEmptyValue)
-			misc.CheckIfErr(err, item.stack)
-			stack.GetFlags().Mux.Unlock()
-		case strings.HasPrefix(yml2var, "locals") || strings.HasPrefix(yml2var, "stack.locals"):
-			key := strings.TrimPrefix(yml2var, "stack.")
-			key = strings.TrimPrefix(strings.TrimPrefix(yml2var, "locals"), ".")
-			setVar := gabs.New()
-			if key == "" {
-				setVar.Set(value)
-			} else {
-				setVar.SetP(value, key)
-			}
-			stack.GetLocals().Mux.Lock()
-			err := mergo.Merge(&stack.GetLocals().Vars, setVar.Data().(map[string]interface{}), mergo.WithOverwriteWithEmptyValue)
-			misc.CheckIfErr(err, item.stack)
-			stack.GetLocals().Mux.Unlock()
-		default:
-			log.Logger.Fatal().
-				Str("yml2var", yml2var).
-				Str("in stack", stack.GetWorkdir()).
-				Msg("Bad output var")
+		err = run.YAMLToVar(stack, yml2var, outBuffer.String())
+		if err != nil {
+			return
 		}
 	}
 	if str2var != "" {
-		value := outBuffer.String()
-		switch {
-		case strings.HasPrefix(str2var, "vars.") || strings.HasPrefix(str2var, "stack.vars."):
-			key := strings.TrimPrefix(yml2var, "stack.")
-			key = strings.TrimPrefix(str2var, "vars.")
-			setVar := gabs.New()
-			setVar.SetP(value, key)
-			stack.AddRawVarsRight(setVar.Data().(map[string]interface{}))
-		case strings.HasPrefix(str2var, "flags.") || strings.HasPrefix(str2var, "stack.flags."):
-			key := strings.TrimPrefix(yml2var, "stack.")
-			key = strings.TrimPrefix(str2var, "flags.")
-			setVar := gabs.New()
-			setVar.SetP(value, key)
-			stack.GetFlags().Mux.Lock()
-			err := mergo.Merge(&stack.GetFlags().Vars, setVar.Data().(map[string]interface{}), mergo.WithOverwriteWithEmptyValue)
-			misc.CheckIfErr(err, item.stack)
-			stack.GetFlags().Mux.Unlock()
-		case strings.HasPrefix(str2var, "locals.") || strings.HasPrefix(str2var, "stack.locals."):
-			key := strings.TrimPrefix(yml2var, "stack.")
-			key = strings.TrimPrefix(str2var, "locals.")
-			setVar := gabs.New()
-			setVar.SetP(value, key)
-			stack.GetLocals().Mux.Lock()
-			err := mergo.Merge(&stack.GetLocals().Vars, setVar.Data().(map[string]interface{}), mergo.WithOverwriteWithEmptyValue)
-			misc.CheckIfErr(err, item.stack)
-			stack.GetLocals().Mux.Unlock()
-		default:
-			log.Logger.Fatal().
-				Str("str2var", str2var).
-				Str("in stack", stack.GetWorkdir()).
-				Msg("Bad output var")
-		}
+		err = run.StringToVar(stack, str2var, outBuffer.String())
 	}
-
-	app.App.StdOut.FinishOutputForObject(stdoutMessagesChannel, stdoutListenerChannel)
-	app.App.StdErr.FinishOutputForObject(stderrMessagesChannel, stderrListenerChannel)
+	return
 }
 
-func (item *scriptItem) parse() {
+func (item *scriptItem) parse() (err error) {
 	tmplItem := item.rawItem
 	item.Script = item.rawItem["script"].(string)
 	item.Vars = tmplItem["vars"]
@@ -274,7 +271,7 @@ func (item *scriptItem) parse() {
 		case []interface{}:
 			item.Output = value.([]interface{})
 		default:
-			misc.CheckIfErr(fmt.Errorf("Bad output stack: %s", item.stack.GetWorkdir()), item.stack)
+			return fmt.Errorf("Bad output stack: %s", item.stack.GetWorkdir())
 		}
 	} else {
 		item.Output = []interface{}{""}
@@ -287,17 +284,26 @@ func (item *scriptItem) parse() {
 	if waitCondition != nil {
 		item.Wait = waitCondition.(string)
 	}
-	var err error
 	runTimeout := item.rawItem["runTimeout"]
-	item.RunTimeout = *app.App.Config.DefaultTimeout
+	item.RunTimeout = app.FromStack(item.stack).Config.DefaultTimeout
 	if runTimeout != nil {
 		item.RunTimeout, err = time.ParseDuration(runTimeout.(string))
-		misc.CheckIfErr(err, item.stack)
+		if err != nil {
+			return
+		}
 	}
 	waitTimeout := item.rawItem["waitTimeout"]
-	item.WaitTimeout = *app.App.Config.DefaultTimeout
+	item.WaitTimeout = app.FromStack(item.stack).Config.DefaultTimeout
 	if waitTimeout != nil {
 		item.WaitTimeout, err = time.ParseDuration(waitTimeout.(string))
-		misc.CheckIfErr(err, item.stack)
+		if err != nil {
+			return
+		}
+	}
+	killGrace := item.rawItem["killGrace"]
+	item.KillGrace = app.FromStack(item.stack).Config.KillGrace
+	if killGrace != nil {
+		item.KillGrace, err = time.ParseDuration(killGrace.(string))
 	}
+	return
 }
@@ -0,0 +1,12 @@
+package run
+
+import (
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+// Watch records files read by the run item for --watch
+func Watch(stack types.Stack, paths ...string) {
+	app.FromStack(stack).Watch.Add(misc.GetStackPathRelativeToTheRootStack(stack), paths...)
+}
@@ -1,10 +1,9 @@
 package schema
 
 import (
-	"runtime/debug"
+	"fmt"
+	"sync"
 
-	"github.com/davecgh/go-spew/spew"
-	"github.com/kruglovmax/stack/pkg/log"
 	jsonschema "github.com/xeipuuv/gojsonschema"
 	"sigs.k8s.io/yaml"
 )
@@ -122,6 +121,12 @@ definitions:
           wait: { "$ref": "#/definitions/when" }
           runTimeout: { "$ref": "#/definitions/timeout" }
           waitTimeout: { "$ref": "#/definitions/timeout" }
+          cache: { "$ref": "#/definitions/cache" }
+          cacheEnv: { "$ref": "#/definitions/cacheEnv" }
+          continueOnError: { "$ref": "#/definitions/continueOnError" }
+          retries: { "$ref": "#/definitions/retries" }
+          retryDelay: { "$ref": "#/definitions/timeout" }
+          retryBackoff: { "$ref": "#/definitions/retryBackoff" }
       - type: object
         additionalProperties: false
         minProperties: 1
@@ -144,6 +149,12 @@ definitions:
           wait: { "$ref": "#/definitions/when" }
           runTimeout: { "$ref": "#/definitions/timeout" }
           waitTimeout: { "$ref": "#/definitions/timeout" }
+          cache: { "$ref": "#/definitions/cache" }
+          cacheEnv: { "$ref": "#/definitions/cacheEnv" }
+          continueOnError: { "$ref": "#/definitions/continueOnError" }
+          retries: { "$ref": "#/definitions/retries" }
+          retryDelay: { "$ref": "#/definitions/timeout" }
+          retryBackoff: { "$ref": "#/definitions/retryBackoff" }
       - type: object
         additionalProperties: false
         minProperties: 1
@@ -164,6 +175,10 @@ definitions:
           wait: { "$ref": "#/definitions/when" }
           runTimeout: { "$ref": "#/definitions/timeout" }
           waitTimeout: { "$ref": "#/definitions/timeout" }
+          continueOnError: { "$ref": "#/definitions/continueOnError" }
+          retries: { "$ref": "#/definitions/retries" }
+          retryDelay: { "$ref": "#/definitions/timeout" }
+          retryBackoff: { "$ref": "#/definitions/retryBackoff" }
       - type: object
         additionalProperties: false
         minProperties: 1
@@ -177,6 +192,13 @@ definitions:
           wait: { "$ref": "#/definitions/when" }
           runTimeout: { "$ref": "#/definitions/timeout" }
           waitTimeout: { "$ref": "#/definitions/timeout" }
+          cache: { "$ref": "#/definitions/cache" }
+          cacheEnv: { "$ref": "#/definitions/cacheEnv" }
+          killGrace: { "$ref": "#/definitions/timeout" }
+          continueOnError: { "$ref": "#/definitions/continueOnError" }
+          retries: { "$ref": "#/definitions/retries" }
+          retryDelay: { "$ref": "#/definitions/timeout" }
+          retryBackoff: { "$ref": "#/definitions/retryBackoff" }
       - type: object
         additionalProperties: false
         minProperties: 1
@@ -194,6 +216,10 @@ definitions:
           wait: { "$ref": "#/definitions/when" }
           runTimeout: { "$ref": "#/definitions/timeout" }
           waitTimeout: { "$ref": "#/definitions/timeout" }
+          continueOnError: { "$ref": "#/definitions/continueOnError" }
+          retries: { "$ref": "#/definitions/retries" }
+          retryDelay: { "$ref": "#/definitions/timeout" }
+          retryBackoff: { "$ref": "#/definitions/retryBackoff" }
       - type: object
         additionalProperties: false
         minProperties: 1
@@ -204,8 +230,33 @@ definitions:
           wait: { "$ref": "#/definitions/when" }
           runTimeout: { "$ref": "#/definitions/timeout" }
           waitTimeout: { "$ref": "#/definitions/timeout" }
+          continueOnError: { "$ref": "#/definitions/continueOnError" }
+          retries: { "$ref": "#/definitions/retries" }
+          retryDelay: { "$ref": "#/definitions/timeout" }
+          retryBackoff: { "$ref": "#/definitions/retryBackoff" }
           parallel:
             type: boolean
+          maxParallel: { "$ref": "#/definitions/maxParallel" }
+      - type: object
+        additionalProperties: false
+        minProperties: 1
+        required: ["foreach", "run"]
+        properties:
+          foreach:
+            type: string
+            minLength: 1
+          run: { "$ref": "#/definitions/run" }
+          when: { "$ref": "#/definitions/when" }
+          wait: { "$ref": "#/definitions/when" }
+          runTimeout: { "$ref": "#/definitions/timeout" }
+          waitTimeout: { "$ref": "#/definitions/timeout" }
+          continueOnError: { "$ref": "#/definitions/continueOnError" }
+          retries: { "$ref": "#/definitions/retries" }
+          retryDelay: { "$ref": "#/definitions/timeout" }
+          retryBackoff: { "$ref": "#/definitions/retryBackoff" }
+          parallel:
+            type: boolean
+          maxParallel: { "$ref": "#/definitions/maxParallel" }
       #- oneOf:
       #  - type: object
       #    additionalProperties: false
@@ -262,17 +313,43 @@ definitions:
   varsFrom:
     type: array
     items:
-      anyOf:
-      - type: object
-        properties:
-          file:
-            type: string
-            minLength: 1
-      - type: object
-        properties:
-          sops:
-            type: string
-            minLength: 1
+      type: object
+      properties:
+        file:
+          type: string
+          minLength: 1
+        sops:
+          type: string
+          minLength: 1
+        env:
+          type: string
+          minLength: 1
+        dotenv:
+          type: string
+          minLength: 1
+        glob:
+          type: string
+          minLength: 1
+        exec:
+          type: string
+          minLength: 1
+        timeout: { "$ref": "#/definitions/timeout" }
+        format:
+          type: string
+          enum: ["yaml", "json", "toml"]
+        optional:
+          type: boolean
+        key:
+          type: string
+          minLength: 1
+      additionalProperties: false
+      oneOf:
+      - required: ["file"]
+      - required: ["sops"]
+      - required: ["env"]
+      - required: ["dotenv"]
+      - required: ["glob"]
+      - required: ["exec"]
   libs:
     oneOf:
     - type: string
@@ -303,6 +380,37 @@ definitions:
   timeout:
     type: string
     minLength: 2
+  continueOnError:
+    type: boolean
+  retries:
+    type: integer
+    minimum: 0
+  retryBackoff:
+    type: number
+    minimum: 1
+  maxParallel:
+    type: integer
+    minimum: 0
+  cache:
+    type: boolean
+  outputs:
+    type: object
+    patternProperties:
+      ".*":
+        type: string
+        minLength: 1
+  matrix:
+    oneOf:
+    - type: string
+      minLength: 1
+    - type: array
+    - type: object
+  cacheEnv:
+    type: array
+    uniqueItems: true
+    items:
+      type: string
+      minLength: 1
   stack:
     type: object
     additionalProperties: false
@@ -323,6 +431,13 @@ definitions:
       wait: { "$ref": "#/definitions/when" }
       waitGroups: { "$ref": "#/definitions/waitGroups" }
       waitTimeout: { "$ref": "#/definitions/timeout" }
+      continueOnError: { "$ref": "#/definitions/continueOnError" }
+      retries: { "$ref": "#/definitions/retries" }
+      retryDelay: { "$ref": "#/definitions/timeout" }
+      retryBackoff: { "$ref": "#/definitions/retryBackoff" }
+      maxParallel: { "$ref": "#/definitions/maxParallel" }
+      matrix: { "$ref": "#/definitions/matrix" }
+      outputs: { "$ref": "#/definitions/outputs" }
 
 
 allOf:
@@ -331,33 +446,30 @@ allOf:
 `
 )
 
-// ConfigSchema var
-var ConfigSchema *jsonschema.Schema
+var (
+	configSchema     *jsonschema.Schema
+	configSchemaErr  error
+	configSchemaOnce sync.Once
+)
 
-func mustCompileConfigSchema() *jsonschema.Schema {
+// ConfigSchema returns the compiled schema of stack files
+func ConfigSchema() (*jsonschema.Schema, error) {
+	configSchemaOnce.Do(func() {
+		configSchema, configSchemaErr = compileConfigSchema()
+	})
+	return configSchema, configSchemaErr
+}
+
+func compileConfigSchema() (*jsonschema.Schema, error) {
 	j, err := yaml.YAMLToJSON([]byte(configSchemaYAML))
 	if err != nil {
-		log.Logger.Trace().
-			Msg(spew.Sdump(configSchemaYAML))
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Msg(err.Error())
+		return nil, fmt.Errorf("stack schema: %w", err)
 	}
 	sl := jsonschema.NewSchemaLoader()
 	sl.Validate = false
 	schema, err := sl.Compile(jsonschema.NewBytesLoader(j))
 	if err != nil {
-		log.Logger.Trace().
-			Msg(spew.Sdump(j))
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Msg(err.Error())
+		return nil, fmt.Errorf("stack schema: %w", err)
 	}
-	return schema
-}
-
-func init() {
-	ConfigSchema = mustCompileConfigSchema()
+	return schema, nil
 }
@@ -0,0 +1,148 @@
+package stack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/kruglovmax/stack/pkg/checkpoint"
+	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+// checkpointKey identifies the stack by its path and name and the paths of its parents
+func (stack *Stack) checkpointKey() string {
+	var path []string
+	for item := types.Stack(stack); item != nil; item = item.GetParent() {
+		path = append([]string{misc.GetStackPathRelativeToTheRootStack(item) + ":" + item.GetName()}, path...)
+	}
+	key := strings.Join(path, " > ")
+	if stack.Input.Input != nil {
+		key = fmt.Sprintf("%s@%.12s", key, checkpoint.Fingerprint(stack.Input.Input))
+	}
+	return key
+}
+
+// stackCheckpoint is the checkpoint of the running stack
+type stackCheckpoint struct {
+	key         string
+	fingerprint string
+	// runItemsDone is set if preRun and run items of the stack finished in the previous run
+	runItemsDone bool
+}
+
+// flagReference matches flags.<name> in expressions, templates and scripts reading STACK_VARS
+var flagReference = regexp.MustCompile(`\bflags\.([A-Za-z_][A-Za-z0-9_]*)`)
+
+// checkpointFingerprint changes if the stack config, input or vars change,
+// if the stack file or files referenced by its run items change or
+// if flags referenced by them change
+func (stack *Stack) checkpointFingerprint() string {
+	files := stack.checkpointFiles()
+	hashes := checkpoint.Files(files)
+	flags := stack.readFlags(files)
+	stack.Vars.Mux.Lock()
+	defer stack.Vars.Mux.Unlock()
+	return checkpoint.Fingerprint(stack.config, stack.Input.Input, stack.Vars.Vars, hashes, flags)
+}
+
+// readFlags returns values of the flags referenced by the stack config and files
+func (stack *Stack) readFlags(files []string) map[string]interface{} {
+	config, _ := json.Marshal(stack.config)
+	sources := [][]byte{config}
+	for _, file := range files {
+		if content, err := ioutil.ReadFile(file); err == nil {
+			sources = append(sources, content)
+		}
+	}
+	flags := make(map[string]interface{})
+	stack.Flags.Mux.Lock()
+	defer stack.Flags.Mux.Unlock()
+	for _, source := range sources {
+		for _, match := range flagReference.FindAllSubmatch(source, -1) {
+			name := string(match[1])
+			flags[name] = misc.CopyValue(stack.Flags.Vars[name])
+		}
+	}
+	return flags
+}
+
+// checkpointFiles returns the stack file and templates and scripts of its run items
+func (stack *Stack) checkpointFiles() (files []string) {
+	if stack.file != "" {
+		files = append(files, stack.file)
+	}
+	var walk func(plan *types.RunItemPlan, names []string)
+	walk = func(plan *types.RunItemPlan, names []string) {
+		files = append(files, stack.runItemFiles(plan, names)...)
+		if plan.Type == "foreach" {
+			names = append(names, "item", "index")
+		}
+		for _, item := range plan.Items {
+			walk(item, names)
+		}
+	}
+	for _, runItems := range [][]types.RunItem{stack.PreRun, stack.Run, stack.PostRun} {
+		for _, runItem := range runItems {
+			walk(runItem.Plan(), nil)
+		}
+	}
+	return
+}
+
+// resume restores vars and flags of the stack from the checkpoint of a previous run.
+// If the whole stack finished then, done is true and its outputs are restored, its
+// run items are skipped and child stacks check their own checkpoints. Otherwise only
+// preRun and run items of the stack are skipped
+func (stack *Stack) resume() (done bool, err error) {
+	entry, ok := stack.state.Checkpoint.Get(stack.checkpoint.key, stack.checkpoint.fingerprint)
+	if !ok {
+		return false, nil
+	}
+	stack.state.Logger.Info().
+		Str("stack", stack.GetWorkdir()).
+		Bool("done", entry.Done).
+		Msg("Resumed from checkpoint")
+	if entry.Vars != nil {
+		stack.Vars.Mux.Lock()
+		stack.Vars.Vars = entry.Vars
+		stack.Vars.Mux.Unlock()
+	}
+	if err = stack.AddFlags(entry.Flags); err != nil {
+		return false, fmt.Errorf("Restoring flags from checkpoint: %w", err)
+	}
+	stack.checkpoint.runItemsDone = true
+	if !entry.Done {
+		return false, nil
+	}
+	stack.setOutputs(entry.Outputs)
+	stack.state.Report.StackSkipped(stack, "resumed from checkpoint")
+	return true, nil
+}
+
+// saveCheckpoint stores vars of the stack and flags written by it after its preRun
+// and run items finished. done marks the whole stack finished, outputs are stored then
+func (stack *Stack) saveCheckpoint(done bool) {
+	if stack.state.Checkpoint == nil {
+		return
+	}
+	entry := new(checkpoint.Entry)
+	entry.Fingerprint = stack.checkpoint.fingerprint
+	entry.Done = done
+	stack.Vars.Mux.Lock()
+	entry.Vars, _ = misc.CopyValue(stack.Vars.Vars).(map[string]interface{})
+	stack.Vars.Mux.Unlock()
+	stack.Flags.Mux.Lock()
+	entry.Flags, _ = misc.CopyValue(stack.writtenFlags).(map[string]interface{})
+	stack.Flags.Mux.Unlock()
+	if done {
+		entry.Outputs = stack.outputs
+	}
+	if err := stack.state.Checkpoint.Set(stack.checkpoint.key, entry); err != nil {
+		stack.state.Logger.Warn().
+			Str("stack", stack.GetWorkdir()).
+			Msg(err.Error())
+	}
+}
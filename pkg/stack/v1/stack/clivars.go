@@ -0,0 +1,96 @@
+package stack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/imdario/mergo"
+	"k8s.io/helm/pkg/strvals"
+
+	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/yamlpos"
+)
+
+// stdinFileName names stdin in errors of -f -
+const stdinFileName = "<stdin>"
+
+// loadVarsFile reads vars of -f. "-" reads the vars document from stdin
+func (stack *Stack) loadVarsFile(varsFile string) (varsMap map[string]interface{}, err error) {
+	if varsFile == "-" {
+		if err = misc.LoadYAML(string(stack.state.StdinVars), &varsMap); err != nil {
+			err = yamlpos.Wrap(stdinFileName, stack.state.StdinVars, err)
+		}
+		return
+	}
+	varsFile = stack.absPath(varsFile)
+	stack.watch(varsFile)
+	err = misc.LoadYAMLFromFile(varsFile, &varsMap)
+	return
+}
+
+// cliVars returns vars of --set, --set-string, --set-file and --set-json.
+// Later flags override earlier ones in this order.
+// source lists the flags the vars came from
+func (stack *Stack) cliVars() (cliVars map[string]interface{}, source string, err error) {
+	config := stack.state.Config
+	cliVars = make(map[string]interface{})
+	var flags []string
+	for _, set := range []struct {
+		flag   string
+		values []string
+		parse  func(string) (map[string]interface{}, error)
+	}{
+		{"--set", config.CLIValues, strvals.Parse},
+		{"--set-string", config.CLIStringValues, strvals.ParseString},
+		{"--set-file", config.CLIFileValues, stack.parseSetFile},
+		{"--set-json", config.CLIJSONValues, parseSetJSON},
+	} {
+		if len(set.values) > 0 {
+			flags = append(flags, set.flag)
+		}
+		for _, str := range set.values {
+			var varsMap map[string]interface{}
+			if varsMap, err = set.parse(str); err != nil {
+				return nil, "", fmt.Errorf("%s %s: %w", set.flag, str, err)
+			}
+			mergo.Merge(&cliVars, varsMap, mergo.WithOverwriteWithEmptyValue)
+		}
+	}
+	if len(flags) == 0 {
+		flags = append(flags, "--set")
+	}
+	return cliVars, strings.Join(flags, ", "), nil
+}
+
+// parseSetFile parses key=path, the value is the content of the file.
+// Paths are relative to the root stack
+func (stack *Stack) parseSetFile(str string) (map[string]interface{}, error) {
+	return strvals.ParseFile(str, func(runes []rune) (interface{}, error) {
+		path := string(runes)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(stack.Workdir, path)
+		}
+		stack.watch(path)
+		content, err := ioutil.ReadFile(path)
+		return string(content), err
+	})
+}
+
+// parseSetJSON parses key=json, the value is the decoded JSON
+func parseSetJSON(str string) (map[string]interface{}, error) {
+	parts := strings.SplitN(str, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("key=json is expected")
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(parts[1]), &value); err != nil {
+		return nil, err
+	}
+	// the key is parsed by strvals, the placeholder value is replaced by the decoded JSON
+	return strvals.ParseFile(parts[0]+"=json", func([]rune) (interface{}, error) {
+		return value, nil
+	})
+}
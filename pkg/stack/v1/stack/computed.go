@@ -0,0 +1,314 @@
+package stack
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kruglovmax/stack/pkg/cel"
+	"github.com/kruglovmax/stack/pkg/misc"
+)
+
+// computedExpression matches ${{ expression }}. $${{ is an escaped ${{
+var computedExpression = regexp.MustCompile(`\$?\$\{\{(.*?)\}\}`)
+
+// computedSections are keys of the stack view with computed values
+var computedSections = []string{"vars", "locals", "flags"}
+
+// computedValue is a string value with ${{ }} expressions
+type computedValue struct {
+	path     []string
+	template string
+	// refs are paths in computed sections read by the expressions
+	refs [][]string
+}
+
+func (value *computedValue) name() string {
+	return strings.Join(value.path, ".")
+}
+
+// computeValues replaces ${{ }} expressions in vars, locals and flags by their
+// values. Expressions are CEL evaluated in the stack view, values referenced
+// by an expression are computed before it. Vars inherited from the parent stack
+// and flags of other stacks are already computed by their stacks
+func (stack *Stack) computeValues(inputFlags map[string]interface{}) (err error) {
+	view := stack.GetView().(map[string]interface{})
+	for _, section := range computedSections {
+		if _, ok := view[section].(map[string]interface{}); !ok {
+			view[section] = make(map[string]interface{})
+		}
+	}
+	view["stack"] = view
+
+	var found, values []*computedValue
+	for _, section := range computedSections {
+		findComputedValues(view[section], []string{section}, &found)
+	}
+	var parentVars map[string]interface{}
+	if stack.parentStack != nil {
+		stack.parentStack.GetVars().Mux.Lock()
+		parentVars = stack.parentStack.GetVars().Vars
+		stack.parentStack.GetVars().Mux.Unlock()
+	}
+	for _, value := range found {
+		switch value.path[0] {
+		case "vars":
+			if inherited, ok := lookupValue(parentVars, value.path[1:]); ok && inherited == value.template {
+				continue
+			}
+		case "flags":
+			if own, ok := lookupValue(inputFlags, value.path[1:]); !ok || own != value.template {
+				continue
+			}
+		}
+		values = append(values, value)
+	}
+	if len(values) == 0 {
+		return
+	}
+	for _, value := range values {
+		if value.refs, err = computedRefs(value.template); err != nil {
+			return stack.positionError(value.path, fmt.Errorf("%s: %w", value.name(), err))
+		}
+	}
+	order, err := computeOrder(values)
+	if err != nil {
+		return stack.positionError(order[0].path, err)
+	}
+
+	computed := make(map[*computedValue]interface{}, len(order))
+	for _, value := range order {
+		var result interface{}
+		if result, err = computeTemplate(value.template, view); err != nil {
+			return stack.positionError(value.path, fmt.Errorf("%s: %w", value.name(), err))
+		}
+		computed[value] = result
+		view[value.path[0]] = setValue(view[value.path[0]], value.path[1:], result)
+	}
+
+	for _, value := range order {
+		switch value.path[0] {
+		case "vars":
+			stack.Vars.Mux.Lock()
+			stack.Vars.Vars = setValue(stack.Vars.Vars, value.path[1:], computed[value]).(map[string]interface{})
+			stack.Vars.Mux.Unlock()
+		case "locals":
+			stack.Locals.Mux.Lock()
+			stack.Locals.Vars = setValue(stack.Locals.Vars, value.path[1:], computed[value]).(map[string]interface{})
+			stack.Locals.Mux.Unlock()
+		case "flags":
+			stack.Flags.Mux.Lock()
+			stack.Flags.Vars = setValue(stack.Flags.Vars, value.path[1:], computed[value]).(map[string]interface{})
+			stack.Flags.Mux.Unlock()
+		}
+	}
+	return
+}
+
+// findComputedValues collects strings with expressions in maps and lists of value
+func findComputedValues(value interface{}, path []string, values *[]*computedValue) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			findComputedValues(item, append(path[:len(path):len(path)], key), values)
+		}
+	case []interface{}:
+		for i, item := range value {
+			findComputedValues(item, append(path[:len(path):len(path)], strconv.Itoa(i)), values)
+		}
+	case string:
+		if computedExpression.MatchString(value) {
+			*values = append(*values, &computedValue{path: path, template: value})
+		}
+	}
+}
+
+// computedRefs returns paths in computed sections read by expressions of the template.
+// stack.vars.a is the same as vars.a
+func computedRefs(template string) (refs [][]string, err error) {
+	for _, match := range computedExpression.FindAllStringSubmatch(template, -1) {
+		if strings.HasPrefix(match[0], "$$") {
+			continue
+		}
+		var paths [][]string
+		if paths, err = cel.References(match[1]); err != nil {
+			return
+		}
+		for _, path := range paths {
+			for len(path) > 1 && path[0] == "stack" {
+				path = path[1:]
+			}
+			for _, section := range computedSections {
+				if path[0] == section {
+					refs = append(refs, path)
+				}
+			}
+		}
+	}
+	return
+}
+
+// computeOrder returns values ordered by their dependencies.
+// On a cycle the values of the cycle are returned with the error
+func computeOrder(values []*computedValue) (order []*computedValue, err error) {
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].name() < values[j].name()
+	})
+	const (
+		visiting = 1
+		done     = 2
+	)
+	states := make(map[*computedValue]int, len(values))
+	var path []*computedValue
+	var visit func(value *computedValue) error
+	visit = func(value *computedValue) error {
+		switch states[value] {
+		case done:
+			return nil
+		case visiting:
+			var cycle []*computedValue
+			for i := range path {
+				if path[i] == value {
+					cycle = path[i:]
+					break
+				}
+			}
+			names := make([]string, 0, len(cycle)+1)
+			for _, item := range cycle {
+				names = append(names, item.name())
+			}
+			names = append(names, value.name())
+			order = cycle
+			return fmt.Errorf("Cycle of computed values: %s", strings.Join(names, " -> "))
+		}
+		states[value] = visiting
+		path = append(path, value)
+		for _, dependency := range values {
+			if dependsOn(value, dependency) {
+				if err := visit(dependency); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		states[value] = done
+		order = append(order, value)
+		return nil
+	}
+	for _, value := range values {
+		if err = visit(value); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// dependsOn reports whether value reads dependency, its parents or its children
+func dependsOn(value, dependency *computedValue) bool {
+	for _, ref := range value.refs {
+		if isPathPrefix(ref, dependency.path) || isPathPrefix(dependency.path, ref) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPathPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// computeTemplate evaluates expressions of the template. The template consisting
+// of a single expression gets the value of any type, others are strings
+func computeTemplate(template string, view map[string]interface{}) (interface{}, error) {
+	matches := computedExpression.FindAllStringSubmatchIndex(template, -1)
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(template) && !strings.HasPrefix(template, "$$") {
+		return cel.ComputeCELNative(template[matches[0][2]:matches[0][3]], view)
+	}
+	var output strings.Builder
+	last := 0
+	for _, match := range matches {
+		output.WriteString(template[last:match[0]])
+		last = match[1]
+		if strings.HasPrefix(template[match[0]:], "$$") {
+			output.WriteString(template[match[0]+1 : match[1]])
+			continue
+		}
+		result, err := cel.ComputeCELNative(template[match[2]:match[3]], view)
+		if err != nil {
+			return nil, err
+		}
+		switch result.(type) {
+		case string:
+			output.WriteString(result.(string))
+		case map[string]interface{}, []interface{}:
+			text, err := misc.ToJSON(result)
+			if err != nil {
+				return nil, err
+			}
+			output.WriteString(text)
+		default:
+			output.WriteString(fmt.Sprint(result))
+		}
+	}
+	output.WriteString(template[last:])
+	return output.String(), nil
+}
+
+// lookupValue returns the value at path in maps and lists of container
+func lookupValue(container interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch value := container.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if container, ok = value[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(value) {
+				return nil, false
+			}
+			container = value[index]
+		default:
+			return nil, false
+		}
+	}
+	return container, true
+}
+
+// setValue returns container with value at path. Maps and lists on the path
+// are copied, the values may be shared with parent stacks
+func setValue(container interface{}, path []string, value interface{}) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+	switch container := container.(type) {
+	case map[string]interface{}:
+		output := make(map[string]interface{}, len(container))
+		for key, item := range container {
+			output[key] = item
+		}
+		output[path[0]] = setValue(container[path[0]], path[1:], value)
+		return output
+	case []interface{}:
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 || index >= len(container) {
+			return container
+		}
+		output := make([]interface{}, len(container))
+		copy(output, container)
+		output[index] = setValue(container[index], path[1:], value)
+		return output
+	}
+	return container
+}
@@ -0,0 +1,215 @@
+package stack
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/consts"
+)
+
+func TestComputeTemplate(t *testing.T) {
+	view := map[string]interface{}{
+		"name": "web",
+		"vars": map[string]interface{}{
+			"port": 8080,
+			"tags": []interface{}{"a", "b"},
+		},
+	}
+	for template, want := range map[string]interface{}{
+		"${{ vars.port }}":                      int64(8080),
+		"${{ vars.tags }}":                      []interface{}{"a", "b"},
+		"${{ name }}:${{ vars.port }}":          "web:8080",
+		"tags ${{ vars.tags }}":                 `tags ["a","b"]`,
+		"$${{ name }} is ${{ name }}":           "${{ name }} is web",
+		"$${{ name }}":                          "${{ name }}",
+		"${{ name + '-' + string(vars.port) }}": "web-8080",
+	} {
+		got, err := computeTemplate(template, view)
+		if err != nil {
+			t.Errorf("computeTemplate(%q): %v", template, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("computeTemplate(%q) = %#v, want %#v", template, got, want)
+		}
+	}
+	if _, err := computeTemplate("${{ nosuch }}", view); err == nil {
+		t.Error("computeTemplate with an undeclared reference returned no error")
+	}
+}
+
+func TestComputedRefs(t *testing.T) {
+	refs, err := computedRefs("${{ vars.a.b + stack.locals.c }} $${{ flags.d }} ${{ input }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"vars", "a", "b"}, {"locals", "c"}}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("computedRefs = %v, want %v", refs, want)
+	}
+}
+
+func TestComputeOrder(t *testing.T) {
+	a := &computedValue{path: []string{"vars", "a"}, refs: [][]string{{"vars", "b"}}}
+	b := &computedValue{path: []string{"vars", "b", "c"}, refs: [][]string{{"locals", "d"}}}
+	d := &computedValue{path: []string{"locals", "d"}}
+	order, err := computeOrder([]*computedValue{a, b, d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []*computedValue{d, b, a}) {
+		t.Errorf("computeOrder = %v, want locals.d, vars.b.c, vars.a", names(order))
+	}
+
+	d.refs = [][]string{{"vars", "a"}}
+	order, err = computeOrder([]*computedValue{a, b, d})
+	if err == nil {
+		t.Fatal("computeOrder with a cycle returned no error")
+	}
+	if !strings.Contains(err.Error(), "locals.d -> vars.a -> vars.b.c -> locals.d") {
+		t.Errorf("cycle error = %v", err)
+	}
+	if len(order) != 3 {
+		t.Errorf("values of the cycle = %v", names(order))
+	}
+}
+
+func TestSetValueCopies(t *testing.T) {
+	shared := map[string]interface{}{
+		"a":    map[string]interface{}{"b": "old"},
+		"list": []interface{}{"x", "y"},
+	}
+	output := setValue(shared, []string{"a", "b"}, "new").(map[string]interface{})
+	output = setValue(output, []string{"list", "1"}, "z").(map[string]interface{})
+	if value, _ := lookupValue(output, []string{"a", "b"}); value != "new" {
+		t.Errorf("a.b = %v, want new", value)
+	}
+	if value, _ := lookupValue(output, []string{"list", "1"}); value != "z" {
+		t.Errorf("list.1 = %v, want z", value)
+	}
+	if value, _ := lookupValue(shared, []string{"a", "b"}); value != "old" {
+		t.Errorf("setValue changed the shared map: a.b = %v", value)
+	}
+	if value, _ := lookupValue(shared, []string{"list", "1"}); value != "y" {
+		t.Errorf("setValue changed the shared list: list.1 = %v", value)
+	}
+	if _, ok := lookupValue(shared, []string{"list", "2"}); ok {
+		t.Error("lookupValue found an element out of the list")
+	}
+}
+
+func TestComputeValuesWithInput(t *testing.T) {
+	root := loadTestStack(t, map[string]string{
+		"stack.yaml": `api: v1
+vars:
+  regions: [eu, us]
+  domain: example.com
+  url: "https://${{ vars.domain }}"
+  computed: "${{ locals.size * 2.0 }}"
+  escaped: "$${{ vars.domain }}"
+locals:
+  size: 2
+stacks:
+- child
+`,
+		"child/stack.yaml": `api: v1
+matrix: vars.regions
+vars:
+  region: "${{ input }}"
+  host: "${{ input + '.' + vars.domain }}"
+`,
+	})
+	vars := root.Vars.Vars
+	for key, want := range map[string]interface{}{
+		"url":      "https://example.com",
+		"computed": float64(4),
+		"escaped":  "${{ vars.domain }}",
+	} {
+		if !reflect.DeepEqual(vars[key], want) {
+			t.Errorf("vars.%s = %#v, want %#v", key, vars[key], want)
+		}
+	}
+
+	children, err := ParseStacks(root, "stacks", root.config.Stacks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 2 {
+		t.Fatalf("matrix loaded %d stacks, want 2", len(children))
+	}
+	for i, region := range []string{"eu", "us"} {
+		child := children[i].(*Stack)
+		if child.Name != "child-"+region {
+			t.Errorf("name = %s, want child-%s", child.Name, region)
+		}
+		if child.Vars.Vars["region"] != region || child.Vars.Vars["host"] != region+".example.com" {
+			t.Errorf("vars of %s = %v", child.Name, child.Vars.Vars)
+		}
+	}
+}
+
+func TestComputeValuesCycle(t *testing.T) {
+	dir := writeTestStack(t, map[string]string{
+		"stack.yaml": `api: v1
+vars:
+  a: "${{ vars.b }}"
+  b: "${{ vars.a }}"
+`,
+	})
+	stack := New(newTestState(dir))
+	err := stack.LoadFromFile(filepath.Join(dir, "stack.yaml"), nil)
+	if err == nil {
+		t.Fatal("LoadFromFile with a cycle of computed values returned no error")
+	}
+	if !strings.Contains(err.Error(), "stack.yaml:3:3: Cycle of computed values: vars.a -> vars.b -> vars.a") {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func names(values []*computedValue) (output []string) {
+	for _, value := range values {
+		output = append(output, value.name())
+	}
+	return
+}
+
+func newTestState(dir string) *app.State {
+	return app.New(context.Background(), &app.Config{Workdir: dir, DefaultTimeout: consts.DefaultTimeout}, ioutil.Discard, ioutil.Discard, zerolog.Nop())
+}
+
+func writeTestStack(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "stack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func loadTestStack(t *testing.T, files map[string]string) *Stack {
+	t.Helper()
+	dir := writeTestStack(t, files)
+	stack := New(newTestState(dir))
+	if err := stack.LoadFromFile(filepath.Join(dir, "stack.yaml"), nil); err != nil {
+		t.Fatal(err)
+	}
+	return stack
+}
@@ -0,0 +1,107 @@
+package stack
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestForeach(t *testing.T) {
+	root := loadTestStack(t, map[string]string{
+		"stack.yaml": `api: v1
+vars:
+  regions: [eu, us, ap]
+  sizes: {small: 1, large: 3}
+run:
+- foreach: vars.regions
+  run:
+  - gomplate: '{{ file.Write (printf "list-%v" .index) .item }}'
+    when: item != "us"
+- foreach: vars.sizes
+  run:
+  - gomplate: '{{ file.Write (printf "map-%v" .index) .item }}'
+`,
+	})
+	if err := root.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(root.Workdir, "*-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(map[string]string)
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written[filepath.Base(file)] = string(content)
+	}
+	want := map[string]string{
+		"list-0":    "eu",
+		"list-2":    "ap",
+		"map-large": "3",
+		"map-small": "1",
+	}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("written = %v, want %v", written, want)
+	}
+}
+
+func TestForeachParallel(t *testing.T) {
+	root := loadTestStack(t, map[string]string{
+		"stack.yaml": `api: v1
+run:
+- foreach: '[1, 2, 3, 4, 5]'
+  parallel: true
+  maxParallel: 2
+  run:
+  - script: echo + >> log; sleep 0.1; echo - >> log
+`,
+	})
+	if err := root.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	log, err := ioutil.ReadFile(filepath.Join(root.Workdir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Fields(string(log))
+	running, max := 0, 0
+	for _, line := range lines {
+		if line == "+" {
+			running++
+		} else {
+			running--
+		}
+		if running > max {
+			max = running
+		}
+	}
+	if len(lines) != 10 || max > 2 {
+		t.Errorf("%d of 5 iterations ran, %d at the same time, want at most 2", len(lines)/2, max)
+	}
+}
+
+func TestForeachStopsOnError(t *testing.T) {
+	root := loadTestStack(t, map[string]string{
+		"stack.yaml": `api: v1
+run:
+- foreach: '[1, 2, 3]'
+  run:
+  - script: echo $(jq .item $STACK_VARS) >> log; test $(jq .index $STACK_VARS) != 1
+`,
+	})
+	if err := root.Start(nil); err == nil {
+		t.Fatal("foreach with a failed iteration returned no error")
+	}
+	log, err := ioutil.ReadFile(filepath.Join(root.Workdir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iterations := strings.Fields(string(log)); !reflect.DeepEqual(iterations, []string{"1", "2"}) {
+		t.Errorf("iterations = %v, want [1 2]", iterations)
+	}
+}
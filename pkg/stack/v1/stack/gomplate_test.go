@@ -0,0 +1,60 @@
+package stack
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestGomplateNestedStackPaths(t *testing.T) {
+	root := loadTestStack(t, map[string]string{
+		"stack.yaml":        "api: v1\nstacks:\n- nested\n",
+		"nested/stack.yaml": "api: v1\nstacks:\n- child\n",
+		"nested/child/stack.yaml": `api: v1
+run:
+- gomplate: >-
+    {{ defineDatasource "config" "config.yaml" -}}
+    {{ (ds "config").name }}|{{ include "config" | strings.TrimSpace }}|{{ file.Read "local.txt" }}|{{ filepath.Abs "local.txt" }}
+  output:
+  - str2var: vars.rendered
+`,
+		"nested/child/config.yaml": "name: child\n",
+		"nested/child/local.txt":   "local",
+	})
+	if err := root.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	child := root.Stacks[0].(*Stack).Stacks[0].(*Stack)
+	want := "child|name: child|local|" + filepath.Join(child.Workdir, "local.txt")
+	if rendered := child.Vars.Vars["rendered"]; rendered != want {
+		t.Errorf("rendered = %q, want %q", rendered, want)
+	}
+}
+
+func TestGomplateWrite(t *testing.T) {
+	for path, ok := range map[string]bool{
+		"out/file.txt":   true,
+		"../shared.txt":  true,
+		"../../outside":  false,
+		"/tmp/stack-abs": false,
+	} {
+		root := loadTestStack(t, map[string]string{
+			"stack.yaml": "api: v1\nstacks:\n- child\n",
+			"child/stack.yaml": `api: v1
+run:
+- gomplate: '{{ file.Write "` + path + `" "content" }}'
+`,
+		})
+		err := root.Start(nil)
+		if (err == nil) != ok {
+			t.Errorf("file.Write %q: %v, want success %v", path, err, ok)
+		}
+		if !ok {
+			continue
+		}
+		child := root.Stacks[0].(*Stack)
+		if content, err := ioutil.ReadFile(filepath.Join(child.Workdir, path)); err != nil || string(content) != "content" {
+			t.Errorf("file.Write %q wrote %q, %v", path, content, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package stack
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kruglovmax/stack/pkg/scheduler"
+)
+
+func TestNestedParallelStacksJobs(t *testing.T) {
+	const jobs = 2
+	script := `run:
+- script: echo + >> $STACK_ROOT/log; sleep 0.1; echo - >> $STACK_ROOT/log
+`
+	files := map[string]string{
+		"stack.yaml": "api: v1\npstacks: [a, b, c]\n",
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		files[name+"/stack.yaml"] = "api: v1\npstacks: [p, q]\n" + script
+		for _, child := range []string{"p", "q"} {
+			files[name+"/"+child+"/stack.yaml"] = "api: v1\nmaxParallel: 2\n" + script
+		}
+	}
+	dir := writeTestStack(t, files)
+	state := newTestState(dir)
+	state.Jobs = scheduler.New(jobs)
+	root := New(state)
+	if err := root.LoadFromFile(filepath.Join(dir, "stack.yaml"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	log, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, max := 0, 0
+	for _, line := range strings.Fields(string(log)) {
+		if line == "+" {
+			running++
+		} else {
+			running--
+		}
+		if running > max {
+			max = running
+		}
+	}
+	if strings.Count(string(log), "+") != 9 {
+		t.Errorf("log = %q, want 9 scripts", log)
+	}
+	if max > jobs {
+		t.Errorf("%d scripts ran at the same time, want at most %d", max, jobs)
+	}
+}
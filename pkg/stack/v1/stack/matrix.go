@@ -0,0 +1,120 @@
+package stack
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/kruglovmax/stack/pkg/cel"
+	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+type matrixElement struct {
+	suffix string
+	input  interface{}
+}
+
+// expandMatrix loads one stack per element of matrix. Every instance gets
+// the element as input and a name suffix. Stacks without matrix are loaded once
+// with input. The matrix is evaluated before loading, so an empty matrix
+// registers no stack
+func expandMatrix(parentStack types.Stack, name string, matrix, input interface{}, load func(input interface{}, nameSuffix string) (*Stack, error)) (output []types.Stack, err error) {
+	if matrix == nil {
+		newStack, err := load(input, "")
+		if err != nil {
+			return nil, err
+		}
+		return []types.Stack{newStack}, nil
+	}
+	elements, err := matrixElements(parentStack, matrix)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	for _, element := range elements {
+		newStack, err := load(element.input, "-"+element.suffix)
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, newStack)
+	}
+	return
+}
+
+// stackFileMatrix reads matrix of the stack file. Files that can't be read are
+// reported as having no matrix, loading the stack reports the error
+func stackFileMatrix(stackFile string) interface{} {
+	var config struct {
+		Matrix interface{} `json:"matrix,omitempty"`
+	}
+	if err := misc.LoadYAMLFromFile(stackFile, &config); err != nil {
+		return nil
+	}
+	return config.Matrix
+}
+
+// matrixElements evaluates matrix in the view of the parent stack.
+// List elements become input as is, map entries become {key, value}
+func matrixElements(parentStack types.Stack, matrix interface{}) (elements []matrixElement, err error) {
+	if expression, ok := matrix.(string); ok {
+		stackMap := parentStack.GetView().(map[string]interface{})
+		stackMap["stack"] = stackMap
+		matrix, err = cel.ComputeCELNative(expression, stackMap)
+		if err != nil {
+			return nil, fmt.Errorf("matrix: %w", err)
+		}
+	}
+	switch matrix := matrix.(type) {
+	case []interface{}:
+		for i, suffix := range listSuffixes(matrix) {
+			elements = append(elements, matrixElement{suffix: suffix, input: matrix[i]})
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(matrix))
+		for key := range matrix {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			elements = append(elements, matrixElement{
+				suffix: key,
+				input: map[string]interface{}{
+					"key":   key,
+					"value": matrix[key],
+				},
+			})
+		}
+	default:
+		return nil, fmt.Errorf("matrix must be a list or a map, got %T", matrix)
+	}
+	return
+}
+
+// listSuffixes returns unique suffixes of list elements. A scalar element gets its value
+// unless an earlier element has the same value. Other elements get the index, or the
+// index with a counter if the index is the value of another element
+func listSuffixes(list []interface{}) []string {
+	suffixes := make([]string, len(list))
+	used := make(map[string]bool)
+	for i, value := range list {
+		switch value.(type) {
+		case string, bool, int, int64, uint64, float64:
+			if s := fmt.Sprint(value); s != "" && !used[s] {
+				suffixes[i] = s
+				used[s] = true
+			}
+		}
+	}
+	for i := range list {
+		if suffixes[i] != "" {
+			continue
+		}
+		suffix := strconv.Itoa(i)
+		for n := 1; used[suffix]; n++ {
+			suffix = fmt.Sprintf("%d-%d", i, n)
+		}
+		suffixes[i] = suffix
+		used[suffix] = true
+	}
+	return suffixes
+}
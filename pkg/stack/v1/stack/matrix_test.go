@@ -0,0 +1,67 @@
+package stack
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListSuffixes(t *testing.T) {
+	for _, test := range []struct {
+		list []interface{}
+		want []string
+	}{
+		{[]interface{}{"eu", "us"}, []string{"eu", "us"}},
+		{[]interface{}{"1", "a", "1", float64(1)}, []string{"1", "a", "2", "3"}},
+		{[]interface{}{"2", "a", "2"}, []string{"2", "a", "2-1"}},
+		{[]interface{}{"1", "1", "1"}, []string{"1", "1-1", "2"}},
+		{[]interface{}{map[string]interface{}{"a": 1}, "0", ""}, []string{"0-1", "0", "2"}},
+		{[]interface{}{true, false, "true"}, []string{"true", "false", "2"}},
+	} {
+		if suffixes := listSuffixes(test.list); !reflect.DeepEqual(suffixes, test.want) {
+			t.Errorf("listSuffixes(%v) = %q, want %q", test.list, suffixes, test.want)
+		}
+	}
+}
+
+func TestMatrixExpansion(t *testing.T) {
+	root := loadTestStack(t, map[string]string{
+		"stack.yaml": `api: v1
+stacks:
+- name: app
+  matrix: ["2", "a", "2"]
+  run: []
+- name: db
+  matrix:
+    main: 100
+    replica: 50
+  run: []
+- name: empty
+  matrix: vars.regions
+  run: []
+vars:
+  regions: []
+`,
+	})
+	stacks, err := ParseStacks(root, "stacks", root.config.Stacks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var inputs []interface{}
+	for _, stack := range stacks {
+		names = append(names, stack.GetName())
+		inputs = append(inputs, stack.GetInput().Input)
+	}
+	wantNames := []string{"app-2", "app-a", "app-2-1", "db-main", "db-replica"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("names = %q, want %q", names, wantNames)
+	}
+	wantInputs := []interface{}{
+		"2", "a", "2",
+		map[string]interface{}{"key": "main", "value": float64(100)},
+		map[string]interface{}{"key": "replica", "value": float64(50)},
+	}
+	if !reflect.DeepEqual(inputs, wantInputs) {
+		t.Errorf("inputs = %v, want %v", inputs, wantInputs)
+	}
+}
@@ -0,0 +1,127 @@
+package stack
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/kruglovmax/stack/pkg/stack/v1/vars"
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+// initVarOrigins starts tracking origins of vars if vars are explained
+func (stack *Stack) initVarOrigins(rawVars map[string]interface{}) (err error) {
+	if stack.state.Config.ExplainVars == "" {
+		return
+	}
+	source := "vars of inline stack " + stack.Name
+	if stack.file != "" {
+		source = "vars in " + stack.relativePath(stack.file)
+	}
+	stack.varOrigins, err = vars.ParseVars(vars.TagVars(rawVars, stack.varOrigin(source)), nil)
+	return
+}
+
+// addVarOrigins mirrors AddRawVarsLeft and AddRawVarsRight on origins of vars
+func (stack *Stack) addVarOrigins(rawVars map[string]interface{}, source string, left bool) error {
+	if stack.varOrigins == nil {
+		return nil
+	}
+	parsedOrigins, err := vars.ParseVars(vars.TagVars(rawVars, stack.varOrigin(source)), nil)
+	if err != nil {
+		return err
+	}
+	if left {
+		stack.varOrigins = vars.CombineVars(parsedOrigins, stack.varOrigins)
+	} else {
+		stack.varOrigins = vars.CombineVars(stack.varOrigins, parsedOrigins)
+	}
+	return nil
+}
+
+// inheritVarOrigins mirrors combining vars of the parent stack with the stack vars
+func (stack *Stack) inheritVarOrigins(parentStack types.Stack) {
+	parent, ok := parentStack.(*Stack)
+	if stack.varOrigins == nil || !ok || parent.varOrigins == nil {
+		return
+	}
+	stack.varOrigins = vars.CombineVars(parent.varOrigins, stack.varOrigins)
+}
+
+func (stack *Stack) varOrigin(source string) *types.VarOrigin {
+	return &types.VarOrigin{
+		Stack:  stack.pathFromRoot(),
+		Source: source,
+	}
+}
+
+// ExplainVars returns resolved vars of the stack with their origins.
+// Origins are known only if the run explains vars of the stack
+func (stack *Stack) ExplainVars() *types.ExplainedStackVars {
+	stack.Vars.Mux.Lock()
+	defer stack.Vars.Mux.Unlock()
+	return &types.ExplainedStackVars{
+		Path: stack.pathFromRoot(),
+		Name: stack.Name,
+		Vars: vars.Explain(stack.Vars, stack.varOrigins),
+	}
+}
+
+// collectExplainedVars saves vars of the explained stack when it is finished
+func (stack *Stack) collectExplainedVars() {
+	if stack.varOrigins == nil || stack.pathFromRoot() != filepath.Clean(stack.state.Config.ExplainVars) {
+		return
+	}
+	explained := stack.ExplainVars()
+	stack.state.ExplainedVars.Mux.Lock()
+	stack.state.ExplainedVars.Stacks = append(stack.state.ExplainedVars.Stacks, explained)
+	stack.state.ExplainedVars.Mux.Unlock()
+}
+
+// FindStacks loads child stacks down to stackPath without executing anything.
+// Returns all stacks with this path: matrix instances and inline stacks share it
+func (stack *Stack) FindStacks(stackPath string) (output []types.Stack, err error) {
+	stackPath = filepath.Clean(stackPath)
+	if stack.pathFromRoot() == stackPath {
+		output = append(output, stack)
+	}
+	for _, input := range []struct {
+		key   string
+		items []interface{}
+	}{{"stacks", stack.config.Stacks}, {"pstacks", stack.config.ParallelStacks}} {
+		var children []types.Stack
+		children, err = ParseStacks(stack, input.key, input.items)
+		if err != nil {
+			return
+		}
+		for _, child := range children {
+			child, ok := child.(*Stack)
+			if !ok {
+				continue
+			}
+			childPath := child.pathFromRoot()
+			switch {
+			case childPath == stack.pathFromRoot():
+				// inline stacks
+			case childPath == stackPath:
+			case childPath == ".." || strings.HasPrefix(stackPath, childPath+"/") || strings.HasPrefix(childPath, "../"):
+			default:
+				continue
+			}
+			var found []types.Stack
+			found, err = child.FindStacks(stackPath)
+			if err != nil {
+				return
+			}
+			output = append(output, found...)
+		}
+	}
+	return
+}
+
+// relativePath returns the path relative to the root stack
+func (stack *Stack) relativePath(path string) string {
+	if rel, err := filepath.Rel(stack.state.Config.Workdir, path); err == nil {
+		return rel
+	}
+	return path
+}
@@ -0,0 +1,59 @@
+package stack
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/kruglovmax/stack/pkg/cel"
+	"github.com/kruglovmax/stack/pkg/misc"
+)
+
+// publishOutputs evaluates outputs of the stack after postRun
+// and publishes them under outputs.<outputsKey>
+func (stack *Stack) publishOutputs() error {
+	if len(stack.config.Outputs) == 0 {
+		return nil
+	}
+	stackMap := stack.GetView().(map[string]interface{})
+	stackMap["stack"] = stackMap
+	outputs := make(map[string]interface{}, len(stack.config.Outputs))
+	for name, expression := range stack.config.Outputs {
+		value, err := cel.ComputeCELNative(expression, stackMap)
+		if err != nil {
+			return fmt.Errorf("outputs.%s: %w", name, err)
+		}
+		outputs[name] = value
+	}
+	stack.setOutputs(outputs)
+	return nil
+}
+
+// setOutputs publishes outputs. Stacks with the same key share their outputs
+func (stack *Stack) setOutputs(outputs map[string]interface{}) {
+	if len(outputs) == 0 {
+		return
+	}
+	stack.outputs = outputs
+	key := stack.outputsKey()
+	stack.state.StacksOutputs.Mux.Lock()
+	defer stack.state.StacksOutputs.Mux.Unlock()
+	published, ok := stack.state.StacksOutputs.StacksOutputs[key]
+	if !ok {
+		published = make(map[string]interface{}, len(outputs))
+		stack.state.StacksOutputs.StacksOutputs[key] = published
+	}
+	for name, value := range outputs {
+		published[name] = value
+	}
+}
+
+// outputsKey is the stack path with the matrix suffix for stacks from files
+// (deploy-eu) and the path of the parent joined with the name for inline
+// stacks (app/migrate-eu)
+func (stack *Stack) outputsKey() string {
+	stackPath := misc.GetStackPathRelativeToTheRootStack(stack)
+	if stack.file == "" && stack.parentStack != nil {
+		return filepath.Join(stackPath, stack.Name)
+	}
+	return stackPath + stack.nameSuffix
+}
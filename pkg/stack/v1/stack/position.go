@@ -0,0 +1,66 @@
+package stack
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/stack/v1/vars"
+	"github.com/kruglovmax/stack/pkg/types"
+	"github.com/kruglovmax/stack/pkg/yamlpos"
+)
+
+// positionError returns err at the position of path in the stack file.
+// Inline stacks use positions in the file of the parent, StackError keeps its code
+func (stack *Stack) positionError(path []string, err error) error {
+	if stackErr, ok := err.(*types.StackError); ok {
+		stackErr.Err = stack.positionError(path, stackErr.Err)
+		return stackErr
+	}
+	if stack.doc == nil || err == nil || yamlpos.IsPositioned(err) {
+		return err
+	}
+	var varErr *vars.VarError
+	if errors.As(err, &varErr) {
+		return stack.doc.Errorf(append([]string{"vars"}, varErr.Path...), "%s", varErr.Error())
+	}
+	return stack.doc.Errorf(path, "%s", err.Error())
+}
+
+// varWarning logs the problem of the var name at its position in the stack file
+func (stack *Stack) varWarning(warning *vars.VarError) {
+	if stack.doc == nil {
+		stack.logVarWarning(warning)
+		return
+	}
+	stack.state.Logger.Warn().
+		Msg(stack.doc.Errorf(append([]string{"vars"}, warning.Path...), "%s", warning.Error()).Error())
+}
+
+// logVarWarning logs the problem of the var name of vars from other sources
+func (stack *Stack) logVarWarning(warning *vars.VarError) {
+	stack.state.Logger.Warn().
+		Str("Input var name", strings.Join(warning.Path, ".")).
+		Msg(warning.Message)
+}
+
+// schemaErrors returns schema validation errors at their positions in the stack file
+func (stack *Stack) schemaErrors(config interface{}) error {
+	validation, err := validateSchema(config)
+	if err != nil || validation.Valid() {
+		return err
+	}
+	var errs yamlpos.Errors
+	for _, e := range validation.Errors() {
+		if e.Type() == "number_all_of" {
+			// the details are reported by errors of the subschemas
+			continue
+		}
+		path := strings.Split(e.Context().String("\x00"), "\x00")[1:]
+		if property, ok := e.Details()["property"].(string); ok && e.Type() == "additional_property_not_allowed" {
+			path = append(path, property)
+		}
+		errs = append(errs, stack.doc.Errorf(path, consts.MessageBadStackErr, e.Description()))
+	}
+	return errs.ErrorOrNil()
+}
@@ -0,0 +1,22 @@
+package stack
+
+import (
+	"github.com/kruglovmax/stack/pkg/misc"
+)
+
+// selection applies --only, --skip and --with-ancestors to the stack.
+// skipReason is not empty if the stack and its child stacks are not executed.
+// execRunItems is false for ancestors of selected stacks, only their vars are resolved
+func (stack *Stack) selection() (skipReason string, execRunItems bool) {
+	selector := stack.state.Selector
+	stackPath := misc.GetStackPathRelativeToTheRootStack(stack)
+	switch {
+	case selector.Skipped(stackPath):
+		return "--skip", false
+	case selector.Selected(stackPath):
+		return "", true
+	case !selector.MayContain(stackPath):
+		return "--only", false
+	}
+	return "", stack.state.Config.WithAncestors
+}
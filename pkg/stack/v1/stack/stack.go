@@ -1,10 +1,13 @@
 package stack
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"path/filepath"
-	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/imdario/mergo"
@@ -13,34 +16,65 @@ import (
 	"github.com/kruglovmax/stack/pkg/cel"
 	"github.com/kruglovmax/stack/pkg/conditions"
 	"github.com/kruglovmax/stack/pkg/consts"
-	"github.com/kruglovmax/stack/pkg/log"
 	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/retry"
 	"github.com/kruglovmax/stack/pkg/stack/v1/libs"
 	"github.com/kruglovmax/stack/pkg/stack/v1/run/parser"
 	"github.com/kruglovmax/stack/pkg/stack/v1/schema"
 	"github.com/kruglovmax/stack/pkg/stack/v1/vars"
 	"github.com/kruglovmax/stack/pkg/types"
+	"github.com/kruglovmax/stack/pkg/yamlpos"
 	jsonschema "github.com/xeipuuv/gojsonschema"
-	"k8s.io/helm/pkg/strvals"
 )
 
 // Stack type
 type Stack struct {
 	// WaitGroup
-	stacksWG   sync.WaitGroup
-	preExecWG  sync.WaitGroup
-	execWG     sync.WaitGroup
-	postExecWG sync.WaitGroup
 
 	// Mutex
 	getViewMutex sync.Mutex
 
+	// context of the stack scope. Stacks with a failure policy get their own
+	ctx       context.Context
+	cancel    context.CancelFunc
+	inPostRun int32
+
+	// state of the run of the stack tree
+	state *app.State
+
+	// ancestor of stacks selected by --only. Its run items are not executed
+	ancestor bool
+
+	// evaluated outputs of the stack
+	outputs map[string]interface{}
+
+	// flags written by run items of the stack, guarded by Flags.Mux
+	writtenFlags map[string]interface{}
+	// checkpoint of the running stack
+	checkpoint stackCheckpoint
+
+	// input and name suffix given by the parent stack before loading,
+	// set for matrix instances and stacks with args
+	input      interface{}
+	nameSuffix string
+
+	// file the stack was loaded from, empty for inline stacks
+	file string
+	// positions of nodes in the stack file. Inline stacks get the node of the
+	// stack in the file of the parent, nil if the parent has no file
+	doc *yamlpos.Document
+
+	// origins of vars, tracked only when vars are explained
+	varOrigins *types.StackVars
+
 	// config
 	config        stackInputYAML
+	policy        retry.Policy
 	runItemParser types.RunItemParser
 	parentStack   types.Stack
 	stackID       string
 	waitGroups    []string
+	maxParallel   int
 
 	// API
 	API            string
@@ -67,48 +101,89 @@ type Stack struct {
 type stackInputYAML struct {
 	workdir string
 
-	API            string                 `json:"api,omitempty"`
-	Name           string                 `json:"name,omitempty"`
-	Vars           map[string]interface{} `json:"vars,omitempty"`
-	VarsFrom       []map[string]string    `json:"varsFrom,omitempty"`
-	Flags          map[string]interface{} `json:"flags,omitempty"`
-	Locals         map[string]interface{} `json:"locals,omitempty"`
-	Libs           []interface{}          `json:"libs,omitempty"`
-	PreRun         []interface{}          `json:"preRun,omitempty"`
-	Run            []interface{}          `json:"run,omitempty"`
-	PostRun        []interface{}          `json:"postRun,omitempty"`
-	ParallelStacks []interface{}          `json:"pstacks,omitempty"`
-	Stacks         []interface{}          `json:"stacks,omitempty"`
-	When           string                 `json:"when,omitempty"`
-	Wait           string                 `json:"wait,omitempty"`
-	WaitTimeout    string                 `json:"waitTimeout,omitempty"`
-	WaitGroups     []string               `json:"waitGroups,omitempty"`
-}
-
-type stackOutputValues struct {
-	API     string                 `json:"api,omitempty"`
-	ID      string                 `json:"id,omitempty"`
-	Name    string                 `json:"name,omitempty"`
-	Workdir string                 `json:"workdir,omitempty"`
-	Input   interface{}            `json:"input,omitempty"`
-	Vars    map[string]interface{} `json:"vars,omitempty"`
-	Flags   map[string]interface{} `json:"flags,omitempty"`
-	Locals  map[string]interface{} `json:"locals,omitempty"`
-	Status  map[string]string      `json:"status,omitempty"`
-}
-
-// AddRawVarsLeft func
-func (stack *Stack) AddRawVarsLeft(v map[string]interface{}) {
+	API             string                 `json:"api,omitempty"`
+	Name            string                 `json:"name,omitempty"`
+	Vars            map[string]interface{} `json:"vars,omitempty"`
+	VarsFrom        []varsFromInput        `json:"varsFrom,omitempty"`
+	Flags           map[string]interface{} `json:"flags,omitempty"`
+	Locals          map[string]interface{} `json:"locals,omitempty"`
+	Libs            []interface{}          `json:"libs,omitempty"`
+	PreRun          []interface{}          `json:"preRun,omitempty"`
+	Run             []interface{}          `json:"run,omitempty"`
+	PostRun         []interface{}          `json:"postRun,omitempty"`
+	ParallelStacks  []interface{}          `json:"pstacks,omitempty"`
+	Stacks          []interface{}          `json:"stacks,omitempty"`
+	When            string                 `json:"when,omitempty"`
+	Wait            string                 `json:"wait,omitempty"`
+	WaitTimeout     string                 `json:"waitTimeout,omitempty"`
+	WaitGroups      []string               `json:"waitGroups,omitempty"`
+	ContinueOnError bool                   `json:"continueOnError,omitempty"`
+	Retries         int                    `json:"retries,omitempty"`
+	RetryDelay      string                 `json:"retryDelay,omitempty"`
+	RetryBackoff    float64                `json:"retryBackoff,omitempty"`
+	MaxParallel     int                    `json:"maxParallel,omitempty"`
+	Matrix          interface{}            `json:"matrix,omitempty"`
+	Outputs         map[string]string      `json:"outputs,omitempty"`
+}
+
+// New returns the root stack of the run
+func New(state *app.State) *Stack {
+	stack := new(Stack)
+	stack.state = state
+	return stack
+}
+
+// AddRawVarsLeft func. source is recorded as the origin of the vars
+func (stack *Stack) AddRawVarsLeft(v map[string]interface{}, source string) error {
+	parsedVars, err := vars.ParseVars(v, stack.logVarWarning)
+	if err != nil {
+		return err
+	}
 	stack.Vars.Mux.Lock()
 	defer stack.Vars.Mux.Unlock()
-	stack.Vars = vars.CombineVars(vars.ParseVars(v), stack.Vars)
+	stack.Vars = vars.CombineVars(parsedVars, stack.Vars)
+	return stack.addVarOrigins(v, source, true)
 }
 
-// AddRawVarsRight func
-func (stack *Stack) AddRawVarsRight(v map[string]interface{}) {
+// AddRawVarsRight func. source is recorded as the origin of the vars
+func (stack *Stack) AddRawVarsRight(v map[string]interface{}, source string) error {
+	parsedVars, err := vars.ParseVars(v, stack.logVarWarning)
+	if err != nil {
+		return err
+	}
 	stack.Vars.Mux.Lock()
 	defer stack.Vars.Mux.Unlock()
-	stack.Vars = vars.CombineVars(stack.Vars, vars.ParseVars(v))
+	stack.Vars = vars.CombineVars(stack.Vars, parsedVars)
+	return stack.addVarOrigins(v, source, false)
+}
+
+// AddFlags merges flags written by run items of the stack.
+// They are recorded for the checkpoint of the stack
+func (stack *Stack) AddFlags(flags map[string]interface{}) error {
+	stack.Flags.Mux.Lock()
+	defer stack.Flags.Mux.Unlock()
+	if err := mergo.Merge(&stack.Flags.Vars, flags, mergo.WithOverwriteWithEmptyValue); err != nil {
+		return err
+	}
+	written, _ := misc.CopyValue(flags).(map[string]interface{})
+	if stack.writtenFlags == nil {
+		stack.writtenFlags = written
+		return nil
+	}
+	return mergo.Merge(&stack.writtenFlags, written, mergo.WithOverwriteWithEmptyValue)
+}
+
+// Cancel stops the stack scope
+func (stack *Stack) Cancel() {
+	stack.cancel()
+}
+
+// GetContext func. postRun is a cleanup and is stopped only by an interrupt
+func (stack *Stack) GetContext() context.Context {
+	if atomic.LoadInt32(&stack.inPostRun) != 0 {
+		return stack.state.Interrupt
+	}
+	return stack.ctx
 }
 
 // GetAPI func
@@ -163,32 +238,56 @@ func (stack *Stack) GetLocals() *types.StackLocals {
 
 // GetView func
 func (stack *Stack) GetView() (result interface{}) {
-	var output stackOutputValues
-
 	stack.getViewMutex.Lock()
 	stack.Vars.Mux.Lock()
 	stack.Flags.Mux.Lock()
 	stack.Locals.Mux.Lock()
 	stack.Status.Mux.Lock()
+	stack.state.StacksOutputs.Mux.Lock()
 	defer stack.getViewMutex.Unlock()
 	defer stack.Vars.Mux.Unlock()
 	defer stack.Flags.Mux.Unlock()
 	defer stack.Locals.Mux.Unlock()
 	defer stack.Status.Mux.Unlock()
+	defer stack.state.StacksOutputs.Mux.Unlock()
 
-	output.API = stack.API
-	output.Name = stack.Name
-	output.Input = stack.Input.Input
-	output.Vars = stack.Vars.Vars
-	output.Flags = stack.Flags.Vars
-	output.Locals = stack.Locals.Vars
-	output.Status = stack.Status.StacksStatus
-	output.ID = stack.GetStackID()
-	output.Workdir = stack.GetWorkdir()
-
-	result = misc.ToInterface(output)
+	outputs := make(map[string]interface{}, len(stack.state.StacksOutputs.StacksOutputs))
+	for stackPath, stackOutputs := range stack.state.StacksOutputs.StacksOutputs {
+		outputs[stackPath] = stackOutputs
+	}
+	view := make(map[string]interface{})
+	// empty values are left out of the view
+	for key, value := range map[string]interface{}{
+		"api":     stack.API,
+		"id":      stack.GetStackID(),
+		"name":    stack.Name,
+		"workdir": stack.GetWorkdir(),
+		"input":   stack.Input.Input,
+		"vars":    stack.Vars.Vars,
+		"flags":   stack.Flags.Vars,
+		"locals":  stack.Locals.Vars,
+		"status":  stack.Status.StacksStatus,
+		"outputs": outputs,
+	} {
+		if value = misc.CopyValue(value); !isEmptyValue(value) {
+			view[key] = value
+		}
+	}
+	return view
+}
 
-	return
+func isEmptyValue(value interface{}) bool {
+	switch value := value.(type) {
+	case nil:
+		return true
+	case string:
+		return value == ""
+	case map[string]interface{}:
+		return len(value) == 0
+	case []interface{}:
+		return len(value) == 0
+	}
+	return false
 }
 
 // GetWaitTimeout func
@@ -201,137 +300,210 @@ func (stack *Stack) GetWorkdir() string {
 	return stack.Workdir
 }
 
-// ParseStacks func
-func ParseStacks(stack types.Stack, input []interface{}) (output []types.Stack) {
-	for _, item := range input {
-		output = append(output, parseStackItems(stack, item, "")...)
+// pathFromRoot is the stack path relative to the root stack. The stack
+// context may be not set yet, so misc.GetStackPathRelativeToTheRootStack is not used
+func (stack *Stack) pathFromRoot() string {
+	stackPath, err := filepath.Rel(stack.state.Config.Workdir, stack.Workdir)
+	if err != nil {
+		return stack.Workdir
+	}
+	return stackPath
+}
+
+// ParseStacks loads stacks of input. key is stacks or pstacks, the key of input
+// in the stack config. It is used for positions of errors in inline stacks
+func ParseStacks(stack types.Stack, key string, input []interface{}) (output []types.Stack, err error) {
+	for i, item := range input {
+		var stacks []types.Stack
+		stacks, err = parseStackItems(stack, item, []string{key, strconv.Itoa(i)})
+		if err != nil {
+			return
+		}
+		output = append(output, stacks...)
 	}
 	return
 }
 
 // LoadFromString reads stack from yaml or json to self struct
-func (stack *Stack) LoadFromString(stackYAML string, parentStack types.Stack) {
-	log.Logger.Info().Str("inline", "YAML").Msg(consts.MessagesReadingStackFrom)
+func (stack *Stack) LoadFromString(stackYAML string, parentStack types.Stack) (err error) {
+	if parentStack != nil {
+		stack.state = app.FromStack(parentStack)
+	}
+	stack.state.Logger.Info().Str("inline", "YAML").Msg(consts.MessagesReadingStackFrom)
 
 	// schema validation
 	var tmpStructForValidation interface{}
-	misc.LoadYAML(stackYAML, &tmpStructForValidation)
-	validation, err := schema.ConfigSchema.Validate(jsonschema.NewGoLoader(tmpStructForValidation))
-	misc.CheckIfErr(err, stack)
-	if !validation.Valid() {
-		var errs string
-		for _, e := range validation.Errors() {
-			errs = errs + "\n" + e.String()
-		}
-		err := fmt.Errorf(consts.MessageBadStackErr, errs)
-		misc.CheckIfErr(err, stack)
+	if err = misc.LoadYAML(stackYAML, &tmpStructForValidation); err != nil {
+		return
+	}
+	if stack.doc != nil {
+		err = stack.schemaErrors(tmpStructForValidation)
+	} else {
+		err = validateConfig(tmpStructForValidation)
+	}
+	if err != nil {
+		return
 	}
 
-	misc.LoadYAML(stackYAML, &stack.config)
+	if err = misc.LoadYAML(stackYAML, &stack.config); err != nil {
+		return
+	}
 	switch stack.config.API {
 	case "v1":
 		stack.runItemParser = parser.RunItemParser
 		stack.parentStack = parentStack
-		stack.Name = stack.config.Name
+		stack.Name = stack.config.Name + stack.nameSuffix
 		stack.Workdir = parentStack.GetWorkdir()
-		parseInputYAML(stack, stack.config, parentStack)
+		if err = parseInputYAML(stack, stack.config, parentStack); err != nil {
+			return
+		}
 	default:
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
+		stack.state.Logger.Debug().
 			Str("YAML", "\n"+stackYAML).
 			Msg(consts.MessageBadStackUnsupportedAPI)
+		return fmt.Errorf(consts.MessageBadStackUnsupportedAPI)
 	}
 	stack.SetStatus("Loaded")
 	return
 }
 
 // LoadFromFile reads stack from yaml or json to self struct
-func (stack *Stack) LoadFromFile(stackFile string, parentStack types.Stack) {
-	log.Logger.Info().Str("file", stackFile).Msg(consts.MessagesReadingStackFrom)
+func (stack *Stack) LoadFromFile(stackFile string, parentStack types.Stack) (err error) {
+	if parentStack != nil {
+		stack.state = app.FromStack(parentStack)
+	}
+	stack.state.Logger.Info().Str("file", stackFile).Msg(consts.MessagesReadingStackFrom)
+
+	defer func() {
+		if err != nil && !yamlpos.IsPositioned(err) {
+			err = fmt.Errorf("%s: %w", stackFile, err)
+		}
+	}()
+
+	stack.Workdir = misc.GetDirPath(stackFile)
+	stack.file = stackFile
+	stack.watch(stackFile)
+
+	content, err := ioutil.ReadFile(stackFile)
+	if err != nil {
+		return
+	}
+	if stack.doc, err = yamlpos.Parse(stackFile, content); err != nil {
+		return
+	}
 
 	// schema validation
 	var tmpStructForValidation interface{}
-	misc.LoadYAMLFromFile(stackFile, &tmpStructForValidation)
-	validation, err := schema.ConfigSchema.Validate(jsonschema.NewGoLoader(tmpStructForValidation))
-	misc.CheckIfErr(err, stack)
-	if !validation.Valid() {
-		var errs string
-		for _, e := range validation.Errors() {
-			errs = errs + "\n" + e.String()
-		}
-		err := fmt.Errorf(consts.MessageBadStackErr, errs)
-		misc.CheckIfErr(err, stack)
+	if err = misc.LoadYAML(string(content), &tmpStructForValidation); err != nil {
+		return stack.doc.Wrap(err)
+	}
+	if err = stack.schemaErrors(tmpStructForValidation); err != nil {
+		return
 	}
 
-	misc.LoadYAMLFromFile(stackFile, &stack.config)
+	if err = misc.LoadYAML(string(content), &stack.config); err != nil {
+		return stack.doc.Wrap(err)
+	}
 	switch stack.config.API {
 	case "v1":
 		stack.runItemParser = parser.RunItemParser
 		stack.parentStack = parentStack
-		stack.Name = misc.GetDirName(stackFile)
-		stack.Workdir = misc.GetDirPath(stackFile)
-		parseInputYAML(stack, stack.config, parentStack)
+		stack.Name = misc.GetDirName(stackFile) + stack.nameSuffix
+		if err = parseInputYAML(stack, stack.config, parentStack); err != nil {
+			return
+		}
 	default:
-		log.Logger.Debug().
-			Msg(string(debug.Stack()))
-		log.Logger.Fatal().
-			Str("file", stackFile).
-			Msg(consts.MessageBadStackUnsupportedAPI)
+		return fmt.Errorf(consts.MessageBadStackUnsupportedAPI)
 	}
 	stack.SetStatus("Loaded")
 	return
 }
 
 // PreExec func
-func (stack *Stack) PreExec(parentWG *sync.WaitGroup) {
+func (stack *Stack) PreExec(parentWG *sync.WaitGroup) error {
 	if parentWG != nil {
 		defer parentWG.Done()
 	}
 	if len(stack.PreRun) > 0 {
-		log.Logger.Info().Str("Stack", stack.GetWorkdir()).Msg("preRun")
+		stack.state.Logger.Info().Str("Stack", stack.GetWorkdir()).Msg("preRun")
 	}
 	stack.SetStatus("PreRun")
-	for _, runItem := range stack.PreRun {
-		var wg sync.WaitGroup
-		wg.Add(1)
-		go runItem.Exec(&wg)
-		wg.Wait()
-	}
+	return stack.execRunItems(stack.PreRun, true)
 }
 
 // Exec func
-func (stack *Stack) Exec(parentWG *sync.WaitGroup) {
+func (stack *Stack) Exec(parentWG *sync.WaitGroup) error {
 	if parentWG != nil {
 		defer parentWG.Done()
 	}
 	if len(stack.Run) > 0 {
-		log.Logger.Info().Str("Stack", stack.GetWorkdir()).Msg("Run")
+		stack.state.Logger.Info().Str("Stack", stack.GetWorkdir()).Msg("Run")
 	}
 	stack.SetStatus("Run")
-	for _, runItem := range stack.Run {
-		var wg sync.WaitGroup
-		wg.Add(1)
-		go runItem.Exec(&wg)
-		wg.Wait()
-	}
+	return stack.execRunItems(stack.Run, true)
 }
 
 // PostExec func
-func (stack *Stack) PostExec(parentWG *sync.WaitGroup) {
+func (stack *Stack) PostExec(parentWG *sync.WaitGroup) error {
 	if parentWG != nil {
 		defer parentWG.Done()
 	}
 	if len(stack.PostRun) > 0 {
-		log.Logger.Info().Str("Stack", stack.GetWorkdir()).Msg("postRun")
+		stack.state.Logger.Info().Str("Stack", stack.GetWorkdir()).Msg("postRun")
 	}
 	stack.SetStatus("PostRun")
-	for _, runItem := range stack.PostRun {
-		var wg sync.WaitGroup
-		wg.Add(1)
-		go runItem.Exec(&wg)
-		wg.Wait()
+	atomic.StoreInt32(&stack.inPostRun, 1)
+	defer atomic.StoreInt32(&stack.inPostRun, 0)
+	return stack.execRunItems(stack.PostRun, false)
+}
+
+// Plan walks the stack tree without executing run items
+func (stack *Stack) Plan() (plan *types.StackPlan, err error) {
+	_, execRunItems := stack.selection()
+	stack.ancestor = !execRunItems
+
+	plan = new(types.StackPlan)
+	plan.Path = misc.GetStackPathRelativeToTheRootStack(stack)
+	plan.Name = stack.Name
+	plan.Workdir = stack.Workdir
+	plan.Input = stack.Input.Input
+	plan.Vars = stack.Vars.Vars
+	plan.Flags = stack.Flags.Vars
+	plan.Locals = stack.Locals.Vars
+	plan.When = stack.When
+	plan.Wait = stack.Wait
+	if stack.Wait != "" {
+		plan.WaitTimeout = stack.WaitTimeout.String()
+	}
+	plan.WaitGroups = stack.waitGroups
+	plan.Retries = stack.policy.Retries
+	plan.ContinueOnError = stack.policy.ContinueOnError
+	plan.MaxParallel = stack.maxParallel
+	plan.Ancestor = stack.ancestor
+	plan.Outputs = stack.config.Outputs
+	if !stack.ancestor {
+		plan.PreRun = planRunItems(stack.PreRun)
+		plan.Run = planRunItems(stack.Run)
+		plan.PostRun = planRunItems(stack.PostRun)
+	}
+
+	stack.SetStatus("ParseChildStacks")
+	plan.Stacks, err = planStacks(stack, "stacks", stack.config.Stacks)
+	if err != nil {
+		return
+	}
+	plan.ParallelStacks, err = planStacks(stack, "pstacks", stack.config.ParallelStacks)
+	if err != nil {
+		return
 	}
+	stack.SetStatus("Planned")
+	return
+}
+
+func (stack *Stack) getStatus() string {
+	stack.Status.Mux.Lock()
+	defer stack.Status.Mux.Unlock()
+	return stack.Status.StacksStatus[stack.stackID]
 }
 
 // SetStatus func
@@ -342,80 +514,269 @@ func (stack *Stack) SetStatus(status string) {
 }
 
 // Start func
-func (stack *Stack) Start(parentWG *sync.WaitGroup) {
+func (stack *Stack) Start(parentWG *sync.WaitGroup) (err error) {
 	if parentWG != nil {
 		defer parentWG.Done()
 	}
 
 	defer stack.done()
 
-	select {
-	case <-app.App.Context.Done():
-		stack.SetStatus("Cancelled because app error")
-		return
-	default: // Prevent from blocking.
+	if stack.parentStack == nil {
+		// the goroutine running the tree is a job, see scheduler.Parallel
+		if stack.state.Jobs.Acquire(stack.ctx) != nil {
+			return
+		}
+		defer stack.state.Jobs.Release()
 	}
 
-	stack.preExecWG.Add(1)
-	go stack.PreExec(&stack.preExecWG)
-	stack.preExecWG.Wait()
+	stack.state.Report.StackStarted(stack, misc.GetStackPathRelativeToTheRootStack(stack))
+	defer func() {
+		stack.state.Report.StackFinished(stack, err)
+	}()
+	defer stack.collectExplainedVars()
 
-	select {
-	case <-app.App.Context.Done():
-		stack.SetStatus("Cancelled because app error")
+	skipReason, execRunItems := stack.selection()
+	if skipReason != "" {
+		stack.state.Report.StackSkipped(stack, skipReason)
+		stack.SetStatus("Skipped")
 		return
-	default: // Prevent from blocking.
+	}
+	if !execRunItems {
+		stack.ancestor = true
+		stack.state.Report.StackSkipped(stack, consts.MessageStackAncestor)
+		return stack.startAncestor()
 	}
 
-	if !conditions.When(stack, stack.When) {
-		return
+	stack.checkpoint = stackCheckpoint{key: stack.checkpointKey(), fingerprint: stack.checkpointFingerprint()}
+	done, err := stack.resume()
+	if err != nil {
+		return stack.fail(types.WrapError(stack, nil, consts.ExitCodeBadStack, err))
+	}
+	if done {
+		return stack.startAncestor()
+	}
+
+	if !stack.policy.IsSet() {
+		return stack.start()
+	}
+
+	parentCtx, parentCancel := stack.parentScope()
+	err = stack.policy.Do(parentCtx, func() error {
+		stack.ctx, stack.cancel = context.WithCancel(parentCtx)
+		return stack.start()
+	}, func(attempt int, err error) {
+		stack.state.Logger.Warn().
+			Str("stack", stack.GetWorkdir()).
+			Int("attempt", attempt).
+			Int("retries", stack.policy.Retries).
+			Msg(err.Error())
+		stack.SetStatus(fmt.Sprintf("Retry %d/%d", attempt, stack.policy.Retries))
+	})
+	stack.cancel()
+	if err != nil {
+		if stack.policy.ContinueOnError {
+			stack.state.Logger.Warn().
+				Str("stack", stack.GetWorkdir()).
+				Msg(consts.MessageContinueOnError + ": " + err.Error())
+			stack.SetStatus("FailedIgnored")
+			return nil
+		}
+		parentCancel()
 	}
-	if !conditions.Wait(stack, stack.Wait, stack.WaitTimeout) {
+	return
+}
+
+func (stack *Stack) start() (err error) {
+	if stack.isCancelled() {
 		return
 	}
 
+	if !stack.checkpoint.runItemsDone {
+		if err = stack.PreExec(nil); err != nil {
+			return stack.fail(err)
+		}
+
+		if stack.isCancelled() {
+			return
+		}
+
+		if !conditions.When(stack, stack.When) {
+			stack.state.Report.StackSkipped(stack, "when: "+stack.When)
+			return
+		}
+		if ok, waitErr := conditions.Wait(stack, stack.Wait, stack.WaitTimeout); !ok {
+			if waitErr != nil {
+				return stack.fail(types.WrapError(stack, nil, consts.ExitCodeWaitTimeout, waitErr))
+			}
+			stack.isCancelled()
+			return
+		}
+	}
+
 	for _, wgKey := range stack.waitGroups {
+		if len(stack.WaitGroups) == len(stack.waitGroups) {
+			break // already added by the previous attempt
+		}
 		stack.WaitGroups = append(stack.WaitGroups, conditions.WaitGroupAdd(stack, wgKey))
 	}
 
-	stack.execWG.Add(1)
-	go stack.Exec(&stack.execWG)
-	stack.execWG.Wait()
+	if !stack.checkpoint.runItemsDone {
+		err = stack.Exec(nil)
+		if err == nil && !stack.isCancelled() {
+			// run items are not executed again on resume even if child stacks fail
+			stack.saveCheckpoint(false)
+		}
+	}
+	if err == nil {
+		if stack.isCancelled() {
+			return
+		}
+		err = stack.startChildStacks()
+	}
 
-	select {
-	case <-app.App.Context.Done():
-		stack.SetStatus("Cancelled because app error")
+	// postRun is executed even if run items or child stacks failed
+	var errs types.StackErrors
+	errs = errs.Append(err).Append(stack.PostExec(nil))
+	if err = errs.ErrorOrNil(); err != nil {
+		return stack.fail(err)
+	}
+
+	if stack.isCancelled() {
+		return
+	}
+
+	if err = stack.publishOutputs(); err != nil {
+		return stack.fail(types.WrapError(stack, nil, consts.ExitCodeBadStack, err))
+	}
+
+	stack.SetStatus("Done")
+	stack.saveCheckpoint(true)
+	return
+}
+
+// startAncestor runs only child stacks. Vars of the stack are already resolved
+func (stack *Stack) startAncestor() (err error) {
+	if stack.isCancelled() {
+		return
+	}
+	if !conditions.When(stack, stack.When) {
+		stack.state.Report.StackSkipped(stack, "when: "+stack.When)
 		return
-	default: // Prevent from blocking.
 	}
+	if err = stack.startChildStacks(); err != nil {
+		return stack.fail(err)
+	}
+	if stack.isCancelled() {
+		return
+	}
+	stack.SetStatus("Done")
+	return
+}
 
-	// Start sub stacks
+func (stack *Stack) startChildStacks() (err error) {
 	stack.SetStatus("ParseChildStacks")
-	stack.ParallelStacks = ParseStacks(stack, stack.config.ParallelStacks)
-	stack.Stacks = ParseStacks(stack, stack.config.Stacks)
+	stack.ParallelStacks, err = ParseStacks(stack, "pstacks", stack.config.ParallelStacks)
+	if err != nil {
+		return types.WrapError(stack, nil, consts.ExitCodeBadStack, err)
+	}
+	stack.Stacks, err = ParseStacks(stack, "stacks", stack.config.Stacks)
+	if err != nil {
+		return types.WrapError(stack, nil, consts.ExitCodeBadStack, err)
+	}
 	stack.SetStatus("RunChildStacks")
-	for _, stackItem := range stack.Stacks {
-		stack.stacksWG.Add(1)
-		stackItem.Start(&stack.stacksWG)
+	for i, stackItem := range stack.Stacks {
+		if err = stackItem.Start(nil); err != nil {
+			stack.notStarted(stack.Stacks[i+1:])
+			stack.notStarted(stack.ParallelStacks)
+			return
+		}
 	}
-	for _, stackItem := range stack.ParallelStacks {
-		stack.stacksWG.Add(1)
-		go stackItem.Start(&stack.stacksWG)
+	var errs types.StackErrors
+	var errsMutex sync.Mutex
+	started := stack.state.Jobs.Parallel(stack.ctx, len(stack.ParallelStacks), stack.maxParallel, func(i int) {
+		err := stack.ParallelStacks[i].Start(nil)
+		errsMutex.Lock()
+		errs = errs.Append(err)
+		errsMutex.Unlock()
+	})
+	stack.notStarted(stack.ParallelStacks[started:])
+	return errs.ErrorOrNil()
+}
+
+// notStarted reports child stacks left by the failed or cancelled stack as cancelled
+func (stack *Stack) notStarted(stacks []types.Stack) {
+	for _, stackItem := range stacks {
+		stack.state.Report.StackStarted(stackItem, misc.GetStackPathRelativeToTheRootStack(stackItem))
+		stack.state.Report.StackSkipped(stackItem, consts.MessageStackNotStarted)
+		stack.state.Report.StackFinished(stackItem, nil)
+		stackItem.SetStatus("Cancelled")
 	}
-	stack.stacksWG.Wait()
+}
 
-	stack.postExecWG.Add(1)
-	go stack.PostExec(&stack.postExecWG)
-	stack.postExecWG.Wait()
+func (stack *Stack) execRunItems(runItems []types.RunItem, stopIfCancelled bool) error {
+	for _, runItem := range runItems {
+		if stopIfCancelled && stack.isCancelled() {
+			return nil
+		}
+		if err := runItem.Exec(nil); err != nil {
+			return types.WrapError(stack, runItem, consts.ExitCodeScriptFailed, err)
+		}
+	}
+	return nil
+}
 
+func (stack *Stack) isCancelled() bool {
 	select {
-	case <-app.App.Context.Done():
-		stack.SetStatus("Cancelled because app error")
-		return
+	case <-stack.ctx.Done():
+		stack.SetStatus("Cancelled")
+		return true
 	default: // Prevent from blocking.
 	}
+	return false
+}
 
-	stack.SetStatus("Done")
+// fail cancels the stack scope. Without a failure policy the scope is the
+// whole tree, so the first failed stack stops all others
+func (stack *Stack) fail(err error) error {
+	stack.SetStatus("Failed")
+	stack.Cancel()
+	return err
+}
+
+// parentScope returns context and cancel func of the parent stack or of the app
+func (stack *Stack) parentScope() (context.Context, context.CancelFunc) {
+	if stack.parentStack != nil {
+		return stack.parentStack.GetContext(), stack.parentStack.Cancel
+	}
+	return stack.state.Context, stack.state.Cancel
+}
+
+func planStacks(stack *Stack, key string, input []interface{}) (output []*types.StackPlan, err error) {
+	stacks, err := ParseStacks(stack, key, input)
+	if err != nil {
+		return
+	}
+	for _, stackItem := range stacks {
+		if child, ok := stackItem.(*Stack); ok {
+			if skipReason, _ := child.selection(); skipReason != "" {
+				continue
+			}
+		}
+		var plan *types.StackPlan
+		plan, err = stackItem.Plan()
+		if err != nil {
+			return
+		}
+		output = append(output, plan)
+	}
+	return
+}
+
+func planRunItems(runItems []types.RunItem) (output []*types.RunItemPlan) {
+	for _, runItem := range runItems {
+		output = append(output, runItem.Plan())
+	}
+	return
 }
 
 func (stack *Stack) done() {
@@ -424,83 +785,154 @@ func (stack *Stack) done() {
 	}
 }
 
-func parseInputYAML(stack *Stack, input stackInputYAML, parentStack types.Stack) {
+func validateSchema(config interface{}) (*jsonschema.Result, error) {
+	configSchema, err := schema.ConfigSchema()
+	if err != nil {
+		return nil, err
+	}
+	return configSchema.Validate(jsonschema.NewGoLoader(config))
+}
+
+func validateConfig(config interface{}) error {
+	validation, err := validateSchema(config)
+	if err != nil {
+		return err
+	}
+	if !validation.Valid() {
+		var errs string
+		for _, e := range validation.Errors() {
+			errs = errs + "\n" + e.String()
+		}
+		return fmt.Errorf(consts.MessageBadStackErr, errs)
+	}
+	return nil
+}
+
+func parseInputYAML(stack *Stack, input stackInputYAML, parentStack types.Stack) (err error) {
 	stack.API = input.API
 
-	stack.Vars = vars.ParseVars(input.Vars)
+	if stack.state == nil {
+		return fmt.Errorf("Stack is not bound to a run")
+	}
 
-	varsArray := make([]map[string]interface{}, 0, len(input.VarsFrom)+len(*app.App.Config.VarFiles))
-	for _, v := range input.VarsFrom {
-		if file, ok := v["file"]; ok {
-			var varsMap map[string]interface{}
-			misc.LoadYAMLFromFile(filepath.Join(stack.Workdir, file), &varsMap)
-			varsArray = append(varsArray, varsMap)
-		} else if file, ok := v["sops"]; ok {
-			var varsMap map[string]interface{}
-			misc.LoadYAMLFromSopsFile(filepath.Join(stack.Workdir, file), &varsMap)
-			varsArray = append(varsArray, varsMap)
+	stack.policy, err = retry.New(input.ContinueOnError, input.Retries, input.RetryDelay, input.RetryBackoff)
+	if err != nil {
+		return stack.positionError([]string{"retryDelay"}, err)
+	}
+	stack.ctx, stack.cancel = stack.parentScope()
+	if stack.policy.IsSet() {
+		stack.ctx, stack.cancel = context.WithCancel(stack.ctx)
+	}
+
+	stack.Vars, err = vars.ParseVars(input.Vars, stack.varWarning)
+	if err != nil {
+		return stack.positionError(nil, err)
+	}
+	if err = stack.initVarOrigins(input.Vars); err != nil {
+		return
+	}
+
+	varsArray := make([]map[string]interface{}, 0, len(input.VarsFrom)+len(stack.state.Config.VarFiles))
+	varsSources := make([]string, 0, cap(varsArray))
+	for i, v := range input.VarsFrom {
+		docs, sources, loadErr := stack.loadVarsFrom(v)
+		if loadErr != nil {
+			return stack.positionError([]string{"varsFrom", strconv.Itoa(i)}, loadErr)
 		}
+		varsArray = append(varsArray, docs...)
+		varsSources = append(varsSources, sources...)
 	}
 
 	if parentStack == nil {
-		for _, varsFile := range *app.App.Config.VarFiles {
+		for _, varsFile := range stack.state.Config.VarFiles {
 			var varsMap map[string]interface{}
-			misc.LoadYAMLFromFile(filepath.Join(stack.Workdir, varsFile), &varsMap)
+			if varsMap, err = stack.loadVarsFile(varsFile); err != nil {
+				return
+			}
 			varsArray = append(varsArray, varsMap)
+			varsSources = append(varsSources, "-f "+varsFile)
 		}
-		cliVars := make(map[string]interface{})
-		for _, str := range *app.App.Config.CLIValues {
-			varsMap, err := strvals.Parse(str)
-			misc.CheckIfErr(err, stack)
-			mergo.Merge(&cliVars, varsMap, mergo.WithOverwriteWithEmptyValue)
+		var cliVars map[string]interface{}
+		var cliSource string
+		if cliVars, cliSource, err = stack.cliVars(); err != nil {
+			return
 		}
 		varsArray = append(varsArray, cliVars)
+		varsSources = append(varsSources, cliSource)
 	}
 
-	for _, v := range varsArray {
-		stack.AddRawVarsLeft(v)
+	for i, v := range varsArray {
+		if err = stack.AddRawVarsLeft(v, varsSources[i]); err != nil {
+			return
+		}
 	}
 
 	if parentStack != nil {
 		stack.Vars = vars.CombineVars(parentStack.GetVars(), stack.Vars)
+		stack.inheritVarOrigins(parentStack)
 	}
 
-	stack.Flags = vars.FlagsGlobal
+	stack.Flags = stack.state.Flags
 	stack.GetFlags().Mux.Lock()
-	err := mergo.Merge(&stack.Flags.Vars, input.Flags)
-	misc.CheckIfErr(err, stack)
+	err = mergo.Merge(&stack.Flags.Vars, input.Flags)
 	stack.GetFlags().Mux.Unlock()
+	if err != nil {
+		return
+	}
 
 	stack.Input = new(types.StackInput)
+	stack.Input.Input = stack.input
 
 	stack.Locals = new(types.StackLocals)
 	stack.Locals.Vars = input.Locals
 
-	stack.Status = app.App.StacksStatus
-	stack.stackID = app.NewStackID()
+	stack.Status = stack.state.StacksStatus
+	stack.stackID = stack.state.NewStackID()
 
-	stack.Libs = libs.ParseAndInitLibs(input.Libs, stack.Workdir)
+	if err = stack.computeValues(input.Flags); err != nil {
+		return
+	}
+
+	stack.Libs, err = libs.ParseAndInitLibs(stack.state, input.Libs, stack.Workdir)
+	if err != nil {
+		return
+	}
+	stack.watchLibs()
 	stack.PreRun = stack.GetRunItemsParser().ParseRun(stack, input.PreRun)
 	stack.Run = stack.GetRunItemsParser().ParseRun(stack, input.Run)
 	stack.PostRun = stack.GetRunItemsParser().ParseRun(stack, input.PostRun)
 	stack.When = input.When
 	stack.Wait = input.Wait
 	waitTimeout := input.WaitTimeout
-	stack.WaitTimeout = *app.App.Config.DefaultTimeout
+	stack.WaitTimeout = stack.state.Config.DefaultTimeout
 	if waitTimeout != "" {
-		var err error
 		stack.WaitTimeout, err = time.ParseDuration(waitTimeout)
-		misc.CheckIfErr(err, stack)
+		if err != nil {
+			return stack.positionError([]string{"waitTimeout"}, err)
+		}
 	}
 	stack.waitGroups = input.WaitGroups
+	stack.maxParallel = input.MaxParallel
+	return
+}
+
+// parseStackItems loads stacks of item. path is the path of item in the stack config
+func parseStackItems(stack types.Stack, item interface{}, path []string) (output []types.Stack, err error) {
+	return parseStackItemsWithInput(stack, item, path, "", nil)
 }
 
-func parseStackItems(stack types.Stack, item interface{}, namePrefix string) (output []types.Stack) {
+// parseStackItemsWithInput loads stacks of item with input. Input is set before
+// loading, so computed values of the stacks can read it
+func parseStackItemsWithInput(stack types.Stack, item interface{}, path []string, namePrefix string, input interface{}) (output []types.Stack, err error) {
 	switch item.(type) {
 	case string:
 		var stackDirs []string
 		for _, libDir := range stack.GetLibs() {
-			matchedDirs := misc.GetDirsByRegexp(filepath.Join(libDir, namePrefix), item.(string))
+			var matchedDirs []string
+			matchedDirs, err = misc.GetDirsByRegexp(filepath.Join(libDir, namePrefix), item.(string))
+			if err != nil {
+				return
+			}
 			if matchedDirs != nil {
 				for _, dir := range matchedDirs {
 					stackDirs = append(stackDirs, filepath.Join(libDir, namePrefix, dir))
@@ -509,22 +941,38 @@ func parseStackItems(stack types.Stack, item interface{}, namePrefix string) (ou
 			}
 		}
 		if len(stackDirs) == 0 {
-			log.Logger.Fatal().
-				Str("In Stack", stack.GetWorkdir()).
-				Interface("SubStacks", item).
-				Msg("Not found")
+			err = fmt.Errorf("Sub stack %s not found in %s", filepath.Join(namePrefix, item.(string)), stack.GetWorkdir())
+			return
 		}
 		for _, stackDir := range stackDirs {
-			newStack := new(Stack)
-			newStack.runItemParser = parser.RunItemParser
-			newStack.parentStack = stack
-			newStack.LoadFromFile(misc.FindStackFileInDir(stackDir), stack)
-			output = append(output, newStack)
+			var stackFile string
+			stackFile, err = misc.FindStackFileInDir(stackDir)
+			if err != nil {
+				return
+			}
+			var newStacks []types.Stack
+			newStacks, err = expandMatrix(stack, misc.GetDirName(stackFile), stackFileMatrix(stackFile), input, func(input interface{}, nameSuffix string) (*Stack, error) {
+				newStack := new(Stack)
+				newStack.runItemParser = parser.RunItemParser
+				newStack.parentStack = stack
+				newStack.input = input
+				newStack.nameSuffix = nameSuffix
+				return newStack, newStack.LoadFromFile(stackFile, stack)
+			})
+			if err != nil {
+				return
+			}
+			output = append(output, newStacks...)
 		}
 		return
 	case []interface{}:
-		for _, v := range item.([]interface{}) {
-			output = append(output, parseStackItems(stack, v, namePrefix)...)
+		for i, v := range item.([]interface{}) {
+			var stacks []types.Stack
+			stacks, err = parseStackItemsWithInput(stack, v, append(path[:len(path):len(path)], strconv.Itoa(i)), namePrefix, input)
+			if err != nil {
+				return
+			}
+			output = append(output, stacks...)
 		}
 		return
 	case map[string]interface{}:
@@ -534,10 +982,25 @@ func parseStackItems(stack types.Stack, item interface{}, namePrefix string) (ou
 			if newStackConfig["api"] == nil {
 				newStackConfig["api"] = stack.GetAPI()
 			}
-			newStack := new(Stack)
-			newStack.runItemParser = parser.RunItemParser
-			newStack.LoadFromString(misc.ToYAML(newStackConfig), stack)
-			output = append(output, newStack)
+			var newStacks []types.Stack
+			newStacks, err = expandMatrix(stack, fmt.Sprint(newStackConfig["name"]), newStackConfig["matrix"], input, func(input interface{}, nameSuffix string) (*Stack, error) {
+				newStack := new(Stack)
+				newStack.runItemParser = parser.RunItemParser
+				newStack.input = input
+				newStack.nameSuffix = nameSuffix
+				if parent, ok := stack.(*Stack); ok {
+					newStack.doc = parent.doc.Sub(path)
+				}
+				stackYAML, err := misc.ToYAML(newStackConfig)
+				if err != nil {
+					return newStack, err
+				}
+				return newStack, newStack.LoadFromString(stackYAML, stack)
+			})
+			if err != nil {
+				return
+			}
+			output = append(output, newStacks...)
 		case isFunc(item): // parse stack with Args
 			ss := item.(map[string]interface{})
 			var itemKey, itemValue string
@@ -550,23 +1013,25 @@ func parseStackItems(stack types.Stack, item interface{}, namePrefix string) (ou
 				if _, ok := computed.(string); err == nil && ok {
 					itemValue = computed.(string)
 				}
-				newStacks := parseStackItems(stack, itemKey, namePrefix)
-				for _, newStack := range newStacks {
-					stackMap := stack.GetView().(map[string]interface{})
-					stackMap["stack"] = stackMap
-					vars, err := dotnotation.Get(stackMap, itemValue)
-					if err != nil {
-						vars = itemValue
-					}
-					newStack.GetInput().Mux.Lock()
-					newStack.GetInput().Input = vars
-					newStack.GetInput().Mux.Unlock()
-					output = append(output, newStack)
+				vars, err := dotnotation.Get(stackMap, itemValue)
+				if err != nil {
+					vars = itemValue
+				}
+				var newStacks []types.Stack
+				newStacks, err = parseStackItemsWithInput(stack, itemKey, path, namePrefix, vars)
+				if err != nil {
+					return output, err
 				}
+				output = append(output, newStacks...)
 			}
 		default:
 			for k, v := range item.(map[string]interface{}) {
-				output = append(output, parseStackItems(stack, v, filepath.Join(namePrefix, k))...)
+				var stacks []types.Stack
+				stacks, err = parseStackItemsWithInput(stack, v, append(path[:len(path):len(path)], k), filepath.Join(namePrefix, k), input)
+				if err != nil {
+					return
+				}
+				output = append(output, stacks...)
 			}
 		}
 		return
@@ -0,0 +1,37 @@
+package stack
+
+import (
+	"testing"
+)
+
+func TestRunItemStatus(t *testing.T) {
+	stack := loadTestStack(t, map[string]string{
+		"stack.yaml": `api: v1
+run:
+- script: exit 1
+  continueOnError: true
+- script: test -f attempted || { touch attempted; exit 1; }
+  retries: 1
+  retryDelay: 10ms
+- script: "true"
+`,
+	})
+	if err := stack.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	id := stack.GetStackID()
+	for key, want := range map[string]string{
+		id:            "Done",
+		id + "/run/1": "FailedIgnored",
+		id + "/run/2": "Done",
+		id + "/run/3": "Done",
+	} {
+		if status := stack.Status.StacksStatus[key]; status != want {
+			t.Errorf("status of %s = %q, want %q", key, status, want)
+		}
+	}
+	runItems := stack.state.Report.Stacks[0].RunItems
+	if len(runItems) != 3 || runItems[1].ID != id+"/run/2" || runItems[1].Retries != 1 {
+		t.Errorf("run items of the report = %+v", runItems)
+	}
+}
@@ -0,0 +1,130 @@
+package stack
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kruglovmax/stack/pkg/cel"
+	"github.com/kruglovmax/stack/pkg/conditions"
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/stack/v1/run/script"
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+// Validate loads every child stack of the tree without executing anything,
+// compiles when, wait and waitGroups expressions and checks that templates
+// and scripts referenced by run items exist. All problems are returned at once
+func (stack *Stack) Validate() error {
+	var errs types.StackErrors
+	errs = errs.Append(stack.validateExpressions())
+	for _, runItems := range [][]types.RunItem{stack.PreRun, stack.Run, stack.PostRun} {
+		for _, runItem := range runItems {
+			errs = errs.Append(stack.validateRunItem(runItem, runItem.Plan(), nil))
+		}
+	}
+	for _, input := range []struct {
+		key   string
+		items []interface{}
+	}{{"stacks", stack.config.Stacks}, {"pstacks", stack.config.ParallelStacks}} {
+		for i, item := range input.items {
+			children, err := parseStackItems(stack, item, []string{input.key, strconv.Itoa(i)})
+			if err != nil {
+				errs = errs.Append(types.NewStackError(stack, nil, consts.ExitCodeBadStack, err))
+				continue
+			}
+			for _, child := range children {
+				errs = errs.Append(child.Validate())
+			}
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+func (stack *Stack) validateExpressions() error {
+	var errs types.StackErrors
+	if err := conditions.Check(stack, stack.When); err != nil {
+		errs = errs.Append(stack.validationError(nil, "when", err))
+	}
+	if err := conditions.Check(stack, stack.Wait); err != nil {
+		errs = errs.Append(stack.validationError(nil, "wait", err))
+	}
+	for _, waitGroup := range stack.waitGroups {
+		// plain names are used as is, only expressions are compiled
+		if !strings.ContainsAny(waitGroup, `"'(+`) {
+			continue
+		}
+		if err := conditions.Check(stack, waitGroup); err != nil {
+			errs = errs.Append(stack.validationError(nil, "waitGroups", err))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// validateRunItem checks the run item and its nested run items.
+// names are variables bound by foreach around the item
+func (stack *Stack) validateRunItem(runItem types.RunItem, plan *types.RunItemPlan, names []string) error {
+	var errs types.StackErrors
+	if err := conditions.Check(stack, plan.When, names...); err != nil {
+		errs = errs.Append(stack.validationError(runItem, plan.Type+" when", err))
+	}
+	if err := conditions.Check(stack, plan.Wait, names...); err != nil {
+		errs = errs.Append(stack.validationError(runItem, plan.Type+" wait", err))
+	}
+	for _, path := range stack.runItemFiles(plan, names) {
+		if !misc.PathIsExists(path) {
+			errs = errs.Append(stack.validationError(runItem, plan.Type, fmt.Errorf("Path is not exists: %s", path)))
+		}
+	}
+	if plan.Type == "foreach" {
+		names = append(names, "item", "index")
+	}
+	for _, item := range plan.Items {
+		errs = errs.Append(stack.validateRunItem(runItem, item, names))
+	}
+	return errs.ErrorOrNil()
+}
+
+// runItemFiles returns templates and script files referenced by the run item
+func (stack *Stack) runItemFiles(plan *types.RunItemPlan, names []string) (files []string) {
+	switch plan.Type {
+	case "gomplate", "jsonnet":
+		paths, _ := plan.Value.([]interface{})
+		for _, path := range paths {
+			path, ok := path.(string)
+			if !ok {
+				continue
+			}
+			if plan.Type == "gomplate" {
+				stackMap := stack.GetView().(map[string]interface{})
+				stackMap["stack"] = stackMap
+				computed, err := cel.ComputeCEL(path, stackMap)
+				if value, ok := computed.(string); err == nil && ok {
+					path = value
+				} else if len(names) > 0 {
+					// the path may depend on the foreach item
+					continue
+				}
+			}
+			files = append(files, stack.absPath(path))
+		}
+	case "script":
+		text, _ := plan.Value.(string)
+		scriptFiles, _ := script.Files(stack.Workdir, text)
+		files = append(files, scriptFiles...)
+	}
+	return
+}
+
+func (stack *Stack) absPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(stack.Workdir, path)
+}
+
+func (stack *Stack) validationError(runItem types.RunItem, key string, err error) error {
+	return types.NewStackError(stack, runItem, consts.ExitCodeBadStack, fmt.Errorf("%s: %w", key, err))
+}
@@ -0,0 +1,94 @@
+package stack
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+// execAllowed returns false if the stack tree is only loaded or the stack is excluded by --skip or --only.
+// varsFrom exec commands of such stacks are not executed
+func (stack *Stack) execAllowed() bool {
+	if stack.state.NoExec {
+		return false
+	}
+	skipReason, _ := stack.selection()
+	return skipReason == ""
+}
+
+// execVars runs the command of varsFrom exec in the stack workdir and decodes its stdout.
+// The command runs once per run for the workdir, other stacks get its cached output
+func (stack *Stack) execVars(command, timeout, format string) (vars map[string]interface{}, err error) {
+	runTimeout := stack.state.Config.DefaultTimeout
+	if timeout != "" {
+		if runTimeout, err = time.ParseDuration(timeout); err != nil {
+			return
+		}
+	}
+	if format == "" {
+		format = "yaml"
+	}
+	output, err := stack.state.ExecOutputs.Do(stack.Workdir+"\x00"+command, func() ([]byte, error) {
+		return stack.execCommand(command, runTimeout)
+	})
+	if err != nil {
+		return
+	}
+	if vars, err = decodeVars("stdout", output, format); err != nil {
+		// positioned at the varsFrom entry, not at the output
+		err = fmt.Errorf("%v", err)
+	}
+	return
+}
+
+// execCommand returns stdout of the command. The process group of the command
+// is terminated on timeout and on cancellation of the stack
+func (stack *Stack) execCommand(command string, timeout time.Duration) ([]byte, error) {
+	stack.state.Logger.Debug().Str("stack", stack.Workdir).Str("exec", command).Msg("varsFrom exec")
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = stack.Workdir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("STACK_ROOT=%s", stack.state.Config.Workdir),
+		fmt.Sprintf("STACK_GITCLONE_DIR=%s", filepath.Join(stack.state.Config.Workdir, consts.GitCloneDir)),
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	var err error
+	exited := make(chan struct{})
+	go func() {
+		err = cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(timeout):
+		misc.TerminateProcessGroup(cmd, exited, stack.state.Config.KillGrace)
+		<-exited
+		return nil, fmt.Errorf("exec timed out after %s", timeout)
+	case <-stack.GetContext().Done():
+		misc.TerminateProcessGroup(cmd, exited, stack.state.Config.KillGrace)
+		<-exited
+		return nil, types.NewStackError(stack, nil, consts.ExitCodeSIGTERM, fmt.Errorf("exec is cancelled"))
+	}
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%w: %s", err, message)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
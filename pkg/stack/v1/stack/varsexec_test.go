@@ -0,0 +1,135 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/selector"
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+func TestExecVarsFormats(t *testing.T) {
+	stack := loadTestStack(t, map[string]string{"stack.yaml": "api: v1\n"})
+	for _, test := range []struct {
+		command, format string
+		want            map[string]interface{}
+	}{
+		{"echo 'a: 1'", "", map[string]interface{}{"a": float64(1)}},
+		{`echo '{"a": "b"}'`, "json", map[string]interface{}{"a": "b"}},
+		{"echo 'a = 1'", "toml", map[string]interface{}{"a": float64(1)}},
+		{"echo A=b", "dotenv", map[string]interface{}{"A": "b"}},
+	} {
+		vars, err := stack.execVars(test.command, "", test.format)
+		if err != nil {
+			t.Errorf("execVars(%q, %q): %v", test.command, test.format, err)
+			continue
+		}
+		if !reflect.DeepEqual(vars, test.want) {
+			t.Errorf("execVars(%q, %q) = %#v, want %#v", test.command, test.format, vars, test.want)
+		}
+	}
+	if _, err := stack.execVars("echo '{a'", "", "json"); err == nil {
+		t.Error("execVars with an undecodable output returned no error")
+	}
+	if _, err := stack.execVars("echo failed >&2; exit 1", "", ""); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("execVars of a failed command = %v, want its stderr", err)
+	}
+}
+
+func TestExecVarsRunsOnce(t *testing.T) {
+	stack := loadTestStack(t, map[string]string{"stack.yaml": "api: v1\n"})
+	command := "echo run >> runs; echo 'a: 1'"
+	for i := 0; i < 3; i++ {
+		if _, err := stack.execVars(command, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runs, err := ioutil.ReadFile(filepath.Join(stack.Workdir, "runs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(runs) != "run\n" {
+		t.Errorf("command ran %d times, want once", strings.Count(string(runs), "run"))
+	}
+}
+
+func TestExecVarsTimeout(t *testing.T) {
+	stack := loadTestStack(t, map[string]string{"stack.yaml": "api: v1\n"})
+	started := time.Now()
+	_, err := stack.execVars("sleep 10", "100ms", "")
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Errorf("execVars = %v, want the timeout", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("command is not terminated on timeout, execVars took %s", elapsed)
+	}
+}
+
+func TestExecVarsCancel(t *testing.T) {
+	stack := loadTestStack(t, map[string]string{"stack.yaml": "api: v1\n"})
+	var cancel context.CancelFunc
+	stack.ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err := stack.execCommand("sleep 10", time.Minute)
+	var stackErr *types.StackError
+	if !errors.As(err, &stackErr) || stackErr.Code != consts.ExitCodeSIGTERM {
+		t.Errorf("execCommand = %v, want the cancellation", err)
+	}
+}
+
+func TestExecVarsNotExecuted(t *testing.T) {
+	files := map[string]string{
+		"stack.yaml": "api: v1\nstacks:\n- child\n",
+		"child/stack.yaml": `api: v1
+varsFrom:
+- exec: "echo run >> runs; echo 'a: 1'"
+`,
+	}
+	loadChild := func(t *testing.T, noExec bool, only, skip []string) *Stack {
+		dir := writeTestStack(t, files)
+		state := newTestState(dir)
+		state.NoExec = noExec
+		var err error
+		if state.Selector, err = selector.New(only, skip); err != nil {
+			t.Fatal(err)
+		}
+		root := New(state)
+		if err = root.LoadFromFile(filepath.Join(dir, "stack.yaml"), nil); err != nil {
+			t.Fatal(err)
+		}
+		children, err := ParseStacks(root, "stacks", root.config.Stacks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return children[0].(*Stack)
+	}
+	for name, test := range map[string]struct {
+		noExec     bool
+		only, skip []string
+		executed   bool
+	}{
+		"run":    {executed: true},
+		"plan":   {noExec: true},
+		"--skip": {skip: []string{"child"}},
+		"--only": {only: []string{"other"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			child := loadChild(t, test.noExec, test.only, test.skip)
+			_, ran := child.Vars.Vars["a"]
+			if ran != test.executed {
+				t.Errorf("vars = %v, executed %v, want %v", child.Vars.Vars, ran, test.executed)
+			}
+			if ran != misc.PathIsExists(filepath.Join(child.Workdir, "runs")) {
+				t.Error("command ran but its vars are missing")
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package stack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+
+	"github.com/kruglovmax/stack/pkg/misc"
+	"github.com/kruglovmax/stack/pkg/yamlpos"
+)
+
+// envNestingSeparator separates names of nested vars in env var names
+const envNestingSeparator = "__"
+
+// varsFromInput is an entry of varsFrom. Exactly one source is set
+type varsFromInput struct {
+	File   string `json:"file,omitempty"`
+	Sops   string `json:"sops,omitempty"`
+	Env    string `json:"env,omitempty"`
+	Dotenv string `json:"dotenv,omitempty"`
+	Glob   string `json:"glob,omitempty"`
+	// Exec is a command, its stdout is the vars document
+	Exec string `json:"exec,omitempty"`
+	// Timeout of exec, the default timeout if empty
+	Timeout string `json:"timeout,omitempty"`
+	// Format of file, sops, glob files and exec output: yaml, json or toml.
+	// By default toml for .toml files, json for .json files and yaml for others
+	Format string `json:"format,omitempty"`
+	// Optional entries are skipped if files are not found
+	Optional bool `json:"optional,omitempty"`
+	// Key mounts vars under the dotted key instead of the root
+	Key string `json:"key,omitempty"`
+}
+
+// loadVarsFrom returns vars documents of the varsFrom entry with their sources.
+// Every file matched by glob is a separate document
+func (stack *Stack) loadVarsFrom(input varsFromInput) (docs []map[string]interface{}, sources []string, err error) {
+	var doc map[string]interface{}
+	switch {
+	case input.Env != "":
+		if doc, err = envVars(input.Env); err != nil {
+			return
+		}
+		docs = append(docs, doc)
+		sources = append(sources, "varsFrom env "+input.Env)
+	case input.Exec != "" && !stack.execAllowed():
+		stack.state.Logger.Debug().Str("stack", stack.Workdir).Str("exec", input.Exec).Msg("varsFrom exec is not executed")
+		sources = append(sources, "varsFrom exec "+input.Exec+" (not executed)")
+		docs = append(docs, map[string]interface{}{})
+	case input.Exec != "":
+		if doc, err = stack.execVars(input.Exec, input.Timeout, input.Format); err != nil {
+			return
+		}
+		docs = append(docs, doc)
+		sources = append(sources, "varsFrom exec "+input.Exec)
+	case input.Glob != "":
+		pattern := stack.absPath(input.Glob)
+		if dir := filepath.Dir(pattern); !strings.ContainsAny(dir, "*?[") {
+			// new files matching the pattern
+			stack.watch(dir)
+		}
+		var files []string
+		if files, err = filepath.Glob(pattern); err != nil {
+			return
+		}
+		if len(files) == 0 && !input.Optional {
+			return nil, nil, fmt.Errorf("No files match %s", input.Glob)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			stack.watch(file)
+			if doc, err = loadVarsDocument(file, input.Format, false); err != nil {
+				return
+			}
+			docs = append(docs, doc)
+			sources = append(sources, "varsFrom "+stack.relativePath(file))
+		}
+	default:
+		file, source := input.File, "varsFrom "
+		switch {
+		case input.Sops != "":
+			file, source = input.Sops, "varsFrom sops "
+		case input.Dotenv != "":
+			file, source = input.Dotenv, "varsFrom dotenv "
+		}
+		path := stack.absPath(file)
+		stack.watch(path)
+		if input.Optional && !misc.PathIsExists(path) {
+			stack.state.Logger.Debug().Str("file", path).Msg("Optional varsFrom file is not found")
+			return
+		}
+		format := input.Format
+		if input.Dotenv != "" {
+			format = "dotenv"
+		}
+		if doc, err = loadVarsDocument(path, format, input.Sops != ""); err != nil {
+			return
+		}
+		docs = append(docs, doc)
+		sources = append(sources, source+stack.relativePath(path))
+	}
+	if input.Key != "" {
+		for i := range docs {
+			docs[i] = mountVars(docs[i], input.Key)
+		}
+	}
+	return
+}
+
+// loadVarsDocument reads the vars file of the format: yaml, json, toml or dotenv
+func loadVarsDocument(file, format string, sops bool) (vars map[string]interface{}, err error) {
+	if format == "" {
+		switch filepath.Ext(file) {
+		case ".toml":
+			format = "toml"
+		case ".json":
+			format = "json"
+		default:
+			format = "yaml"
+		}
+	}
+	var content []byte
+	if sops {
+		sopsFormat := format
+		if format == "toml" {
+			// sops stores toml as a binary file
+			sopsFormat = "binary"
+		}
+		content, err = misc.DecryptSopsFile(file, sopsFormat)
+	} else {
+		content, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return
+	}
+	return decodeVars(file, content, format)
+}
+
+// decodeVars decodes the vars document of the format. name is the file in errors
+func decodeVars(name string, content []byte, format string) (vars map[string]interface{}, err error) {
+	switch format {
+	case "yaml":
+		err = misc.LoadYAML(string(content), &vars)
+	case "json":
+		err = json.Unmarshal(content, &vars)
+	case "toml":
+		if _, err = toml.Decode(string(content), &vars); err == nil {
+			vars, err = jsonCompatible(vars)
+		}
+	case "dotenv":
+		var env map[string]string
+		if env, err = godotenv.Unmarshal(string(content)); err == nil {
+			vars = make(map[string]interface{}, len(env))
+			for name, value := range env {
+				vars[name] = value
+			}
+		}
+	default:
+		err = fmt.Errorf("Unsupported vars format: %s", format)
+	}
+	if err != nil {
+		err = yamlpos.Wrap(name, content, err)
+	}
+	return
+}
+
+// jsonCompatible converts toml values (integers, dates) the way values of yaml files are converted
+func jsonCompatible(vars map[string]interface{}) (output map[string]interface{}, err error) {
+	content, err := json.Marshal(vars)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, &output)
+	return
+}
+
+// envVars returns env vars with the prefix. The prefix is trimmed, names are
+// lowercased and __ in names separates nested vars: APP_DB__HOST is db.host.
+// Env vars setting the same var or a var and its nested var (APP_DB and
+// APP_DB__HOST) are an error
+func envVars(prefix string) (map[string]interface{}, error) {
+	environ := os.Environ()
+	sort.Strings(environ)
+	vars := make(map[string]interface{})
+	var paths, names []string
+	for _, env := range environ {
+		parts := strings.SplitN(env, "=", 2)
+		name := strings.TrimPrefix(parts[0], prefix)
+		if len(parts) != 2 || name == parts[0] || name == "" {
+			continue
+		}
+		keys := strings.Split(strings.ToLower(name), envNestingSeparator)
+		path := strings.Join(keys, ".")
+		for i, other := range paths {
+			if other == path || strings.HasPrefix(other, path+".") || strings.HasPrefix(path, other+".") {
+				return nil, fmt.Errorf("Env vars %s and %s conflict: both set %s", names[i], parts[0], shorterPath(other, path))
+			}
+		}
+		paths = append(paths, path)
+		names = append(names, parts[0])
+		nested := vars
+		for _, key := range keys[:len(keys)-1] {
+			next, ok := nested[key].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				nested[key] = next
+			}
+			nested = next
+		}
+		nested[keys[len(keys)-1]] = parts[1]
+	}
+	return vars, nil
+}
+
+func shorterPath(a, b string) string {
+	if len(a) < len(b) {
+		return a
+	}
+	return b
+}
+
+// mountVars returns vars under the dotted key
+func mountVars(vars map[string]interface{}, key string) map[string]interface{} {
+	keys := strings.Split(key, ".")
+	for i := len(keys) - 1; i >= 0; i-- {
+		vars = map[string]interface{}{keys[i]: vars}
+	}
+	return vars
+}
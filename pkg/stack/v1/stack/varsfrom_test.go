@@ -0,0 +1,54 @@
+package stack
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvVars(t *testing.T) {
+	setEnv(t, "STACKTEST_DB__HOST", "db.local")
+	setEnv(t, "STACKTEST_DB__PORT", "5432")
+	setEnv(t, "STACKTEST_REGION", "eu")
+	vars, err := envVars("STACKTEST_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"db":     map[string]interface{}{"host": "db.local", "port": "5432"},
+		"region": "eu",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("envVars = %v, want %v", vars, want)
+	}
+}
+
+func TestEnvVarsConflict(t *testing.T) {
+	for _, env := range [][2]string{
+		{"STACKCONFLICT_DB", "STACKCONFLICT_DB__HOST"},
+		{"STACKCONFLICT_DB", "STACKCONFLICT_db"},
+	} {
+		t.Run(env[1], func(t *testing.T) {
+			setEnv(t, env[0], "a")
+			setEnv(t, env[1], "b")
+			_, err := envVars("STACKCONFLICT_")
+			if err == nil || !strings.Contains(err.Error(), "both set db") {
+				t.Errorf("envVars = %v, want the conflict of %s and %s", err, env[0], env[1])
+			}
+		})
+	}
+}
+
+// setEnv sets the env var until the end of the test
+func setEnv(t *testing.T, name, value string) {
+	previous, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
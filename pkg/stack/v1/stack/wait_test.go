@@ -0,0 +1,32 @@
+package stack
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+func TestWaitTimeout(t *testing.T) {
+	stack := loadTestStack(t, map[string]string{
+		"stack.yaml": `api: v1
+wait: "false"
+waitTimeout: 100ms
+`,
+	})
+	goroutines := runtime.NumGoroutine()
+	err := stack.Start(nil)
+	if code := types.ExitCode(err); code != consts.ExitCodeWaitTimeout {
+		t.Errorf("Start = %v, exit code %d, want %d", err, code, consts.ExitCodeWaitTimeout)
+	}
+	// checking the condition stops on timeout
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runtime.NumGoroutine() > goroutines {
+		t.Errorf("%d goroutines are left after the wait timeout", runtime.NumGoroutine()-goroutines)
+	}
+}
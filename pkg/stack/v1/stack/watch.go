@@ -0,0 +1,18 @@
+package stack
+
+// watch records files loaded by the stack for --watch
+func (stack *Stack) watch(paths ...string) {
+	stack.state.Watch.Add(stack.pathFromRoot(), paths...)
+}
+
+// watchLibs records lib dirs where child stacks of the stack are looked up.
+// The root workdir is a lib of every stack, it is watched for the root stack only
+func (stack *Stack) watchLibs() {
+	stackPath := stack.pathFromRoot()
+	for _, libDir := range stack.Libs {
+		if libDir == stack.state.Config.Workdir && stackPath != "." {
+			continue
+		}
+		stack.state.Watch.AddDir(stackPath, libDir)
+	}
+}
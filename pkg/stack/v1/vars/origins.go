@@ -0,0 +1,110 @@
+package vars
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/kruglovmax/stack/pkg/types"
+)
+
+// TagVars returns a copy of raw vars with every value replaced by origin.
+// Var names keep their modifiers, so tagged vars merged the same way as
+// the vars themselves show where every resolved value came from.
+// List items are tagged one by one, nil values stay nil
+func TagVars(rawVars map[string]interface{}, origin *types.VarOrigin) map[string]interface{} {
+	output := make(map[string]interface{}, len(rawVars))
+	for key, value := range rawVars {
+		output[key] = tagValue(value, origin)
+	}
+	return output
+}
+
+func tagValue(value interface{}, origin *types.VarOrigin) interface{} {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		return TagVars(value, origin)
+	case []interface{}:
+		output := make([]interface{}, len(value))
+		for i, item := range value {
+			if item != nil {
+				output[i] = origin
+			}
+		}
+		return output
+	}
+	return origin
+}
+
+// Explain returns resolved vars sorted by key with origins from tagged vars
+func Explain(stackVars, origins *types.StackVars) (output []*types.ExplainedVar) {
+	var originVars map[string]interface{}
+	if origins != nil {
+		originVars = origins.Vars
+	}
+	return explain("", stackVars.Vars, stackVars.Modifiers, originVars, "")
+}
+
+func explain(prefix string, stackVars, modifiers, origins map[string]interface{}, modifier string) (output []*types.ExplainedVar) {
+	keys := make([]string, 0, len(stackVars))
+	for key := range stackVars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+		keyModifier := modifier
+		if keyModifiers, ok := modifiers[key+thisVarModifiersSuffix].(StackVarsModifiers); ok {
+			keyModifier = keyModifiers.String()
+		}
+		switch value := stackVars[key].(type) {
+		case map[string]interface{}:
+			subModifiers, _ := modifiers[key].(map[string]interface{})
+			subOrigins, _ := origins[key].(map[string]interface{})
+			output = append(output, explain(name, value, subModifiers, subOrigins, keyModifier)...)
+			continue
+		case []interface{}:
+			if itemOrigins, ok := origins[key].([]interface{}); ok && len(itemOrigins) == len(value) {
+				for i, item := range value {
+					origin, _ := itemOrigins[i].(*types.VarOrigin)
+					output = append(output, &types.ExplainedVar{
+						Key:      fmt.Sprintf("%s[%d]", name, i),
+						Value:    item,
+						Modifier: keyModifier,
+						Origin:   origin,
+					})
+				}
+				continue
+			}
+		}
+		origin, _ := origins[key].(*types.VarOrigin)
+		output = append(output, &types.ExplainedVar{
+			Key:      name,
+			Value:    stackVars[key],
+			Modifier: keyModifier,
+			Origin:   origin,
+		})
+	}
+	return
+}
+
+// String returns suffixes of the modifiers as they are written in var names
+func (modifiers StackVarsModifiers) String() (output string) {
+	switch {
+	case modifiers.AllUpdate:
+		output = VarsSuffixes["AllUpdate"]
+	case modifiers.Update:
+		output = VarsSuffixes["Update"]
+	}
+	if modifiers.Clear {
+		output += VarsSuffixes["Clear"]
+	}
+	if modifiers.Weak {
+		output += VarsSuffixes["Weak"]
+	}
+	return
+}
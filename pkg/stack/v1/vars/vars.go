@@ -1,13 +1,10 @@
 package vars
 
 import (
-	"runtime/debug"
+	"fmt"
 	"strings"
 
-	"github.com/davecgh/go-spew/spew"
-
 	"github.com/kruglovmax/stack/pkg/consts"
-	"github.com/kruglovmax/stack/pkg/log"
 	"github.com/kruglovmax/stack/pkg/types"
 )
 
@@ -20,9 +17,6 @@ type StackVarsModifiers struct {
 }
 
 var (
-	// FlagsGlobal var
-	FlagsGlobal *types.StackFlags
-
 	// VarsSuffixDelimeter var
 	VarsSuffixDelimeter = "^"
 
@@ -37,54 +31,52 @@ var (
 	thisVarModifiersSuffix = "_modifiers"
 )
 
-func init() {
-	if FlagsGlobal == nil {
-		FlagsGlobal = new(types.StackFlags)
-		if FlagsGlobal.Vars == nil {
-			FlagsGlobal.Vars = make(map[string]interface{})
-		}
-	}
+// VarError is a problem of the var at Path.
+// Path consists of raw var names with modifiers as they are written in vars
+type VarError struct {
+	Path    []string
+	Message string
+}
+
+// Error func
+func (e *VarError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Message, strings.Join(e.Path, "."))
 }
 
-// ParseVars func
-func ParseVars(varsFromConfig map[string]interface{}) *types.StackVars {
-	return parseVars(varsFromConfig, nil)
+// ParseVars func. Problems of var names are passed to warn,
+// nil warn ignores them. Double definitions are returned as *VarError
+func ParseVars(varsFromConfig map[string]interface{}, warn func(*VarError)) (*types.StackVars, error) {
+	return parseVars(varsFromConfig, nil, nil, warn)
 }
 
-func parseVars(varsFromConfig map[string]interface{}, parentVarModifiers *StackVarsModifiers) (stackVars *types.StackVars) {
+func parseVars(varsFromConfig map[string]interface{}, parentVarModifiers *StackVarsModifiers, path []string, warn func(*VarError)) (stackVars *types.StackVars, err error) {
 	stackVars = new(types.StackVars)
 	modifiers := make(map[string]interface{})
 	vars := make(map[string]interface{})
 
 	for varRawName, varValue := range varsFromConfig {
-		varName, varModifiers := ParseVarModifiers(varRawName, parentVarModifiers)
+		varPath := append(append([]string(nil), path...), varRawName)
+		varName, varModifiers, warnings := parseVarModifiers(varRawName, parentVarModifiers)
+		if warn != nil {
+			for _, warning := range warnings {
+				warn(&VarError{Path: varPath, Message: warning})
+			}
+		}
+		if _, ok := modifiers[varName+thisVarModifiersSuffix]; ok {
+			err = &VarError{Path: varPath, Message: consts.MessageVarsDoubleDefinition}
+			return
+		}
 		switch varValue.(type) {
 		case map[string]interface{}:
-			stackSubVars := parseVars(varValue.(map[string]interface{}), &varModifiers)
-			_, ok := modifiers[varName]
-			if ok {
-				log.Logger.Trace().
-					Msg(spew.Sdump(vars))
-				log.Logger.Debug().
-					Msg(string(debug.Stack()))
-				log.Logger.Fatal().
-					Str("var", varName).
-					Msg(consts.MessageVarsDoubleDefinition)
+			var stackSubVars *types.StackVars
+			stackSubVars, err = parseVars(varValue.(map[string]interface{}), &varModifiers, varPath, warn)
+			if err != nil {
+				return
 			}
 			modifiers[varName] = stackSubVars.Modifiers
 			modifiers[varName+thisVarModifiersSuffix] = varModifiers
 			vars[varName] = stackSubVars.Vars
 		default:
-			_, ok := modifiers[varName]
-			if ok {
-				log.Logger.Trace().
-					Msg(spew.Sdump(vars))
-				log.Logger.Debug().
-					Msg(string(debug.Stack()))
-				log.Logger.Fatal().
-					Str("var", varName).
-					Msg(consts.MessageVarsDoubleDefinition)
-			}
 			modifiers[varName+thisVarModifiersSuffix] = varModifiers
 			vars[varName] = varValue
 		}
@@ -94,9 +86,8 @@ func parseVars(varsFromConfig map[string]interface{}, parentVarModifiers *StackV
 	return
 }
 
-// ParseVarModifiers func
-// varRawName - test+
-func ParseVarModifiers(varRawName string, topVarModifiers *StackVarsModifiers) (varName string, modifiers StackVarsModifiers) {
+// parseVarModifiers returns problems of the var name instead of logging them
+func parseVarModifiers(varRawName string, topVarModifiers *StackVarsModifiers) (varName string, modifiers StackVarsModifiers, warnings []string) {
 	varName = varRawName
 	if topVarModifiers != nil {
 		if topVarModifiers.Weak {
@@ -117,20 +108,10 @@ Loop:
 				modifiers.Update = true
 				varName = varLoopName
 				if modifiers.Clear {
-					log.Logger.Debug().
-						Msg(string(debug.Stack()))
-					log.Logger.Warn().
-						Str("Input var name", varRawName).
-						Str("Output var name", varName).
-						Msgf(consts.MessageVarsSimplyfy, varName)
+					warnings = append(warnings, fmt.Sprintf(consts.MessageVarsSimplyfy, varName))
 				}
 			} else {
-				log.Logger.Debug().
-					Msg(string(debug.Stack()))
-				log.Logger.Warn().
-					Str("Input var name", varRawName).
-					Str("Output var name", varName).
-					Msg(consts.MessageVarsBadVarName)
+				warnings = append(warnings, consts.MessageVarsBadVarName)
 				break Loop
 			}
 		} else if varLoopName := strings.TrimSuffix(varName, VarsSuffixes["Update"]); varLoopName != varName {
@@ -139,21 +120,11 @@ Loop:
 				(topVarModifiers == nil || (topVarModifiers != nil && topVarModifiers.Update)) {
 				varName = varLoopName
 				if modifiers.Clear {
-					log.Logger.Debug().
-						Msg(string(debug.Stack()))
-					log.Logger.Warn().
-						Str("Input var name", varRawName).
-						Str("Output var name", varName).
-						Msgf(consts.MessageVarsSimplyfy, varName)
+					warnings = append(warnings, fmt.Sprintf(consts.MessageVarsSimplyfy, varName))
 				}
 				modifiers.Update = true
 			} else {
-				log.Logger.Debug().
-					Msg(string(debug.Stack()))
-				log.Logger.Warn().
-					Str("Input var name", varRawName).
-					Str("Output var name", varName).
-					Msg(consts.MessageVarsBadVarName)
+				warnings = append(warnings, consts.MessageVarsBadVarName)
 				break Loop
 			}
 		} else if varLoopName := strings.TrimSuffix(varName, VarsSuffixes["Clear"]); varLoopName != varName {
@@ -162,20 +133,10 @@ Loop:
 				varName = varLoopName
 				modifiers.Clear = true
 				if modifiers.Update {
-					log.Logger.Debug().
-						Msg(string(debug.Stack()))
-					log.Logger.Warn().
-						Str("Input var name", varRawName).
-						Str("Output var name", varName).
-						Msgf(consts.MessageVarsSimplyfy, varName)
+					warnings = append(warnings, fmt.Sprintf(consts.MessageVarsSimplyfy, varName))
 				}
 			} else {
-				log.Logger.Debug().
-					Msg(string(debug.Stack()))
-				log.Logger.Warn().
-					Str("Input var name", varRawName).
-					Str("Output var name", varName).
-					Msg(consts.MessageVarsBadVarName)
+				warnings = append(warnings, consts.MessageVarsBadVarName)
 				break Loop
 			}
 		} else if varLoopName := strings.TrimSuffix(varName, VarsSuffixes["Weak"]); varLoopName != varName {
@@ -185,12 +146,7 @@ Loop:
 				varName = varLoopName
 				modifiers.Weak = true
 			} else {
-				log.Logger.Debug().
-					Msg(string(debug.Stack()))
-				log.Logger.Warn().
-					Str("Input var name", varRawName).
-					Str("Output var name", varName).
-					Msg(consts.MessageVarsBadVarName)
+				warnings = append(warnings, consts.MessageVarsBadVarName)
 				break Loop
 			}
 		} else if varLoopName := strings.TrimSuffix(varName, VarsSuffixDelimeter); varLoopName != varName {
@@ -0,0 +1,88 @@
+package stack
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/types"
+	"github.com/rs/zerolog"
+)
+
+func TestValidate(t *testing.T) {
+	files := map[string]string{
+		"stack.yaml": `api: v1
+run:
+- script: touch executed
+stacks: [a]
+pstacks: [b]
+`,
+		"a/stack.yaml": `api: v1
+stacks: [nested, bad]
+`,
+		"a/bad/stack.yaml": `api: v1
+run: 5
+`,
+		"a/nested/stack.yaml": `api: v1
+when: vars.x ==
+run:
+- script: ./missing.sh
+- gomplate: [missing.tmpl]
+- foreach: '[1]'
+  run:
+  - script: echo
+    wait: item >
+`,
+		"b/stack.yaml": `api: v1
+stacks: [nosuch]
+`,
+	}
+	dir := writeFiles(t, files)
+	err := validateStack(t, dir)
+	stackErrors, ok := err.(types.StackErrors)
+	if !ok {
+		t.Fatalf("Validate = %v, want all problems of the tree", err)
+	}
+	for _, want := range []string{"when", "missing.sh", "missing.tmpl", "script wait", "bad/stack.yaml", "nosuch"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("problems do not mention %s:\n%v", want, err)
+		}
+	}
+	if len(stackErrors) != 6 {
+		t.Errorf("%d problems found, want 6:\n%v", len(stackErrors), err)
+	}
+	if types.ExitCode(err) != consts.ExitCodeBadStack {
+		t.Errorf("exit code = %d, want %d", types.ExitCode(err), consts.ExitCodeBadStack)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "executed")); !os.IsNotExist(err) {
+		t.Error("validate executed a run item")
+	}
+
+	files["a/nested/stack.yaml"] = "api: v1\nrun:\n- script: ./present.sh\n"
+	files["a/nested/present.sh"] = "echo\n"
+	files["a/bad/stack.yaml"] = "api: v1\n"
+	files["b/stack.yaml"] = "api: v1\n"
+	if err = validateStack(t, writeFiles(t, files)); err != nil {
+		t.Errorf("Validate of the fixed tree = %v", err)
+	}
+}
+
+func validateStack(t *testing.T, dir string) error {
+	t.Helper()
+	logger := zerolog.Nop()
+	runner, err := NewRunner(Options{
+		Config: app.Config{Workdir: dir},
+		Stdout: ioutil.Discard,
+		Stderr: ioutil.Discard,
+		Logger: &logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runner.Validate(context.Background())
+}
@@ -0,0 +1,112 @@
+package stack
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/selector"
+	"github.com/kruglovmax/stack/pkg/watch"
+)
+
+// Watch runs the stack tree and then re-runs stacks whose files changed,
+// with their child stacks, until ctx is done. Stack files, varsFrom files,
+// templates and lib dirs loaded by the run are watched.
+// Returns the result of the last run
+func (runner *Runner) Watch(ctx context.Context) (result *Result) {
+	runner.files = watch.New()
+	defer func() {
+		runner.files = nil
+	}()
+
+	baseline := runner.files.Snapshot()
+	start := time.Now()
+	result = runner.run(ctx, runner.selector)
+	runner.logCycle(1, nil, []string{"."}, result, start)
+
+	for cycle := 2; ctx.Err() == nil; cycle++ {
+		runner.options.Logger.Info().
+			Int("files", runner.files.Len()).
+			Msg(consts.MessageWatching)
+		changed, err := watch.Wait(ctx, runner.files, baseline, runner.options.WatchInterval, consts.WatchDebounce)
+		if err != nil {
+			return
+		}
+		baseline = runner.files.Snapshot()
+		changedSelector, stackPaths := runner.watchSelection(runner.files.Stacks(changed))
+		if len(stackPaths) == 0 {
+			runner.options.Logger.Info().
+				Strs("changed", runner.relPaths(changed)).
+				Msg("No selected stacks changed")
+			cycle--
+			continue
+		}
+		start = time.Now()
+		result = runner.run(ctx, changedSelector)
+		runner.logCycle(cycle, changed, stackPaths, result, start)
+	}
+	return
+}
+
+// watchSelection selects changed stacks allowed by --only and --skip.
+// A change of the root stack or of an ancestor of stacks selected by --only
+// re-runs the whole selection
+func (runner *Runner) watchSelection(stackPaths []string) (*selector.Selector, []string) {
+	var selected []string
+	for _, stackPath := range stackPaths {
+		switch {
+		case runner.selector.Skipped(stackPath):
+		case stackPath == ".":
+			return runner.selector, []string{"."}
+		case runner.selector.Selected(stackPath):
+			selected = append(selected, stackPath)
+		case runner.selector.MayContain(stackPath):
+			return runner.selector, []string{"."}
+		}
+	}
+	if len(selected) == 0 {
+		return nil, nil
+	}
+	only := append([]string(nil), selected...)
+	skip := append([]string(nil), runner.options.Skip...)
+	changedSelector, err := selector.New(only, skip)
+	if err != nil {
+		// stack dirs with pattern characters in names
+		runner.options.Logger.Warn().Msg(err.Error())
+		return runner.selector, []string{"."}
+	}
+	return changedSelector, selected
+}
+
+// logCycle prints the summary of the watch cycle
+func (runner *Runner) logCycle(cycle int, changed, stackPaths []string, result *Result, start time.Time) {
+	statuses := make(map[string]int)
+	for _, stack := range result.Report.Stacks {
+		statuses[stack.Status]++
+	}
+	event := runner.options.Logger.Info()
+	if result.ExitCode != consts.ExitCodeOK {
+		event = runner.options.Logger.Error()
+	}
+	event.
+		Int("cycle", cycle).
+		Strs("changed", runner.relPaths(changed)).
+		Strs("stacks", stackPaths).
+		Interface("statuses", statuses).
+		Str("duration", time.Since(start).Round(time.Millisecond).String()).
+		Int("code", result.ExitCode).
+		Msg(consts.MessageWatchCycle)
+}
+
+func (runner *Runner) relPaths(paths []string) (output []string) {
+	for _, path := range paths {
+		path = strings.TrimSuffix(path, string(filepath.Separator))
+		if rel, err := filepath.Rel(runner.options.Workdir, path); err == nil {
+			path = rel
+		}
+		output = append(output, path)
+	}
+	return
+}
@@ -0,0 +1,68 @@
+package stack
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kruglovmax/stack/pkg/app"
+	"github.com/rs/zerolog"
+)
+
+func TestWatch(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"stack.yaml":   "api: v1\nstacks: [a, b]\nrun:\n" + logScript("root"),
+		"a/stack.yaml": "api: v1\nrun:\n" + logScript("a"),
+		"b/stack.yaml": "api: v1\nrun:\n" + logScript("b"),
+	})
+	logger := zerolog.Nop()
+	runner, err := NewRunner(Options{
+		Config: app.Config{Workdir: dir, WatchInterval: 20 * time.Millisecond},
+		Stdout: ioutil.Discard,
+		Stderr: ioutil.Discard,
+		Logger: &logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		runner.Watch(ctx)
+		close(done)
+	}()
+
+	waitLog := func(want []string) {
+		t.Helper()
+		var log []string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if content, err := ioutil.ReadFile(filepath.Join(dir, "log")); err == nil {
+				if log = strings.Fields(string(content)); reflect.DeepEqual(log, want) {
+					return
+				}
+			}
+		}
+		t.Fatalf("log = %q, want %q", log, want)
+	}
+	waitLog([]string{"root", "a", "b"})
+	if err = ioutil.WriteFile(filepath.Join(dir, "a", "stack.yaml"), []byte("api: v1\nrun:\n"+logScript("a2")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitLog([]string{"root", "a", "b", "a2"})
+	if err = ioutil.WriteFile(filepath.Join(dir, "stack.yaml"), []byte("api: v1\nstacks: [a, b]\nrun:\n"+logScript("root2")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitLog([]string{"root", "a", "b", "a2", "root2", "a2", "b"})
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch is not stopped by the cancelled context")
+	}
+}
@@ -0,0 +1,50 @@
+package stackrc
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/kruglovmax/stack/pkg/consts"
+	"github.com/kruglovmax/stack/pkg/misc"
+)
+
+// Find returns the project config file in dir or in the closest parent dir.
+// Returns empty string if there is no project config
+func Find(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		file := filepath.Join(dir, consts.StackRCFileName)
+		if misc.PathIsExists(file) {
+			return file, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// Load returns values of the project config by keys.
+// Values are scalars or lists of scalars
+func Load(file string) (values map[string]interface{}, err error) {
+	if err = misc.LoadYAMLFromFile(file, &values); err != nil {
+		return
+	}
+	for key, value := range values {
+		items, isList := value.([]interface{})
+		if !isList {
+			items = []interface{}{value}
+		}
+		for _, item := range items {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				return nil, fmt.Errorf("%s: %s: value must be a scalar or a list of scalars", file, key)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package types
+
+import (
+	"strings"
+
+	"github.com/kruglovmax/stack/pkg/consts"
+)
+
+// StackError is a failure of a stack or of one of its run items
+type StackError struct {
+	Stack   Stack
+	RunItem RunItem
+	Code    int
+	Err     error
+}
+
+// StackErrors is a list of failures collected from a stack tree
+type StackErrors []*StackError
+
+// NewStackError func
+func NewStackError(stack Stack, runItem RunItem, code int, err error) *StackError {
+	return &StackError{
+		Stack:   stack,
+		RunItem: runItem,
+		Code:    code,
+		Err:     err,
+	}
+}
+
+// WrapError attaches stack and run item to err.
+// Already wrapped errors keep their code and only get missing fields filled.
+func WrapError(stack Stack, runItem RunItem, code int, err error) error {
+	switch err.(type) {
+	case nil:
+		return nil
+	case *StackError:
+		stackError := err.(*StackError)
+		if stackError.Stack == nil {
+			stackError.Stack = stack
+		}
+		if stackError.RunItem == nil {
+			stackError.RunItem = runItem
+		}
+		return stackError
+	case StackErrors:
+		return err
+	}
+	return NewStackError(stack, runItem, code, err)
+}
+
+// Error func
+func (e *StackError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap func
+func (e *StackError) Unwrap() error {
+	return e.Err
+}
+
+// Error func
+func (e StackErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, stackError := range e {
+		messages = append(messages, stackError.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Append adds err to the list flattening nested StackErrors
+func (e StackErrors) Append(err error) StackErrors {
+	switch err.(type) {
+	case nil:
+		return e
+	case *StackError:
+		return append(e, err.(*StackError))
+	case StackErrors:
+		return append(e, err.(StackErrors)...)
+	}
+	return append(e, NewStackError(nil, nil, consts.ExitCodeScriptFailed, err))
+}
+
+// ErrorOrNil returns nil for an empty list
+func (e StackErrors) ErrorOrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// ExitCode returns the exit code of the first failure
+func ExitCode(err error) int {
+	switch err.(type) {
+	case nil:
+		return consts.ExitCodeOK
+	case *StackError:
+		return err.(*StackError).Code
+	case StackErrors:
+		if len(err.(StackErrors)) > 0 {
+			return err.(StackErrors)[0].Code
+		}
+		return consts.ExitCodeOK
+	}
+	return consts.ExitCodeScriptFailed
+}
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"context"
 	"sync"
 )
 
@@ -11,13 +12,16 @@ type Config interface {
 
 // Stack interface
 type Stack interface {
-	AddRawVarsLeft(map[string]interface{})
-	AddRawVarsRight(map[string]interface{})
-	Start(*sync.WaitGroup)
-	PreExec(*sync.WaitGroup)
-	Exec(*sync.WaitGroup)
-	PostExec(*sync.WaitGroup)
+	AddRawVarsLeft(map[string]interface{}, string) error
+	AddRawVarsRight(map[string]interface{}, string) error
+	AddFlags(map[string]interface{}) error
+	Cancel()
+	Start(*sync.WaitGroup) error
+	PreExec(*sync.WaitGroup) error
+	Exec(*sync.WaitGroup) error
+	PostExec(*sync.WaitGroup) error
 	GetAPI() string
+	GetContext() context.Context
 	GetLibs() []string
 	GetName() string
 	GetInput() *StackInput
@@ -29,9 +33,12 @@ type Stack interface {
 	GetStackID() string
 	GetView() interface{}
 	GetWorkdir() string
+	Plan() (*StackPlan, error)
+	Validate() error
+	ExplainVars() *ExplainedStackVars
 	SetStatus(string)
-	LoadFromFile(string, Stack)
-	LoadFromString(string, Stack)
+	LoadFromFile(string, Stack) error
+	LoadFromString(string, Stack) error
 }
 
 // StackVars type
@@ -71,6 +78,40 @@ type StacksStatus struct {
 	Mux          sync.Mutex
 }
 
+// StacksOutputs type. Outputs of stacks by stack path
+type StacksOutputs struct {
+	StacksOutputs map[string]map[string]interface{}
+	Mux           sync.Mutex
+}
+
+// VarOrigin is the source of a var value
+type VarOrigin struct {
+	// Stack is the path of the stack where the value was set
+	Stack  string `json:"stack"`
+	Source string `json:"source"`
+}
+
+// ExplainedVar is a resolved var with its origin. Key is the dotted path of the var
+type ExplainedVar struct {
+	Key      string      `json:"key"`
+	Value    interface{} `json:"value"`
+	Modifier string      `json:"modifier,omitempty"`
+	Origin   *VarOrigin  `json:"origin,omitempty"`
+}
+
+// ExplainedStackVars holds resolved vars of a stack with their origins
+type ExplainedStackVars struct {
+	Path string          `json:"path"`
+	Name string          `json:"name"`
+	Vars []*ExplainedVar `json:"vars"`
+}
+
+// ExplainedVars type. Vars of stacks explained during the run
+type ExplainedVars struct {
+	Stacks []*ExplainedStackVars
+	Mux    sync.Mutex
+}
+
 // ExecExitCode of stack
 type ExecExitCode struct {
 	Status  uint64
@@ -79,7 +120,48 @@ type ExecExitCode struct {
 
 // RunItem interface
 type RunItem interface {
-	Exec(*sync.WaitGroup)
+	Exec(*sync.WaitGroup) error
+	Plan() *RunItemPlan
+}
+
+// StackPlan is a dry-run view of a stack and its children
+type StackPlan struct {
+	Path            string                 `json:"path"`
+	Name            string                 `json:"name"`
+	Workdir         string                 `json:"workdir"`
+	Input           interface{}            `json:"input,omitempty"`
+	Vars            map[string]interface{} `json:"vars,omitempty"`
+	Flags           map[string]interface{} `json:"flags,omitempty"`
+	Locals          map[string]interface{} `json:"locals,omitempty"`
+	When            string                 `json:"when,omitempty"`
+	Wait            string                 `json:"wait,omitempty"`
+	WaitTimeout     string                 `json:"waitTimeout,omitempty"`
+	WaitGroups      []string               `json:"waitGroups,omitempty"`
+	Retries         int                    `json:"retries,omitempty"`
+	ContinueOnError bool                   `json:"continueOnError,omitempty"`
+	MaxParallel     int                    `json:"maxParallel,omitempty"`
+	Ancestor        bool                   `json:"ancestor,omitempty"`
+	Outputs         map[string]string      `json:"outputs,omitempty"`
+	PreRun          []*RunItemPlan         `json:"preRun,omitempty"`
+	Run             []*RunItemPlan         `json:"run,omitempty"`
+	Stacks          []*StackPlan           `json:"stacks,omitempty"`
+	ParallelStacks  []*StackPlan           `json:"pstacks,omitempty"`
+	PostRun         []*RunItemPlan         `json:"postRun,omitempty"`
+}
+
+// RunItemPlan is a dry-run view of a run item
+type RunItemPlan struct {
+	Type            string         `json:"type"`
+	Value           interface{}    `json:"value,omitempty"`
+	Vars            interface{}    `json:"vars,omitempty"`
+	Output          []interface{}  `json:"output,omitempty"`
+	When            string         `json:"when,omitempty"`
+	Wait            string         `json:"wait,omitempty"`
+	Parallel        bool           `json:"parallel,omitempty"`
+	MaxParallel     int            `json:"maxParallel,omitempty"`
+	Retries         int            `json:"retries,omitempty"`
+	ContinueOnError bool           `json:"continueOnError,omitempty"`
+	Items           []*RunItemPlan `json:"items,omitempty"`
 }
 
 // RunItemParser interface
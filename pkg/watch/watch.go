@@ -0,0 +1,253 @@
+package watch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files maps watched paths to the stacks which loaded them.
+// A nil Files watches nothing
+type Files struct {
+	mux   sync.Mutex
+	paths map[string]*entry
+}
+
+type entry struct {
+	// listing is true for lib dirs, only their subdirectories are watched
+	listing bool
+	stacks  map[string]bool
+	// fingerprint when the path was added, changes made while the stack
+	// that loaded it is still running are compared with it
+	added string
+}
+
+// Snapshot holds fingerprints of watched paths
+type Snapshot map[string]string
+
+// New func
+func New() *Files {
+	files := new(Files)
+	files.paths = make(map[string]*entry)
+	return files
+}
+
+// Add watches content of files and directories loaded by the stack.
+// stackPath is relative to the root stack
+func (files *Files) Add(stackPath string, paths ...string) {
+	files.add(stackPath, false, paths)
+}
+
+// AddDir watches the list of subdirectories of dirs. Used for lib dirs
+// where child stacks are looked up
+func (files *Files) AddDir(stackPath string, dirs ...string) {
+	files.add(stackPath, true, dirs)
+}
+
+func (files *Files) add(stackPath string, listing bool, paths []string) {
+	if files == nil {
+		return
+	}
+	files.mux.Lock()
+	defer files.mux.Unlock()
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		key := path
+		if listing {
+			key = path + string(filepath.Separator)
+		}
+		e, ok := files.paths[key]
+		if !ok {
+			e = &entry{listing: listing, stacks: make(map[string]bool)}
+			e.added = e.fingerprint(key)
+			files.paths[key] = e
+		}
+		e.stacks[stackPath] = true
+	}
+}
+
+// Len returns the number of watched paths
+func (files *Files) Len() int {
+	if files == nil {
+		return 0
+	}
+	files.mux.Lock()
+	defer files.mux.Unlock()
+	return len(files.paths)
+}
+
+// Snapshot returns fingerprints of all watched paths
+func (files *Files) Snapshot() Snapshot {
+	snapshot := make(Snapshot)
+	if files == nil {
+		return snapshot
+	}
+	files.mux.Lock()
+	entries := make(map[string]*entry, len(files.paths))
+	for key, e := range files.paths {
+		entries[key] = e
+	}
+	files.mux.Unlock()
+	for key, e := range entries {
+		snapshot[key] = e.fingerprint(key)
+	}
+	return snapshot
+}
+
+// added returns fingerprints of paths taken when they were added
+func (files *Files) added() Snapshot {
+	snapshot := make(Snapshot)
+	if files == nil {
+		return snapshot
+	}
+	files.mux.Lock()
+	defer files.mux.Unlock()
+	for key, e := range files.paths {
+		snapshot[key] = e.added
+	}
+	return snapshot
+}
+
+func (e *entry) fingerprint(key string) string {
+	if e.listing {
+		return listingFingerprint(strings.TrimSuffix(key, string(filepath.Separator)))
+	}
+	return fingerprint(key)
+}
+
+// Stacks returns sorted paths of the stacks which loaded the changed paths
+func (files *Files) Stacks(changed []string) (stackPaths []string) {
+	if files == nil {
+		return
+	}
+	files.mux.Lock()
+	defer files.mux.Unlock()
+	seen := make(map[string]bool)
+	for _, key := range changed {
+		if e, ok := files.paths[key]; ok {
+			for stackPath := range e.stacks {
+				if !seen[stackPath] {
+					seen[stackPath] = true
+					stackPaths = append(stackPaths, stackPath)
+				}
+			}
+		}
+	}
+	sort.Strings(stackPaths)
+	return
+}
+
+// Changed returns sorted paths whose fingerprints differ. Paths missing
+// in baseline are new and not reported
+func Changed(baseline, current Snapshot) (changed []string) {
+	for key, value := range current {
+		if old, ok := baseline[key]; ok && old != value {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return
+}
+
+// Wait polls files every interval until some of them change and then
+// stay unchanged for debounce. Paths added to files after baseline was taken
+// are compared with their fingerprint when they were added. Returns ctx.Err() if ctx is done
+func Wait(ctx context.Context, files *Files, baseline Snapshot, interval, debounce time.Duration) (changed []string, err error) {
+	baseline = copySnapshot(baseline)
+	var last Snapshot
+	var lastChange time.Time
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+		current := files.Snapshot()
+		var added Snapshot
+		for key := range current {
+			if _, ok := baseline[key]; !ok {
+				if added == nil {
+					added = files.added()
+				}
+				baseline[key] = added[key]
+			}
+		}
+		if last == nil {
+			if len(Changed(baseline, current)) > 0 {
+				last = current
+				lastChange = time.Now()
+			}
+			continue
+		}
+		if len(Changed(last, current)) > 0 {
+			last = current
+			lastChange = time.Now()
+			continue
+		}
+		if time.Since(lastChange) >= debounce {
+			return Changed(baseline, current), nil
+		}
+	}
+}
+
+func copySnapshot(snapshot Snapshot) Snapshot {
+	output := make(Snapshot, len(snapshot))
+	for key, value := range snapshot {
+		output[key] = value
+	}
+	return output
+}
+
+// fingerprint of a file is its size and mtime, of a directory
+// the hash of fingerprints of all its files
+func fingerprint(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "-"
+	}
+	if !info.IsDir() {
+		return fileFingerprint(info)
+	}
+	hash := sha256.New()
+	filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			fmt.Fprintf(hash, "%s %s\n", file, fileFingerprint(info))
+		}
+		return nil
+	})
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func fileFingerprint(info os.FileInfo) string {
+	return fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+}
+
+func listingFingerprint(dir string) string {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "-"
+	}
+	var dirs []string
+	for _, fileInfo := range fileInfos {
+		// hidden dirs hold state, git clones and git libs of the run
+		if fileInfo.IsDir() && !strings.HasPrefix(fileInfo.Name(), ".") {
+			dirs = append(dirs, fileInfo.Name())
+		}
+	}
+	return strings.Join(dirs, "\n")
+}
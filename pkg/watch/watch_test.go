@@ -0,0 +1,121 @@
+package watch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStacks(t *testing.T) {
+	files := New()
+	files.Add(".", "/stack/stack.yaml", "/stack/common.yaml")
+	files.Add("app", "/stack/app/stack.yaml", "/stack/common.yaml")
+	files.AddDir("app", "/stack/libs")
+	for _, test := range []struct {
+		changed []string
+		want    []string
+	}{
+		{[]string{"/stack/app/stack.yaml"}, []string{"app"}},
+		{[]string{"/stack/common.yaml"}, []string{".", "app"}},
+		{[]string{"/stack/libs/"}, []string{"app"}},
+		{[]string{"/stack/other.yaml"}, nil},
+	} {
+		if stacks := files.Stacks(test.changed); !reflect.DeepEqual(stacks, test.want) {
+			t.Errorf("Stacks(%q) = %q, want %q", test.changed, stacks, test.want)
+		}
+	}
+	if files.Len() != 4 {
+		t.Errorf("Len() = %d, want 4", files.Len())
+	}
+}
+
+func TestChanged(t *testing.T) {
+	baseline := Snapshot{"a": "1", "b": "1", "c": "1"}
+	current := Snapshot{"a": "1", "b": "2", "c": "-", "d": "1"}
+	if changed := Changed(baseline, current); !reflect.DeepEqual(changed, []string{"b", "c"}) {
+		t.Errorf("Changed = %q, want [b c]", changed)
+	}
+}
+
+func TestWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, libs := filepath.Join(dir, "stack.yaml"), filepath.Join(dir, "libs")
+	if err = ioutil.WriteFile(file, []byte("api: v1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(libs, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	files := New()
+	files.Add(".", file)
+	files.AddDir(".", libs)
+
+	for _, test := range []struct {
+		change func() error
+		want   []string
+	}{
+		{
+			func() error { return ioutil.WriteFile(file, []byte("api: v1\nrun: []\n"), 0644) },
+			[]string{file},
+		},
+		{
+			func() error { return os.Mkdir(filepath.Join(libs, "lib"), os.ModePerm) },
+			[]string{libs + string(filepath.Separator)},
+		},
+		{
+			// hidden dirs of lib dirs are not watched
+			func() error { return os.Mkdir(filepath.Join(libs, ".git"), os.ModePerm) },
+			nil,
+		},
+	} {
+		baseline := files.Snapshot()
+		if err = test.change(); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		changed, err := Wait(ctx, files, baseline, 10*time.Millisecond, 50*time.Millisecond)
+		cancel()
+		if test.want == nil {
+			if err != context.DeadlineExceeded {
+				t.Errorf("Wait = %q, %v, want no change", changed, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(changed, test.want) {
+			t.Errorf("Wait = %q, %v, want %q", changed, err, test.want)
+		}
+	}
+}
+
+func TestWaitChangedBeforeWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "stack.yaml")
+	if err = ioutil.WriteFile(file, []byte("api: v1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := New()
+	baseline := files.Snapshot()
+	// the file is loaded by the run and changed before the run is finished
+	files.Add(".", file)
+	if err = ioutil.WriteFile(file, []byte("api: v1\nrun: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	changed, err := Wait(ctx, files, baseline, 10*time.Millisecond, 50*time.Millisecond)
+	if err != nil || !reflect.DeepEqual(changed, []string{file}) {
+		t.Errorf("Wait = %q, %v, want %q", changed, err, []string{file})
+	}
+}
@@ -0,0 +1,218 @@
+package yamlpos
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var lineRef = regexp.MustCompile(`line (\d+): `)
+
+// Document is a parsed YAML file keeping positions of its nodes
+type Document struct {
+	File  string
+	lines []string
+	root  *yaml.Node
+}
+
+// Error is a problem at the position in the YAML file.
+// Line and Column are 1-based, zero Line means the position is unknown
+type Error struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+	Snippet string
+}
+
+// Errors is a list of problems in YAML files
+type Errors []*Error
+
+// Error returns the problem as file:line:col: message with the source snippet
+func (e *Error) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Message)
+	}
+	output := fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+	if e.Snippet != "" {
+		output += "\n" + e.Snippet
+	}
+	return output
+}
+
+// Error func
+func (errs Errors) Error() string {
+	output := make([]string, 0, len(errs))
+	for _, e := range errs {
+		output = append(output, e.Error())
+	}
+	return strings.Join(output, "\n")
+}
+
+// ErrorOrNil func
+func (errs Errors) ErrorOrNil() error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return errs
+}
+
+// IsPositioned reports whether err already names the file it came from
+func IsPositioned(err error) bool {
+	var e *Error
+	var errs Errors
+	return errors.As(err, &e) || errors.As(err, &errs)
+}
+
+// Parse parses content of the file keeping positions of nodes.
+// Syntax errors are returned as *Error
+func Parse(file string, content []byte) (doc *Document, err error) {
+	doc = &Document{
+		File:  file,
+		lines: strings.Split(string(content), "\n"),
+		root:  new(yaml.Node),
+	}
+	if err = yaml.Unmarshal(content, doc.root); err != nil {
+		return nil, doc.Wrap(err)
+	}
+	if doc.root.Kind == yaml.DocumentNode && len(doc.root.Content) > 0 {
+		doc.root = doc.root.Content[0]
+	}
+	return
+}
+
+// Wrap returns *Error for errors of YAML parsers referring to lines of the document
+// and for other errors prefixes them with the file name
+func Wrap(file string, content []byte, err error) error {
+	doc := &Document{
+		File:  file,
+		lines: strings.Split(string(content), "\n"),
+	}
+	return doc.Wrap(err)
+}
+
+// Wrap func
+func (doc *Document) Wrap(err error) error {
+	if err == nil || IsPositioned(err) {
+		return err
+	}
+	message := err.Error()
+	match := lineRef.FindStringSubmatchIndex(message)
+	if match == nil {
+		return &Error{File: doc.File, Message: message}
+	}
+	line, _ := strconv.Atoi(message[match[2]:match[3]])
+	// parsers report only lines, point at the first non-blank character
+	column := 1
+	if line > 0 && line <= len(doc.lines) {
+		column += len(doc.lines[line-1]) - len(strings.TrimLeft(doc.lines[line-1], " \t"))
+	}
+	return doc.errorAt(line, column, message[match[1]:])
+}
+
+// Errorf returns the problem at the node found by path.
+// path consists of mapping keys and sequence indexes, the closest existing
+// parent node is used if the node is not found
+func (doc *Document) Errorf(path []string, format string, a ...interface{}) *Error {
+	line, column := doc.Position(path)
+	return doc.errorAt(line, column, fmt.Sprintf(format, a...))
+}
+
+// Position returns the line and the column of the node found by path.
+// The position of the key is returned for mapping values
+func (doc *Document) Position(path []string) (line, column int) {
+	line, column, _ = doc.find(path)
+	return
+}
+
+// Sub returns the document of the node found by path, e.g. an inline stack
+// in the parent stack file. Positions of the sub document are in the same file.
+// Returns nil if there is no such node
+func (doc *Document) Sub(path []string) *Document {
+	if doc == nil {
+		return nil
+	}
+	_, _, node := doc.find(path)
+	if node == nil {
+		return nil
+	}
+	return &Document{File: doc.File, lines: doc.lines, root: node}
+}
+
+// find returns the position of the node found by path and the node.
+// The node is nil and the position is of the closest existing parent
+// if the node is not found
+func (doc *Document) find(path []string) (line, column int, node *yaml.Node) {
+	line, column = 1, 1
+	node = doc.root
+	if node == nil {
+		return
+	}
+	if node.Line > 0 {
+		line, column = node.Line, node.Column
+	}
+	for _, part := range path {
+		var next, position *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == part {
+					position, next = node.Content[i], node.Content[i+1]
+				}
+			}
+		case yaml.SequenceNode:
+			if index, err := strconv.Atoi(part); err == nil && index >= 0 && index < len(node.Content) {
+				position, next = node.Content[index], node.Content[index]
+			}
+		}
+		if next == nil {
+			return line, column, nil
+		}
+		line, column = position.Line, position.Column
+		for next.Kind == yaml.AliasNode && next.Alias != nil {
+			next = next.Alias
+		}
+		node = next
+	}
+	return
+}
+
+func (doc *Document) errorAt(line, column int, message string) *Error {
+	return &Error{
+		File:    doc.File,
+		Line:    line,
+		Column:  column,
+		Message: message,
+		Snippet: doc.snippet(line, column),
+	}
+}
+
+// snippet returns the line with a caret under the column
+func (doc *Document) snippet(line, column int) string {
+	if line < 1 || line > len(doc.lines) {
+		return ""
+	}
+	source := strings.TrimRight(doc.lines[line-1], "\r")
+	prefix := strings.Repeat(" ", len(strconv.Itoa(line)))
+	caret := strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return r
+		}
+		return ' '
+	}, string([]rune(source)[:min(column-1, len([]rune(source)))]))
+	return fmt.Sprintf(" %d | %s\n %s | %s^", line, source, prefix, caret)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
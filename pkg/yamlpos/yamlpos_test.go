@@ -0,0 +1,117 @@
+package yamlpos
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const stackYAML = `api: v1
+vars:
+  region: eu
+  list:
+  - a
+  - b
+stacks:
+- name: inline
+  vars:
+    x: 1
+`
+
+func parse(t *testing.T) *Document {
+	t.Helper()
+	doc, err := Parse("stack.yaml", []byte(stackYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestPosition(t *testing.T) {
+	doc := parse(t)
+	for _, test := range []struct {
+		path         []string
+		line, column int
+	}{
+		{nil, 1, 1},
+		{[]string{"vars", "region"}, 3, 3},
+		{[]string{"vars", "list", "1"}, 6, 5},
+		{[]string{"stacks", "0", "vars", "x"}, 10, 5},
+		// the closest existing parent
+		{[]string{"vars", "missing"}, 2, 1},
+		{[]string{"vars", "list", "5"}, 4, 3},
+	} {
+		line, column := doc.Position(test.path)
+		if line != test.line || column != test.column {
+			t.Errorf("Position(%v) = %d:%d, want %d:%d", test.path, line, column, test.line, test.column)
+		}
+	}
+}
+
+func TestErrorf(t *testing.T) {
+	err := parse(t).Errorf([]string{"vars", "region"}, "bad %s", "region")
+	want := "stack.yaml:3:3: bad region\n 3 |   region: eu\n   |   ^"
+	if err.Error() != want {
+		t.Errorf("Errorf =\n%s\nwant\n%s", err.Error(), want)
+	}
+}
+
+func TestSub(t *testing.T) {
+	doc := parse(t)
+	sub := doc.Sub([]string{"stacks", "0"})
+	if sub == nil {
+		t.Fatal("Sub of the inline stack is nil")
+	}
+	if line, column := sub.Position([]string{"vars", "x"}); line != 10 || column != 5 {
+		t.Errorf("Position in the sub document = %d:%d, want 10:5", line, column)
+	}
+	if err := sub.Errorf([]string{"vars", "x"}, "bad"); err.File != "stack.yaml" {
+		t.Errorf("File of the sub document error = %q, want stack.yaml", err.File)
+	}
+	if doc.Sub([]string{"stacks", "1"}) != nil {
+		t.Error("Sub of a missing node is not nil")
+	}
+	var nilDoc *Document
+	if nilDoc.Sub([]string{"stacks"}) != nil {
+		t.Error("Sub of a nil document is not nil")
+	}
+}
+
+func TestParseSyntaxError(t *testing.T) {
+	_, err := Parse("stack.yaml", []byte("api: v1\nvars:\n  a: [1\n"))
+	if err == nil {
+		t.Fatal("Parse returned no error")
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Line == 0 || !strings.HasPrefix(err.Error(), fmt.Sprintf("stack.yaml:%d:", e.Line)) {
+		t.Errorf("syntax error is not positioned: %v", err)
+	}
+}
+
+func TestIsPositioned(t *testing.T) {
+	doc := parse(t)
+	if !IsPositioned(doc.Errorf(nil, "bad")) {
+		t.Error("*Error is not positioned")
+	}
+	if !IsPositioned(fmt.Errorf("wrapped: %w", Errors{doc.Errorf(nil, "a"), doc.Errorf(nil, "b")})) {
+		t.Error("wrapped Errors are not positioned")
+	}
+	if IsPositioned(errors.New("bad")) {
+		t.Error("plain error is positioned")
+	}
+	if err := doc.Wrap(errors.New("bad")); !IsPositioned(err) || err.Error() != "stack.yaml: bad" {
+		t.Errorf("Wrap = %v, want stack.yaml: bad", err)
+	}
+}
+
+func TestErrorsErrorOrNil(t *testing.T) {
+	doc := parse(t)
+	if Errors(nil).ErrorOrNil() != nil {
+		t.Error("empty Errors is not nil")
+	}
+	single := doc.Errorf(nil, "a")
+	if err := (Errors{single}).ErrorOrNil(); err != single {
+		t.Errorf("single Errors = %v, want the error itself", err)
+	}
+}